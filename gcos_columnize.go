@@ -1,53 +1,48 @@
 package main
 
-// This script takes the text input file of GHCN (Global Historical
-// Climatology Network) data and converts it to compressed binary
-// column vectors, in long format by year.
-//
-// The raw data are in wide format by station month, see the data file
+// This script takes the text input files of GHCN (Global Historical
+// Climatology Network) daily data and converts them to compressed
+// binary column vectors, sorted by station and date, with one
+// directory per partition (per year unless -partition is given).  The
+// raw data are in wide format by station month, see the data file
 // format here:
 //     ftp://ftp.ncdc.noaa.gov/pub/data/ghcn/daily/readme.txt
 //
-// We pivot the data to create files by year, combining data for all
-// stations and all days for a single year.  The resulting data are
-// stored in directories for each year, e.g.:
-//
-// 1909/
-//      ids.gz
-//      dates.gz
-//      values.gz
+// By default the element set by the "eltype" variable below (e.g.
+// TMAX) is stored in long format, with one value per row.  The
+// -elements flag instead stores several elements (e.g. TMAX,TMIN,PRCP)
+// as aligned columns, with one row per station and date and a validity
+// bitmap for each element.  The -feather and -parquet flags also write
+// each partition to an Arrow IPC (Feather) or Parquet file.
 //
-// The three data files are aligned, i.e. ids[i], dates[i], values[i]
-// correspond to an observation.  The data file formats are:
+// The input files that were used are recorded in a manifest, so that
+// running the script again only rebuilds the partitions that new or
+// changed input files contribute to.  The output is built in a staging
+// directory, with checkpoints from which an interrupted run resumes,
+// and replaces the previous output only when the run succeeds.
 //
-// ids.gz: the station identifiers as a newline (\n) delimited
-//     sequence of text values
-// dates.gz: the date of each observation, as a newline delimited
-//     sequence of iso formatted dates (e.g. 1909-03-15) for March
-//     15th 1909
-// values.gz: the temperature values, as a stream of native float64
-//     values
-//
-// The output files are sorted first by station then by date.
+// The output files and the flags are described in README.md, and by
+// the -help flag.  The ghcn package contains a reader for the output
+// (see ghcn.Store and gcos_extract.go).
 //
 // The data_path and out_path variables below should be set to
 // writeable directory paths in the file system.
 //
-// The script can be used to extract either daily maximum or daily
-// minimum temperature values, by setting the "eltype" variable below
-// to either "TMAX" or "TMIN" respectively.
-//
 // The script uses external libraries that can be obtained using:
-//     go get github.com/kshedden/ziparray
+//     go get github.com/DrGo/godata_workshop/ghcn
 
 import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"encoding/gob"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"sort"
@@ -55,7 +50,7 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/kshedden/ziparray"
+	"github.com/DrGo/godata_workshop/ghcn"
 )
 
 // Configurable values
@@ -69,19 +64,113 @@ var (
 	// The temperature type to process, should be either "TMAX" or
 	// "TMIN"
 	eltype = "TMAX"
-)
 
-var (
-	// A gob encoder for the data in each year
-	year_gob map[int]*gob.Encoder
+	// If not empty, the element types to process together (see
+	// ghcn.Elements for the types that can be used here), which are
+	// stored as aligned columns in one table rather than in the long
+	// format.  Can be configured from the command line.
+	elements []string
+
+	// Determines which daily values are used, can be configured
+	// from the command line
+	policy = ghcn.DefaultPolicy()
+
+	// Records the malformed lines and unreadable files, the
+	// acceptable error rate can be configured from the command line
+	report = ghcn.NewReport()
+
+	// Prints the progress while the input files are read, how often
+	// can be configured from the command line
+	progress = ghcn.NewProgress()
+
+	// Summarizes the run, written to the output directory at the end
+	metrics = ghcn.NewMetrics("gcos_columnize")
+
+	// Location of ghcnd-stations.txt and ghcnd-inventory.txt.  If
+	// not empty, the station metadata are written to stations.csv.gz
+	// in out_path.
+	meta_path = ""
+
+	// Selects the stations to process, can be configured from the
+	// command line
+	filter ghcn.StationFilter
+
+	// Determines how the output is divided into directories, can be
+	// configured from the command line
+	parts ghcn.Partitioning = ghcn.ByYear{}
+
+	// If true, the values are stored as int16 multiples of
+	// value_scale rather than as float64
+	use_int16 = false
+
+	// The value of one unit of the int16 values
+	value_scale = 0.1
+
+	// The number of rows in each block of the column files, see
+	// ghcn.PartStats
+	block_size = ghcn.DefaultBlockSize
 
-	// The backing data buffer for each gob encoder.  We can't
-	// store the files directly because of limits on the number of
-	// simultaneously open files.
-	year_buf map[int]*bytes.Buffer
+	// If true, each partition's data are also written to an Arrow IPC
+	// (Feather version 2) file
+	write_feather = false
 
-	// Safely send results from goroutines back to parent
-	rec_chan chan rec_t
+	// If true, each partition's data are also written to a Parquet file
+	write_parquet = false
+
+	// The layout of the Parquet files
+	parquet_opt = ghcn.DefaultParquetOptions()
+
+	// If true, the Parquet files are read back after they are
+	// written, and compared to the data
+	verify_parquet = false
+
+	// If true, all partitions are rebuilt even if the manifest shows
+	// that the inputs have not changed
+	full_rebuild = false
+
+	// If true, print what would be created or replaced, without
+	// changing any files
+	dry_run = false
+)
+
+// The name of the file that marks the directories created by this
+// script.  Directories that do not have this file are never removed
+// or replaced.
+const marker_file = ".gcos_columnize"
+
+var (
+	// The directory in which the output is built, and the directory
+	// that the previous output is moved to while the new output is
+	// published.  Both are next to out_path (see main), so that they
+	// can be renamed to out_path.
+	stage_path string
+	old_path   string
+
+	// Holds the data for each partition that have not yet been
+	// written to its temporary file, as fixed size records (see
+	// ghcn.Obs).  We can't store the files directly because of
+	// limits on the number of simultaneously open files.
+	spiller *ghcn.Spiller
+
+	// The number of bytes written to each partition's temporary
+	// file, for the partitions that have been set up
+	part_size map[string]int64
+	part_mu   sync.Mutex
+
+	// The batches of records sent by the goroutines that read the
+	// input files to the goroutines that encode them, one channel
+	// per shard.  The records of a partition always go to the same
+	// shard.
+	shard_chan []chan []ghcn.KeyObs
+
+	// The number of batches that have been sent but not encoded
+	batch_wg sync.WaitGroup
+
+	// The number of goroutines that encode the records
+	num_shards int = 4
+
+	// The number of records in each batch
+	batch_size int = 1024
 
 	// Semaphore, used to limit the number of input files being
 	// processed simultaneously (since a limited number of files
@@ -94,70 +183,150 @@ var (
 	// Used to manage concurrency
 	wg sync.WaitGroup
 
-	// Number of bytes per year to save in-memory before flushing to disk
-	buf_size int = 1e7
+	// The memory budget in bytes for the data of all partitions that
+	// are held in memory before being written to disk
+	buf_mem int = 1 << 28
+
+	// The order in which the partitions' data are written to disk
+	// when the budget is reached, ghcn.SpillLargest or
+	// ghcn.SpillOldest
+	spill_order = ghcn.SpillLargest
+
+	// The memory budget in bytes for sorting the records, shared by
+	// the partitions that are sorted at the same time
+	sort_mem int = 1 << 29
+
+	// The number of partitions that are sorted at the same time
+	sort_workers int = 4
+
+	// Semaphore, used to limit the number of partitions being
+	// sorted simultaneously
+	sort_sem chan bool
+
+	// The station metadata, if meta_path is set
+	stations map[string]*ghcn.Station
+
+	// The manifest of the input files that the output is built
+	// from, and a lock for updating it and the checkpoint
+	manifest    *ghcn.Manifest
+	manifest_mu sync.Mutex
+
+	// The progress of the run, which is written to stage_path so that
+	// an interrupted run can be resumed
+	ckpt *ghcn.Checkpoint
+
+	// The number of input files to read between checkpoints
+	ckpt_files int = 200
+
+	// If not nil, only the partitions for which keep_part returns
+	// true are being rebuilt
+	keep_part func(key string) bool
+
+	// The elements that are processed, which is eltype unless the
+	// elements variable is set, and the position of each
+	use_elements []string
+	el_index     map[string]int
 )
 
-// One data value (either maximum or minimum daily temperature)
-type rec_t struct {
-	Id    string  // The station id
-	Year  int     // The year of the data point
-	Month int     // The month of the data point (1..12)
-	Day   int     // The day within the month (1..31)
-	Value float64 // The data value (TMAX or TMIN)
+// The stations, years and partitions that an input file contributed
+// values to, and the number of its lines that were malformed
+type contrib_t struct {
+	ids     map[string]bool
+	years   map[int]bool
+	parts   map[string]bool
+	rejects int
 }
 
-// We will need to sort slices of rec_t values
-type recslice []rec_t
+// sender_t sends the records read by one goroutine to the shards
+// that encode them, in batches (see ghcn.Sender), and counts the
+// records of each year.
+type sender_t struct {
+	*ghcn.Sender
 
-// Needed for sorting.  Less implies sorting by station first, then
-// by date.
-func (a recslice) Len() int {
-	return len(a)
+	// The number of records for each year
+	years map[int]int64
 }
-func (a recslice) Swap(i, j int) {
-	a[i], a[j] = a[j], a[i]
+
+func newSender() *sender_t {
+	s := &sender_t{years: make(map[int]int64)}
+	s.Sender = ghcn.NewSender(num_shards, batch_size, s.send)
+	return s
 }
-func (a recslice) Less(i, j int) bool {
-	if a[i].Id < a[j].Id {
-		return true
-	} else if a[i].Id > a[j].Id {
-		return false
-	}
-	if a[i].Year < a[j].Year {
-		return true
-	} else if a[i].Year > a[j].Year {
-		return false
-	}
-	if a[i].Month < a[j].Month {
-		return true
-	} else if a[i].Month > a[j].Month {
-		return false
-	}
-	if a[i].Day < a[j].Day {
-		return true
-	} else if a[i].Day > a[j].Day {
-		return false
-	}
-	return false
+
+// add adds a record to the batch of its shard.
+func (s *sender_t) add(key string, r *ghcn.Obs) {
+	s.years[r.Year]++
+	s.Add(key, r)
 }
 
-// setupYear creates data structures to handle all the data we
-// encounter for one year.  It also truncates the file that will be
-// used for temporary data storage for the year's data.
-func setupYear(year int) {
-	year_buf[year] = new(bytes.Buffer)
-	year_gob[year] = gob.NewEncoder(year_buf[year])
+// send sends the batch of one shard.  The shard owns the batch after
+// it is sent.
+func (s *sender_t) send(k int, batch []ghcn.KeyObs) {
+	batch_wg.Add(1)
+	progress.AddRecords(len(batch))
+	shard_chan[k] <- batch
+}
+
+// flush sends the batches that are not empty, and adds the counts of
+// records by year to the metrics.
+func (s *sender_t) flush() {
+	s.Flush()
+	metrics.AddYears(s.years)
+}
 
-	// Make sure the output path exists
-	dname := path.Join(out_path, fmt.Sprintf("%d", year))
-	err := os.MkdirAll(dname, 0700)
+// The values of all elements for one station and date, and whether
+// each is present.  The slices are indexed like use_elements.
+type row_t struct {
+	Id     string
+	Date   ghcn.Date
+	Values []float64
+	Valid  []bool
+	MFlag  []byte
+	QFlag  []byte
+	SFlag  []byte
+}
+
+// newRow returns a row with no elements present.
+func newRow() *row_t {
+	n := len(use_elements)
+	return &row_t{Values: make([]float64, n), Valid: make([]bool, n),
+		MFlag: make([]byte, n), QFlag: make([]byte, n), SFlag: make([]byte, n)}
+}
+
+// clear marks all elements of the row as missing.
+func (r *row_t) clear() {
+	for k := range r.Values {
+		r.Values[k] = 0
+		r.Valid[k] = false
+		r.MFlag[k] = 0
+		r.QFlag[k] = 0
+		r.SFlag[k] = 0
+	}
+}
+
+// setupPart creates data structures to handle all the data we
+// encounter for one partition.  It also removes any earlier output for
+// the partition, and truncates the file that will be used for
+// temporary data storage for the partition's data.  It is called the
+// first time that a value for the partition is seen.
+func setupPart(key string) {
+	part_mu.Lock()
+	part_size[key] = 0
+	part_mu.Unlock()
+
+	// Make sure the output path exists and is empty
+	dname := path.Join(stage_path, key)
+	err := os.RemoveAll(dname)
+	if err != nil {
+		panic(err)
+	}
+	err = os.MkdirAll(dname, 0700)
 	if err != nil {
 		panic(err)
 	}
 
 	// Reset the output file
-	fn := tfileName(year)
+	fn := tfileName(key)
 	_, err = os.Create(fn)
 	if err != nil {
 		panic(err)
@@ -165,57 +334,55 @@ func setupYear(year int) {
 }
 
 // parse processes one row of data from a raw input file (i.e. data
-// for all days in one month for one station).
-func parse(line string) {
-
-	var err error
-
-	// The station id
-	id := line[0:11]
-
-	// The year for the data value
-	year, err := strconv.Atoi(line[11:15])
-	if err != nil {
-		panic(err)
+// for all days in one month for one station), passes the values to
+// snd, and records the station, year and partition in c if any values
+// are used.
+func parse(lrec *ghcn.Record, c *contrib_t, snd *sender_t) {
+
+	// Only the partitions that are being rebuilt are needed
+	key := parts.Key(lrec.Id, lrec.Year)
+	if keep_part != nil && !keep_part(key) {
+		return
 	}
 
-	// The month for the data value
-	month, err := strconv.Atoi(line[15:17])
-	if err != nil {
-		panic(err)
+	k := el_index[lrec.Element]
+	el := ghcn.Elements[lrec.Element]
+
+	// Slots past the end of the month are not days
+	ndays := lrec.NDays
+	if n := ghcn.DaysIn(lrec.Year, lrec.Month); n < ndays {
+		ndays = n
 	}
 
-	// Read all the daily temperature values.  See data format
-	// document for parsing details
-	for pos := 21; pos < len(line); pos += 8 {
+	for j, v := range lrec.Values[:ndays] {
 
-		// Skip if low quality
-		if line[26] != ' ' {
+		// Skip if missing or low quality
+		if !lrec.IsValid[j] {
 			continue
 		}
 
-		// The data value (maximum or minimum temperature)
-		sval := strings.TrimLeft(line[pos:pos+5], " ")
-		v, err := strconv.ParseFloat(sval, 64)
-		if err != nil {
-			panic(err)
-		}
-
-		// This represents a missing value
-		if v == -9999 {
-			continue
-		}
+		// Convert from the raw units (e.g. 0.1 degrees C) to the
+		// units of the element.  Dividing by 1/Scale gives the
+		// exact decimal value.
+		v /= 1 / el.Scale
 
-		// The raw data are in 0.1 degrees C, convert to degrees C
-		v /= 10
+		r := ghcn.Obs{Id: lrec.Id, Year: lrec.Year, Month: lrec.Month,
+			Day: j + 1, Element: k, Value: v, MFlag: lrec.MFlag[j],
+			QFlag: lrec.QFlag[j], SFlag: lrec.SFlag[j]}
+		snd.add(key, &r)
 
-		day := (pos-21)/8 + 1
-		r := rec_t{Id: id, Year: year, Month: month, Day: day, Value: v}
-		rec_chan <- r
+		c.ids[lrec.Id] = true
+		c.years[lrec.Year] = true
+		c.parts[key] = true
 	}
 }
 
-// processFile handles all processing for one data file (for one station).
+// processFile handles all processing for one data file (for one
+// station).  If the file is read in full, its contributions are
+// recorded in the manifest.  The file is recorded as done in the
+// checkpoint unless it could not be read, in which case the hash in
+// its manifest entry is cleared so that the next run reads it again
+// and rebuilds the partitions in the entry.
 func processFile(file os.FileInfo) {
 
 	defer func() {
@@ -223,232 +390,1454 @@ func processFile(file os.FileInfo) {
 		wg.Done()
 	}()
 
-	fmt.Printf("Reading %v\n", file.Name())
+	c := &contrib_t{ids: make(map[string]bool), years: make(map[int]bool),
+		parts: make(map[string]bool)}
+	fname := path.Join(data_path, file.Name())
+	nlines, err := readFile(fname, c)
+	report.File(fname, nlines, err)
+	progress.FileDone()
+
+	manifest_mu.Lock()
+	defer manifest_mu.Unlock()
+
+	// The entry of a file read in full starts with no partitions, the
+	// partitions from its previous entry are already affected (see
+	// planRun).  The values read before an error are in the
+	// partitions recorded below.
+	e := manifest.Files[file.Name()]
+	if err != nil {
+		e.Hash = ""
+	} else {
+		ckpt.Done = append(ckpt.Done, file.Name())
+		ckpt.Lines += nlines
+		ckpt.Rejects += c.rejects
+	}
+
+	if keep_part == nil {
+		for id := range c.ids {
+			e.Stations = append(e.Stations, id)
+		}
+		for year := range c.years {
+			e.Years = append(e.Years, year)
+		}
+		for key := range c.parts {
+			e.Parts = append(e.Parts, key)
+		}
+	}
+}
+
+// readFile reads one data file and returns the number of lines that
+// were read.  Malformed lines are skipped and recorded in the report.
+// If an error is returned, the values from the lines before the
+// problem have already been processed.
+func readFile(fname string, c *contrib_t) (int, error) {
 
 	// A file reader for the input file
-	fname := path.Join(data_path, file.Name())
 	fid, err := os.Open(fname)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	defer fid.Close()
 
-	// Wrap the file reader in a gzip reader
-	rdr, err := gzip.NewReader(fid)
+	// Wrap the file reader in a gzip reader, counting the bytes
+	// that are read
+	rdr, err := gzip.NewReader(progress.Reader(fid))
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("%s: %v", fname, err)
 	}
 	defer rdr.Close()
 
 	scanner := bufio.NewScanner(rdr)
 
-	// Read the lines of the file
+	// The values are sent to the shards in batches, the last batches
+	// are sent when the file is done.
+	snd := newSender()
+	defer snd.flush()
+
+	// Read the lines of the file.  The record is reused for every
+	// line.
+	var lrec ghcn.Record
+	lnum := 0
+
+	// The lines are counted in the progress every 1000 lines
+	defer func() {
+		progress.AddLines(lnum % 1000)
+	}()
+
 	for scanner.Scan() {
 
-		line := scanner.Text()
+		line := scanner.Bytes()
+		lnum++
+		if lnum%1000 == 0 {
+			progress.AddLines(1000)
+		}
 
 		// Check the element type first so we can skip the
-		// line if not being used.
-		eltype_val := line[17:21]
-		if eltype_val != eltype {
+		// line if not being used.  Lines that are too short are
+		// rejected by the parser.
+		if len(line) >= 21 {
+			if _, ok := el_index[string(line[17:21])]; !ok {
+				continue
+			}
+		}
+
+		err := ghcn.ParseBytes(line, policy, &lrec)
+		if err != nil {
+			report.Reject(&ghcn.LineError{File: fname, Line: lnum, Text: string(line), Err: err})
+			c.rejects++
 			continue
 		}
 
-		parse(line)
+		if !filter.Keep(lrec.Id, lrec.Element) {
+			continue
+		}
+
+		parse(&lrec, c, snd)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return lnum, fmt.Errorf("%s: line %d: %v", fname, lnum+1, err)
 	}
+
+	return lnum, nil
 }
 
-// Returns the name of the temporary data file for each year
-func tfileName(year int) string {
-	return path.Join(out_path, fmt.Sprintf("%d", year), "raw.bin")
+// Returns the name of the temporary data file for each partition
+func tfileName(key string) string {
+	return path.Join(stage_path, key, "raw.bin")
 }
 
-// flush writes the data from one in-memory buffer to a file on disk.
-func flush(year int) {
+// flush appends data from the in-memory buffer of a partition to its
+// temporary file on disk, it is called by the spiller.
+func flush(key string, data []byte) error {
 
-	fmt.Printf("Flushing %d\n", year)
-	fname := tfileName(year)
+	fname := tfileName(key)
 	fid, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0700)
+	if err != nil {
+		return err
+	}
+
+	n, err := fid.Write(data)
+	part_mu.Lock()
+	part_size[key] += int64(n)
+	part_mu.Unlock()
+	if err != nil {
+		fid.Close()
+		return err
+	}
+
+	return fid.Close()
+}
+
+// configString describes the settings that determine the contents of
+// the output.  Output built with other settings is rebuilt in full.
+func configString() string {
+	return fmt.Sprintf("element=%s wide=%v policy=%+v filter={%s} partition=%s int16=%v:%g "+
+		"blocks=%d feather=%v parquet=%v:%d", strings.Join(use_elements, ","), len(elements) > 0,
+		*policy, &filter, parts, use_int16,
+		value_scale, block_size, write_feather, write_parquet, parquet_opt.RowGroupSize)
+}
+
+// inputFiles returns the input data files, sorted by name.
+func inputFiles() []os.FileInfo {
+	files, err := ioutil.ReadDir(data_path)
 	if err != nil {
 		panic(err)
 	}
-	defer fid.Close()
+	return files
+}
+
+// writeCheckpoint records the progress of the run in stage_path.
+func writeCheckpoint() {
+	manifest_mu.Lock()
+	defer manifest_mu.Unlock()
 
-	_, err = fid.Write(year_buf[year].Bytes())
+	err := ckpt.Write(stage_path)
 	if err != nil {
 		panic(err)
 	}
-	year_buf[year].Truncate(0)
 }
 
-// processRaw processes the raw data into native go data structures.
-func processRaw() {
+// resumeCheckpoint returns the checkpoint of an interrupted run in the
+// staging directory, if the run can be resumed.
+func resumeCheckpoint() *ghcn.Checkpoint {
 
-	year_buf = make(map[int]*bytes.Buffer)
-	year_gob = make(map[int]*gob.Encoder)
-	rec_chan = make(chan rec_t)
-	sem = make(chan bool, sem_size)
+	c, err := ghcn.ReadCheckpoint(stage_path)
+	if err != nil {
+		panic(err)
+	}
+	if c == nil || full_rebuild {
+		return nil
+	}
+
+	if c.Config != configString() {
+		fmt.Printf("Settings have changed since the interrupted run, not resuming\n")
+		return nil
+	}
+
+	files := inputFiles()
+	if len(files) != len(c.Manifest.Files) {
+		fmt.Printf("Input files have changed since the interrupted run, not resuming\n")
+		return nil
+	}
+	for _, file := range files {
+		same, _, err := c.Manifest.Check(file.Name(), path.Join(data_path, file.Name()), file)
+		if err != nil {
+			panic(err)
+		}
+		if e := c.Manifest.Files[file.Name()]; !same && e != nil && e.Hash == "" {
+			fmt.Printf("%s could not be read in the interrupted run, not resuming\n", file.Name())
+			return nil
+		} else if !same {
+			fmt.Printf("%s has changed since the interrupted run, not resuming\n", file.Name())
+			return nil
+		}
+	}
+
+	return c
+}
+
+// planRun compares the input files to the manifest of the published
+// output and returns the initial checkpoint of a new run.  The second
+// return value is true if the run updates the published output, and
+// false if the output is built from scratch, which is the case if
+// full is true or there is no usable manifest.
+func planRun(full bool) (*ghcn.Checkpoint, bool) {
+
+	old, err := ghcn.ReadManifest(out_path)
+	if err != nil {
+		panic(err)
+	}
+	c := &ghcn.Checkpoint{Config: configString(), Phase: ghcn.PhaseIngest,
+		Manifest: ghcn.NewManifest(configString()), Sizes: make(map[string]int64)}
+
+	switch {
+	case full:
+		fmt.Printf("Rebuilding all partitions\n")
+		old = nil
+	case old == nil:
+		fmt.Printf("No manifest found, building all partitions\n")
+	case old.Config != c.Config:
+		fmt.Printf("Settings have changed, rebuilding all partitions\n")
+		old = nil
+	}
+	update := old != nil
+	if !update {
+		old = ghcn.NewManifest(c.Config)
+	}
+
+	// Compare the input files to the manifest.  The partitions that
+	// the changed or removed files contributed to must be rebuilt.
+	affected := make(map[string]bool)
+	nsame := 0
+	for _, file := range inputFiles() {
+		same, e, err := old.Check(file.Name(), path.Join(data_path, file.Name()), file)
+		if err != nil {
+			panic(err)
+		}
+		c.Manifest.Files[file.Name()] = e
+		if same {
+			nsame++
+			continue
+		}
+		c.Changed = append(c.Changed, file.Name())
+		if o, ok := old.Files[file.Name()]; ok {
+			for _, key := range o.Parts {
+				affected[key] = true
+			}
+		}
+	}
+	for name, o := range old.Files {
+		if _, ok := c.Manifest.Files[name]; !ok {
+			for _, key := range o.Parts {
+				affected[key] = true
+			}
+		}
+	}
+	for key := range affected {
+		c.Affected = append(c.Affected, key)
+	}
+	fmt.Printf("%d input files are new or changed, %d are unchanged\n",
+		len(c.Changed), nsame)
+
+	return c, update
+}
+
+// startRun creates a new staging directory.  If update is true, the
+// files of the published partitions are linked into it, so that only
+// the partitions that are rebuilt need to be written.  The linked
+// files are never written to, since the partitions that are rebuilt
+// are removed from the staging directory first (see setupPart).
+func startRun(update bool) {
 
-	// Reset the output directory
-	err := os.RemoveAll(out_path)
+	removeDir(stage_path)
+	err := os.MkdirAll(stage_path, 0700)
 	if err != nil {
 		panic(err)
 	}
-	err = os.MkdirAll(out_path, 0700)
+	err = ioutil.WriteFile(path.Join(stage_path, marker_file),
+		[]byte("Created by gcos_columnize, this directory may be replaced by it\n"), 0600)
 	if err != nil {
 		panic(err)
 	}
 
-	for year := 1833; year <= 2016; year++ {
-		setupYear(year)
+	if !update {
+		return
 	}
 
-	// Get a list of the input data file names
-	files, err := ioutil.ReadDir(data_path)
+	dirs, err := ioutil.ReadDir(out_path)
 	if err != nil {
 		panic(err)
 	}
+	for _, di := range dirs {
+		if !di.IsDir() {
+			continue
+		}
+		err = os.Mkdir(path.Join(stage_path, di.Name()), 0700)
+		if err != nil {
+			panic(err)
+		}
+		files, err := ioutil.ReadDir(path.Join(out_path, di.Name()))
+		if err != nil {
+			panic(err)
+		}
+		for _, fi := range files {
+			err = linkFile(path.Join(out_path, di.Name(), fi.Name()),
+				path.Join(stage_path, di.Name(), fi.Name()))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
 
-	// Process each file
-	go func() {
-		for _, file := range files {
-			wg.Add(1)
+// linkFile creates a hard link dst to the file src, or a copy of src if
+// the file system does not support links.
+func linkFile(src, dst string) error {
 
-			// We will only be able to put sem_size true's
-			// into the semaphore channel at once.  When a
-			// call to processFile completes, we remove
-			// one value from sem so that this loop can
-			// proceed to the next file.
-			sem <- true
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// removable returns true if the directory dname can be removed or
+// replaced: it does not exist, is empty, or has the marker file
+// showing that it was created by this script.
+func removable(dname string) bool {
+
+	files, err := ioutil.ReadDir(dname)
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		panic(err)
+	}
+
+	if len(files) == 0 {
+		return true
+	}
+	_, err = os.Stat(path.Join(dname, marker_file))
 
-			go processFile(file)
+	return err == nil
+}
+
+// checkRemovable panics if the directory dname cannot be removed or
+// replaced (see removable).
+func checkRemovable(dname string) {
+	if !removable(dname) {
+		panic(fmt.Sprintf("Refusing to remove or replace %s, which was not created by this script "+
+			"(it has no %s file)", dname, marker_file))
+	}
+}
+
+// removeDir removes the directory dname, which must have been created
+// by this script (see removable).
+func removeDir(dname string) {
+
+	checkRemovable(dname)
+	err := os.RemoveAll(dname)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// exists returns true if the file or directory fname exists.
+func exists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+// restoreOutput moves the previous output back to out_path, if a run
+// was interrupted while publishing its output.
+func restoreOutput() {
+
+	if exists(out_path) || !exists(old_path) {
+		return
+	}
+
+	fmt.Printf("Restoring %s from %s\n", out_path, old_path)
+	err := os.Rename(old_path, out_path)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// publish replaces the output in out_path by the output in the staging
+// directory.  The previous output is moved aside, and is only removed
+// once the new output is in place.
+func publish() {
+
+	removeDir(old_path)
+	if exists(out_path) {
+		checkRemovable(out_path)
+		err := os.Rename(out_path, old_path)
+		if err != nil {
+			panic(err)
 		}
-		wg.Wait()
+	}
 
-		// Close the channel to signal that we can stop reading.
-		close(rec_chan)
-	}()
+	err := os.Rename(stage_path, out_path)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Published the output to %s\n", out_path)
+
+	removeDir(old_path)
+}
+
+// dryRun prints what a run would create, replace or remove, without
+// changing any files.
+func dryRun() {
+
+	fmt.Printf("Dry run, no files will be changed\n")
+	if !exists(out_path) && exists(old_path) {
+		fmt.Printf("Would restore %s from %s\n", out_path, old_path)
+	}
+
+	if c := resumeCheckpoint(); c != nil {
+		fmt.Printf("Would resume the interrupted run in %s in the %s phase, %d input files "+
+			"are done and %d partitions are written\n", stage_path, c.Phase, len(c.Done), len(c.Sorted))
+	} else {
+		c, update := planRun(full_rebuild)
+		if exists(stage_path) {
+			fmt.Printf("Would remove the staging directory %s\n", stage_path)
+		}
+		fmt.Printf("Would build the output in the staging directory %s\n", stage_path)
+		for _, name := range c.Changed {
+			fmt.Printf("Would read %s\n", name)
+		}
+		if update {
+			sort.Strings(c.Affected)
+			for _, key := range c.Affected {
+				fmt.Printf("Would rebuild or remove partition %s\n", key)
+			}
+			if len(c.Changed) > 0 {
+				fmt.Printf("Would rebuild the partitions that the changed files contribute to\n")
+			}
+		}
+	}
+
+	if exists(out_path) {
+		fmt.Printf("Would replace %s\n", out_path)
+	} else {
+		fmt.Printf("Would create %s\n", out_path)
+	}
+	for _, dname := range []string{out_path, stage_path, old_path} {
+		if !removable(dname) {
+			fmt.Printf("Would refuse to replace %s, which has no %s file\n", dname, marker_file)
+		}
+	}
+}
+
+// processRaw processes the raw data into native go data structures.
+// If the output directory has a manifest from a run with the same
+// settings, only the input files that have changed since that run
+// are read in full, along with the parts of the unchanged files that
+// are needed to rebuild the partitions that the changed files
+// contribute to.  Otherwise the output is rebuilt from scratch.
+//
+// If the staging directory has a checkpoint from an interrupted run,
+// the run is resumed: the temporary files are truncated to their
+// sizes at the checkpoint, and only the input files that were not
+// done at the checkpoint are read.
+func processRaw() {
+
+	part_size = make(map[string]int64)
+	sem = make(chan bool, sem_size)
+
+	var err error
+	spiller, err = ghcn.NewSpiller(buf_mem, spill_order, flush)
+	if err != nil {
+		panic(err)
+	}
+
+	progress.Memory = func() (int64, int64) {
+		return int64(spiller.Used()), int64(buf_mem)
+	}
+	progress.Start()
+	defer progress.Stop()
+
+	c := resumeCheckpoint()
+	if c == nil {
+		var update bool
+		ckpt, update = planRun(full_rebuild)
+		manifest = ckpt.Manifest
+		startRun(update)
+		writeCheckpoint()
+	} else {
+		ckpt = c
+		manifest = ckpt.Manifest
+		fmt.Printf("Resuming the interrupted run in the %s phase, %d input files are done\n",
+			ckpt.Phase, len(ckpt.Done))
+		report.Add(len(ckpt.Done), ckpt.Lines, ckpt.Rejects)
+		report.Drop(ckpt.Dropped)
+		if ckpt.Phase != ghcn.PhaseIngest {
+			return
+		}
+		resumeParts()
+	}
+
+	files := inputFiles()
+	done := make(map[string]bool)
+	for _, name := range ckpt.Done {
+		done[name] = true
+	}
+	changed := make(map[string]bool)
+	for _, name := range ckpt.Changed {
+		changed[name] = true
+	}
+	affected := make(map[string]bool)
+	for _, key := range ckpt.Affected {
+		affected[key] = true
+	}
+
+	// Read the changed files in full.
+	var todo []os.FileInfo
+	for _, file := range files {
+		if changed[file.Name()] && !done[file.Name()] {
+			todo = append(todo, file)
+		}
+	}
+	keep_part = nil
+	ingest(todo)
+
+	for name := range changed {
+		for _, key := range manifest.Files[name].Parts {
+			affected[key] = true
+		}
+	}
+	ckpt.Affected = ckpt.Affected[0:0]
+	for key := range affected {
+		ckpt.Affected = append(ckpt.Affected, key)
+	}
+	writeCheckpoint()
+
+	// Read the data for the affected partitions from the unchanged
+	// files.
+	todo = todo[0:0]
+	for _, file := range files {
+		if changed[file.Name()] || done[file.Name()] {
+			continue
+		}
+		for _, key := range manifest.Files[file.Name()].Parts {
+			if affected[key] {
+				todo = append(todo, file)
+				break
+			}
+		}
+	}
+	keep_part = func(key string) bool {
+		return affected[key]
+	}
+	ingest(todo)
+	fmt.Printf("Rebuilding %d partitions\n", len(affected))
+
+	// Remove the partitions that no longer have any data
+	for key := range affected {
+		if _, ok := part_size[key]; !ok {
+			err := os.RemoveAll(path.Join(stage_path, key))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
 
-	// Read until the channel is closed
-	for r := range rec_chan {
-		year := r.Year
+	ckpt.Phase = ghcn.PhaseSort
+	writeCheckpoint()
+}
+
+// resumeParts restores the temporary files of the partitions to their
+// state at the checkpoint.  The partitions that were first seen after
+// the checkpoint are removed, they are set up again when their data
+// are read.
+func resumeParts() {
+
+	dirs, err := ioutil.ReadDir(stage_path)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, di := range dirs {
+		key := di.Name()
+		if !di.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(tfileName(key)); err != nil {
+			continue
+		}
 
-		// Since the setupYear range is based on fixed values
-		// we need to be ready if new years arise.
-		if year_gob[year] == nil {
-			msg := fmt.Sprintf("Year %d not set up properly.\n", year)
-			panic(msg)
+		size, ok := ckpt.Sizes[key]
+		if !ok {
+			err = os.RemoveAll(path.Join(stage_path, key))
+			if err != nil {
+				panic(err)
+			}
+			continue
 		}
 
-		err = year_gob[year].Encode(r)
+		err = os.Truncate(tfileName(key), size)
 		if err != nil {
 			panic(err)
 		}
-		if year_buf[year].Len() > buf_size {
-			flush(year)
+		part_size[key] = size
+	}
+}
+
+// ingest reads the given input files, and writes their values to the
+// temporary data files of the partitions.  A checkpoint is written
+// after every ckpt_files input files, and at the end.
+func ingest(files []os.FileInfo) {
+
+	progress.AddFiles(files)
+
+	shard_chan = make([]chan []ghcn.KeyObs, num_shards)
+	for k := range shard_chan {
+		shard_chan[k] = make(chan []ghcn.KeyObs, sem_size)
+		go encodeShard(shard_chan[k])
+	}
+
+	// Process each file
+	for i, file := range files {
+
+		// Wait for the files that are being read, so that the
+		// temporary files hold exactly the data from the files
+		// that are done, then write a checkpoint.
+		if i > 0 && i%ckpt_files == 0 {
+			wg.Wait()
+			checkpoint()
 		}
+
+		wg.Add(1)
+
+		// We will only be able to put sem_size true's into the
+		// semaphore channel at once.  When a call to processFile
+		// completes, we remove one value from sem so that this
+		// loop can proceed to the next file.
+		sem <- true
+
+		go processFile(file)
 	}
+	wg.Wait()
+
+	checkpoint()
 
-	// Write whatever is left to disk
-	for year, _ := range year_buf {
-		flush(year)
+	// Stop the shards
+	for _, ch := range shard_chan {
+		close(ch)
 	}
 }
 
-// doSortWrite takes the native go data structure for one year, sorts
-// by station then by date, and finally creates the final output
-// files.
-func doSortWrite(year int) {
+// encodeShard encodes the batches of records received on ch, and adds
+// them to the buffers of their partitions.  Consecutive records of the
+// same partition are added together.
+func encodeShard(ch chan []ghcn.KeyObs) {
+
+	seen := make(map[string]bool)
+	add := func(key string, data []byte) error {
+
+		// The partitions are set up when they are first seen, so
+		// that only partitions with data get a directory.
+		if !seen[key] {
+			part_mu.Lock()
+			_, ok := part_size[key]
+			part_mu.Unlock()
+			if !ok {
+				setupPart(key)
+			}
+			seen[key] = true
+		}
 
-	defer func() { wg.Done() }()
+		return spiller.Add(key, data)
+	}
 
-	// Read the sequence of rec_t values from disk into an array.
-	year_s := fmt.Sprintf("%d", year)
-	fn := path.Join(out_path, year_s, "raw.bin")
-	fid, err := os.Open(fn)
+	var buf []byte
+	for batch := range ch {
+		var err error
+		buf, err = ghcn.EncodeBatch(batch, buf, add)
+		if err != nil {
+			panic(err)
+		}
+		batch_wg.Done()
+	}
+}
+
+// checkpoint writes whatever is in the buffers to disk, and records
+// the sizes of the temporary files and the input files that are done.
+// It must only be called when no input files are being read.
+func checkpoint() {
+
+	// Wait for the batches that have been sent to be encoded
+	batch_wg.Wait()
+
+	err := spiller.FlushAll()
 	if err != nil {
 		panic(err)
 	}
-	dec := gob.NewDecoder(fid)
-	var x []rec_t
+	for key, size := range part_size {
+		ckpt.Sizes[key] = size
+	}
+	writeCheckpoint()
+}
+
+// doSortWrite sorts the data for one partition by station then by
+// date, and creates the final output files.  The sort uses at most
+// sort_mem/sort_workers bytes of memory for the records, larger
+// partitions are sorted in runs that are written to disk and then
+// merged.
+func doSortWrite(key string) {
+
+	defer func() {
+		<-sort_sem
+		wg.Done()
+	}()
+
+	dname := path.Join(stage_path, key)
+
+	// Remove any output and sorted runs left by an interrupted run.
+	files, err := ioutil.ReadDir(dname)
+	if err != nil {
+		panic(err)
+	}
+	for _, fi := range files {
+		if path.Join(dname, fi.Name()) != tfileName(key) {
+			err = os.Remove(path.Join(dname, fi.Name()))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// Read the records from disk into the sorter.
+	fid, err := os.Open(tfileName(key))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	sorter := ghcn.NewSorter(dname, ghcn.ObsLen, ghcn.ObsKeyLen, sort_mem/sort_workers)
+	rdr := bufio.NewReader(fid)
+	var buf [ghcn.ObsLen]byte
 	for {
-		var z rec_t
-		err = dec.Decode(&z)
+		_, err = io.ReadFull(rdr, buf[:])
 		if err == io.EOF {
 			break
+		} else if err == io.ErrUnexpectedEOF {
+			panic(fmt.Sprintf("%s: truncated record", tfileName(key)))
+		} else if err != nil {
+			panic(err)
 		}
+		err = sorter.Add(buf[:])
 		if err != nil {
 			panic(err)
 		}
-		x = append(x, z)
 	}
 
-	// Sort by station then by date
-	sort.Sort(recslice(x))
+	m, err := sorter.Sort()
+	if err != nil {
+		panic(err)
+	}
+	defer m.Close()
+	if sorter.Nruns > 0 {
+		fmt.Printf("Merging %d sorted runs for %s\n", sorter.Nruns, key)
+	}
 
-	// Split the go struct into arrays for each field.
-	ids := make([]string, len(x))
-	values := make([]float64, len(x))
-	dates := make([]string, len(x))
+	format := &ghcn.Format{Values: "float64", Elements: elements}
+	if use_int16 {
+		format.Values = "int16"
+		format.Scale = value_scale
+	}
+	pw, err := ghcn.NewPartWriter(dname, format)
+	if err != nil {
+		panic(err)
+	}
+	pw.BlockSize = block_size
+
+	// The Feather and Parquet files are written in parts of at most
+	// -row-group-size rows, as the rows come out of the merge.
+	var cb *colbuf_t
+	var aw *ghcn.ArrowWriter
+	var qw *ghcn.ParquetWriter
+	var afid, qfid *os.File
+	var sum *digest_t
+	if write_feather || write_parquet {
+		cb = newColbuf()
+		schema := cb.table()
+		if write_feather {
+			afid, err = os.Create(path.Join(dname, key+".feather"))
+			if err != nil {
+				panic(err)
+			}
+			defer afid.Close()
+			aw, err = ghcn.NewArrowWriter(afid, schema)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if write_parquet {
+			qfid, err = os.Create(path.Join(dname, key+".parquet"))
+			if err != nil {
+				panic(err)
+			}
+			defer qfid.Close()
+			qw, err = ghcn.NewParquetWriter(qfid, schema, parquet_opt)
+			if err != nil {
+				panic(err)
+			}
+			if verify_parquet {
+				sum = newDigest()
+			}
+		}
+	}
 
-	for i, y := range x {
-		ids[i] = y.Id
-		values[i] = y.Value
-		da := fmt.Sprintf("%4d-%02d-%02d", y.Year, y.Month, y.Day)
-		dates[i] = da
+	// writeParts writes the rows held in cb.
+	writeParts := func() {
+		t := cb.table()
+		if aw != nil {
+			err := aw.Write(t)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if qw != nil {
+			err := qw.Write(t)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if sum != nil {
+			sum.add(t)
+		}
+		cb.reset()
+	}
+
+	// The records for one station and date are combined into a row.
+	// Values that do not fit the value type (e.g. int16 with the
+	// given -scale) are counted and stored as missing, a row without
+	// any values is not written.
+	row := newRow()
+	dropped := 0
+	emit := func() {
+		nvalid := 0
+		for k := range row.Values {
+			if row.Valid[k] && !format.Fits(row.Values[k]) {
+				row.Valid[k] = false
+				dropped++
+			}
+			if row.Valid[k] {
+				nvalid++
+			}
+		}
+		if nvalid == 0 {
+			row.clear()
+			return
+		}
+
+		var err error
+		if len(elements) > 0 {
+			err = pw.WriteRow(row.Id, row.Date, row.Values, row.Valid)
+		} else {
+			err = pw.Write(row.Id, row.Date, row.Values[0])
+		}
+		if err != nil {
+			panic(err)
+		}
+		if cb != nil {
+			cb.add(row)
+			if cb.len() >= parquet_opt.RowGroupSize {
+				writeParts()
+			}
+		}
+		row.clear()
 	}
 
-	fname := path.Join(out_path, year_s, "ids.gz")
-	ziparray.WriteString(ids, fname)
+	var z ghcn.Obs
+	var last [ghcn.ObsDateLen]byte
+	n := 0
+	for {
+		b, err := m.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		if n > 0 && !bytes.Equal(b[0:ghcn.ObsDateLen], last[:]) {
+			emit()
+		}
+		copy(last[:], b[0:ghcn.ObsDateLen])
+		n++
+
+		z.Decode(b)
+		row.Id = z.Id
+		row.Date = ghcn.NewDate(z.Year, z.Month, z.Day)
+		row.Values[z.Element] = z.Value
+		row.Valid[z.Element] = true
+		row.MFlag[z.Element] = z.MFlag
+		row.QFlag[z.Element] = z.QFlag
+		row.SFlag[z.Element] = z.SFlag
+	}
+	if n > 0 {
+		emit()
+	}
 
-	fname = path.Join(out_path, year_s, "values.gz")
-	ziparray.WriteFloat64(values, fname)
+	if cb != nil {
+		if cb.len() > 0 {
+			writeParts()
+		}
+		if aw != nil {
+			err = aw.Close()
+			if err == nil {
+				err = afid.Close()
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		if qw != nil {
+			err = qw.Close()
+			if err == nil {
+				err = qfid.Close()
+			}
+			if err != nil {
+				panic(err)
+			}
+			if sum != nil {
+				verifyParquet(qfid.Name(), sum)
+			}
+		}
+	}
 
-	fname = path.Join(out_path, year_s, "dates.gz")
-	ziparray.WriteString(dates, fname)
+	// This writes the format file, which marks the partition as
+	// complete.
+	err = pw.Close()
+	if err != nil {
+		panic(err)
+	}
 
 	// Remove the temporary data file.
-	err = os.Remove(tfileName(year))
+	fid.Close()
+	err = os.Remove(tfileName(key))
+	if err != nil {
+		panic(err)
+	}
+
+	if dropped > 0 {
+		fmt.Printf("Stored %d values of %s as missing, they do not fit in %s with scale %g\n",
+			dropped, key, format.Values, format.Scale)
+	}
+	report.Drop(dropped)
+
+	manifest_mu.Lock()
+	ckpt.Sorted = append(ckpt.Sorted, key)
+	ckpt.Dropped += dropped
+	manifest_mu.Unlock()
+	writeCheckpoint()
+}
+
+// flagString returns a GHCN flag as a string, which is empty if the
+// flag is not set.
+func flagString(f byte) string {
+	if f == ' ' || f == 0 {
+		return ""
+	}
+	return string(f)
+}
+
+// The sorted rows of a partition, held as columns for the Feather
+// and Parquet writers.  The element values and flags are indexed like
+// use_elements.
+type colbuf_t struct {
+	ids    []string
+	dates  []ghcn.Date
+	values [][]float64
+	valid  [][]bool // nil in the long format, which has no missing values
+	mflag  [][]string
+	qflag  [][]string
+	sflag  [][]string
+}
+
+// newColbuf returns an empty set of columns.
+func newColbuf() *colbuf_t {
+	n := len(use_elements)
+	c := &colbuf_t{values: make([][]float64, n), valid: make([][]bool, n),
+		mflag: make([][]string, n), qflag: make([][]string, n), sflag: make([][]string, n)}
+	if len(elements) > 0 {
+		for k := range c.valid {
+			c.valid[k] = []bool{}
+		}
+	}
+	return c
+}
+
+// add appends a row to the columns.
+func (c *colbuf_t) add(r *row_t) {
+	c.ids = append(c.ids, r.Id)
+	c.dates = append(c.dates, r.Date)
+	for k := range use_elements {
+		c.values[k] = append(c.values[k], r.Values[k])
+		c.mflag[k] = append(c.mflag[k], flagString(r.MFlag[k]))
+		c.qflag[k] = append(c.qflag[k], flagString(r.QFlag[k]))
+		c.sflag[k] = append(c.sflag[k], flagString(r.SFlag[k]))
+		if c.valid[k] != nil {
+			c.valid[k] = append(c.valid[k], r.Valid[k])
+		}
+	}
+}
+
+// len returns the number of rows held.
+func (c *colbuf_t) len() int {
+	return len(c.ids)
+}
+
+// reset removes the rows, keeping the memory for reuse.
+func (c *colbuf_t) reset() {
+	c.ids = c.ids[:0]
+	c.dates = c.dates[:0]
+	for k := range use_elements {
+		c.values[k] = c.values[k][:0]
+		c.mflag[k] = c.mflag[k][:0]
+		c.qflag[k] = c.qflag[k][:0]
+		c.sflag[k] = c.sflag[k][:0]
+		if c.valid[k] != nil {
+			c.valid[k] = c.valid[k][:0]
+		}
+	}
+}
+
+// table returns the rows held as a table, which shares the memory of
+// the columns until reset is called.  In the long format, the columns
+// are id, date, value, mflag, qflag and sflag.  With several
+// elements, the columns are id and date, followed by the value and
+// flags of each element, e.g. tmax, tmax_mflag, tmax_qflag and
+// tmax_sflag, which are null where the element is missing.
+func (c *colbuf_t) table() *ghcn.Table {
+
+	ids, dates := c.ids, c.dates
+	if ids == nil {
+		ids, dates = []string{}, []ghcn.Date{}
+	}
+
+	t := &ghcn.Table{Metadata: map[string]string{"element": strings.Join(use_elements, ",")}}
+	t.Add("id", ids, nil)
+	t.Add("date", dates, nil)
+
+	for k, e := range use_elements {
+		values, mflag, qflag, sflag := c.values[k], c.mflag[k], c.qflag[k], c.sflag[k]
+		if values == nil {
+			values = []float64{}
+			mflag, qflag, sflag = []string{}, []string{}, []string{}
+		}
+		name, prefix := "value", ""
+		if len(elements) > 0 {
+			name = strings.ToLower(e)
+			prefix = name + "_"
+		}
+		t.Add(name, values, c.valid[k])
+		t.Add(prefix+"mflag", mflag, c.valid[k])
+		t.Add(prefix+"qflag", qflag, c.valid[k])
+		t.Add(prefix+"sflag", sflag, c.valid[k])
+	}
+
+	return t
+}
+
+// A hash of each column of the tables passed to add, used to check
+// the Parquet files without holding all of a partition's data.
+type digest_t struct {
+	names []string
+	rows  int
+	sums  []hash.Hash64
+}
+
+func newDigest() *digest_t {
+	return new(digest_t)
+}
+
+// add adds the rows of t to the hashes.  Missing values are hashed
+// the same way whatever their value, since the Parquet files do not
+// store them.
+func (d *digest_t) add(t *ghcn.Table) {
+
+	if d.sums == nil {
+		d.names = t.Names
+		for range t.Columns {
+			d.sums = append(d.sums, fnv.New64a())
+		}
+	}
+	d.rows += t.Len()
+
+	var buf [8]byte
+	for j, col := range t.Columns {
+		h := d.sums[j]
+		valid := t.Valid[j]
+		for i := 0; i < t.Len(); i++ {
+			if valid != nil && !valid[i] {
+				h.Write([]byte{0})
+				continue
+			}
+			h.Write([]byte{1})
+			switch x := col.(type) {
+			case []string:
+				binary.LittleEndian.PutUint32(buf[0:4], uint32(len(x[i])))
+				h.Write(buf[0:4])
+				h.Write([]byte(x[i]))
+			case []ghcn.Date:
+				binary.LittleEndian.PutUint32(buf[0:4], uint32(x[i]))
+				h.Write(buf[0:4])
+			case []float64:
+				binary.LittleEndian.PutUint64(buf[:], math.Float64bits(x[i]))
+				h.Write(buf[:])
+			}
+		}
+	}
+}
+
+// verifyParquet reads back a Parquet file written by doSortWrite, and
+// panics if its columns do not have the hashes in want.
+func verifyParquet(fname string, want *digest_t) {
+
+	t, err := ghcn.ReadParquetFile(fname)
 	if err != nil {
 		panic(err)
 	}
+
+	got := newDigest()
+	got.add(t)
+	if strings.Join(got.names, ",") != strings.Join(want.names, ",") || got.rows != want.rows {
+		panic(fmt.Sprintf("%s: found columns %v and %d rows, expected columns %v and %d rows",
+			fname, got.names, got.rows, want.names, want.rows))
+	}
+
+	for j, name := range want.names {
+		if got.sums[j].Sum64() != want.sums[j].Sum64() {
+			panic(fmt.Sprintf("%s: the values of column %s differ from the data", fname, name))
+		}
+	}
 }
 
-// recsort loops over the years and manages the process of sorting and
-// generating final output.
+// recsort loops over the partitions that have new data and manages the
+// process of sorting and generating final output.  The partitions that
+// were sorted before a checkpoint are skipped.
 func recsort() {
 
 	fmt.Printf("Sorting and writing output...\n")
 
 	// Get a list of the directory names (a directory for each
-	// year)
-	dirs, err := ioutil.ReadDir(out_path)
+	// partition).  Only the partitions with a temporary data file
+	// have been rebuilt.
+	dirs, err := ioutil.ReadDir(stage_path)
 	if err != nil {
 		panic(err)
 	}
 
+	sorted := make(map[string]bool)
+	for _, key := range ckpt.Sorted {
+		sorted[key] = true
+	}
+
 	// Reset since we may have used it already in step 1
 	wg = sync.WaitGroup{}
+	sort_sem = make(chan bool, sort_workers)
 
-	// This is "embarrassingly simple" parallelism
+	// This is "embarrassingly simple" parallelism, limited to
+	// sort_workers partitions at a time
 	for _, di := range dirs {
 		if !di.IsDir() {
 			continue
 		}
+		if _, err := os.Stat(tfileName(di.Name())); err != nil {
+			continue
+		}
+		if sorted[di.Name()] {
+			continue
+		}
 
-		year, err := strconv.Atoi(di.Name())
+		wg.Add(1)
+		sort_sem <- true
+		go doSortWrite(di.Name())
+	}
+
+	wg.Wait()
+}
+
+// writeLayout records the partitioning and the years that have data,
+// for use by readers of the output.
+func writeLayout() {
+
+	years := make(map[int]bool)
+	for _, e := range manifest.Files {
+		for _, year := range e.Years {
+			years[year] = true
+		}
+	}
+
+	layout := &ghcn.Layout{Partitioning: parts.String(), Years: []int{}, Elements: elements}
+	for year := range years {
+		layout.Years = append(layout.Years, year)
+	}
+	sort.Ints(layout.Years)
+
+	err := ghcn.WriteLayout(stage_path, layout)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// setupElements sets the elements that are processed.
+func setupElements() {
+
+	use_elements = elements
+	if len(use_elements) == 0 {
+		use_elements = []string{eltype}
+	}
+
+	el_index = make(map[string]int)
+	for k, e := range use_elements {
+		if _, ok := ghcn.Elements[e]; !ok {
+			panic(fmt.Sprintf("Unknown element type %q", e))
+		}
+		if _, ok := el_index[e]; ok {
+			panic(fmt.Sprintf("Element type %q is given more than once", e))
+		}
+		el_index[e] = k
+	}
+}
+
+// setupStations reads the station metadata if it is available.
+func setupStations() {
+
+	if meta_path != "" {
+		var err error
+		stations, err = ghcn.LoadStations(meta_path)
 		if err != nil {
 			panic(err)
 		}
+		filter.Stations = stations
+	}
 
-		wg.Add(1)
-		go doSortWrite(year)
+	if filter.NeedsMetadata() && stations == nil {
+		panic("The -bbox and -coverage flags require station metadata, see -meta")
 	}
+}
 
-	wg.Wait()
+// writeMetrics writes the summary of the run to the output.
+func writeMetrics() {
+
+	metrics.Finish(progress, report)
+	metrics.Set("RebuiltPartitions", len(ckpt.Sorted))
+	metrics.Set("SpilledBuffers", spiller.Spills)
+	metrics.Set("SpilledBytes", spiller.SpillBytes)
+	metrics.Set("FlushedBuffers", spiller.Flushes)
+	metrics.Set("FlushedBytes", spiller.FlushBytes)
+	metrics.Set("PeakBufferBytes", spiller.Peak)
+
+	err := metrics.Write(path.Join(stage_path, ghcn.MetricsFile))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// writeStations writes the metadata for all stations that have data
+// in the output to a csv file, which can be joined to the ids column.
+func writeStations() {
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, e := range manifest.Files {
+		for _, id := range e.Stations {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	fname := path.Join(stage_path, "stations.csv.gz")
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	wtr := gzip.NewWriter(fid)
+	defer wtr.Close()
+
+	wtr.Write([]byte("Id," + ghcn.StationHeader + "\n"))
+	for _, id := range ids {
+		wtr.Write([]byte(id + "," + stations[id].CSV() + "\n"))
+	}
 }
 
 func main() {
+	flag.StringVar(&meta_path, "meta", meta_path,
+		"Directory containing ghcnd-stations.txt and ghcnd-inventory.txt")
+	flag.BoolVar(&full_rebuild, "full", full_rebuild,
+		"Rebuild all partitions, even if the inputs have not changed")
+	flag.IntVar(&ckpt_files, "checkpoint-files", ckpt_files,
+		"The number of input files to read between checkpoints")
+	flag.BoolVar(&dry_run, "dry-run", dry_run,
+		"Print what would be created or replaced, without changing any files")
+	flag.BoolVar(&use_int16, "int16", use_int16,
+		"Store the values as int16 multiples of -scale rather than float64")
+	flag.Float64Var(&value_scale, "scale", value_scale,
+		"The value of one unit of the int16 values, e.g. 0.1 degrees")
+	flag.IntVar(&block_size, "block-size", block_size,
+		"The number of rows in each block of the column files, each block has its own statistics in stats.json")
+	flag.BoolVar(&write_feather, "feather", write_feather,
+		"Also write each partition to an Arrow IPC (Feather) file, e.g. 1909/1909.feather")
+	flag.BoolVar(&write_parquet, "parquet", write_parquet,
+		"Also write each partition to a Parquet file, e.g. 1909/1909.parquet")
+	flag.IntVar(&parquet_opt.RowGroupSize, "row-group-size", parquet_opt.RowGroupSize,
+		"The number of rows in each Parquet row group and Feather record batch")
+	flag.BoolVar(&verify_parquet, "verify", verify_parquet,
+		"Read back each Parquet file and compare it to the data")
+	flag.Func("mem", "Memory budget for the data held before writing to the temporary files, in MB (default 256)",
+		func(s string) error {
+			mb, err := strconv.Atoi(s)
+			buf_mem = mb << 20
+			return err
+		})
+	flag.StringVar(&spill_order, "spill", spill_order,
+		"Write the largest or the oldest buffers to disk first when the -mem budget is reached, until half of it is free")
+	flag.IntVar(&num_shards, "shards", num_shards,
+		"The number of goroutines that encode the records")
+	flag.IntVar(&batch_size, "batch", batch_size,
+		"The number of records sent to the encoding goroutines at a time")
+	flag.Func("sort-mem", "Memory budget for sorting, in MB (default 512), larger partitions are sorted in runs on disk", func(s string) error {
+		mb, err := strconv.Atoi(s)
+		sort_mem = mb << 20
+		return err
+	})
+	flag.IntVar(&sort_workers, "sort-workers", sort_workers,
+		"The number of partitions that are sorted at the same time")
+	flag.Func("elements", "Store the given comma separated element types (e.g. TMAX,TMIN,PRCP) as aligned columns, rather than eltype",
+		func(s string) error {
+			elements = strings.Split(s, ",")
+			return nil
+		})
+	flag.Func("partition", "Partition the output by year, decade, station or prefix:N "+
+		"(default year)", func(s string) error {
+		var err error
+		parts, err = ghcn.ParsePartitioning(s)
+		return err
+	})
+	policy.RegisterFlags(flag.CommandLine)
+	filter.RegisterFlags(flag.CommandLine)
+	report.RegisterFlags(flag.CommandLine)
+	progress.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if sort_workers < 1 {
+		panic("-sort-workers must be at least 1")
+	}
+	if ckpt_files < 1 {
+		panic("-checkpoint-files must be at least 1")
+	}
+	if block_size < 1 {
+		panic("-block-size must be at least 1")
+	}
+	if num_shards < 1 {
+		panic("-shards must be at least 1")
+	}
+	if batch_size < 1 {
+		panic("-batch must be at least 1")
+	}
+
+	stage_path = out_path + ".staging"
+	old_path = out_path + ".old"
+
+	setupElements()
+	setupStations()
+
+	if dry_run {
+		dryRun()
+		return
+	}
+
+	// Check before doing any work that the output can be replaced.
+	metrics.Phase("setup")
+	restoreOutput()
+	checkRemovable(out_path)
+
+	err := report.Open()
+	if err != nil {
+		panic(err)
+	}
+
+	metrics.Phase("ingest")
 	processRaw()
+	metrics.Phase("sort")
 	recsort()
+	metrics.Phase("finish")
+	writeLayout()
+
+	if stations != nil {
+		writeStations()
+	}
+
+	err = report.Close()
+	if err != nil {
+		panic(err)
+	}
+	report.Summary(os.Stdout)
+	spiller.Summary(os.Stdout)
+
+	// A run with too many errors keeps its checkpoint, so that it can
+	// be resumed with a larger -max-error-rate without reading the
+	// input again.
+	if report.Failed() {
+		fmt.Printf("The output in %s was not published, run again with a larger -max-error-rate to publish it\n",
+			stage_path)
+		os.Exit(1)
+	}
+
+	// The manifest and the metrics are written last, then the
+	// checkpoint is removed to mark the run as complete.
+	err = manifest.Write(stage_path)
+	if err != nil {
+		panic(err)
+	}
+	writeMetrics()
+	err = os.Remove(path.Join(stage_path, ghcn.CheckpointFile))
+	if err != nil {
+		panic(err)
+	}
+
+	publish()
 }
@@ -0,0 +1,127 @@
+package main
+
+// This script reads the columnized data written by gcos_columnize.go
+// and prints the selected observations to stdout in csv format.  It
+// shows how the ghcn.Store reader can be used to stream many years of
+// data without holding them in memory.
+//
+// Example usage:
+//    go run gcos_extract.go -years=1990-1999 -ids=USW00094728,CA006158355
+//    go run gcos_extract.go -prefix=US -above=40
+//    go run gcos_extract.go -element=PRCP -above=100
+//
+// The store keeps statistics for each partition and for blocks of rows
+// within it, so selective queries such as the second one only
+// decompress the blocks that may contain matching observations.
+//
+// If the store holds several elements (see the -elements flag of
+// gcos_columnize.go), the value of every element is printed, with an
+// empty cell where the element is missing, unless the -element flag
+// selects one of them.
+//
+// The store_path variable below must be set to the directory that
+// gcos_columnize.go writes to.
+//
+// The script uses the ghcn package in this repository, which must be
+// located in your GOPATH, e.g. by using:
+//     go get github.com/DrGo/godata_workshop/ghcn
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DrGo/godata_workshop/ghcn"
+)
+
+var (
+	// Location of the columnized data
+	store_path = "/nfs/kshedden/GHCN_tmp"
+
+	// The range of years to read
+	first_year, last_year int = 0, 9999
+
+	// Selects the observations to print
+	filter ghcn.Filter
+)
+
+// valueFlag returns a flag function that parses a number into *v.
+func valueFlag(v **float64) func(string) error {
+	return func(s string) error {
+		x, err := strconv.ParseFloat(s, 64)
+		*v = &x
+		return err
+	}
+}
+
+// dateFlag returns a flag function that parses an iso date into t.
+func dateFlag(t *time.Time) func(string) error {
+	return func(s string) error {
+		var err error
+		*t, err = time.Parse("2006-01-02", s)
+		return err
+	}
+}
+
+func main() {
+
+	flag.StringVar(&store_path, "store", store_path, "Location of the columnized data")
+	flag.Func("years", "Range of years first-last to read", func(s string) error {
+		_, err := fmt.Sscanf(s, "%d-%d", &first_year, &last_year)
+		return err
+	})
+	flag.Func("ids", "Comma separated station ids to print", func(s string) error {
+		filter.Ids = strings.Split(s, ",")
+		return nil
+	})
+	flag.Func("from", "First date to print (e.g. 1990-06-01)", dateFlag(&filter.From))
+	flag.Func("to", "Last date to print (e.g. 1990-08-31)", dateFlag(&filter.To))
+	flag.StringVar(&filter.Prefix, "prefix", "", "Station id prefix to print (e.g. the country code US)")
+	flag.Func("above", "Only print values greater than this", valueFlag(&filter.Above))
+	flag.Func("below", "Only print values less than this", valueFlag(&filter.Below))
+	flag.StringVar(&filter.Element, "element", "", "In a store of several elements, the element to print")
+	flag.Parse()
+
+	store, err := ghcn.OpenStore(store_path)
+	if err != nil {
+		panic(err)
+	}
+
+	wtr := bufio.NewWriter(os.Stdout)
+	defer wtr.Flush()
+
+	// Print all the elements if none is selected.
+	wide := len(store.Elements()) > 0 && filter.Element == ""
+	if wide {
+		wtr.WriteString("Id,Date," + strings.Join(store.Elements(), ",") + "\n")
+	} else {
+		wtr.WriteString("Id,Date,Value\n")
+	}
+
+	sc := store.Scan(first_year, last_year, &filter)
+	defer sc.Close()
+	for sc.Next() {
+		r := sc.Row()
+		if !wide {
+			fmt.Fprintf(wtr, "%s,%s,%g\n", r.Id, r.Date, r.Value)
+			continue
+		}
+		fmt.Fprintf(wtr, "%s,%s", r.Id, r.Date)
+		for k, v := range r.Values {
+			if r.Valid[k] {
+				fmt.Fprintf(wtr, ",%g", v)
+			} else {
+				wtr.WriteString(",")
+			}
+		}
+		wtr.WriteString("\n")
+	}
+
+	if err := sc.Err(); err != nil {
+		panic(err)
+	}
+}
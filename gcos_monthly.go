@@ -1,7 +1,11 @@
 package main
 
-// This script constructs monthly averages from daily temperature
-// records for the GCOS surface network (GCOS GSN).
+// This script constructs monthly summaries from daily records for the
+// GCOS surface network (GCOS GSN).  Every element type listed in the
+// "elements" variable below is processed in a single pass over the
+// station files.  The rule used to summarize each element (a mean for
+// temperatures, a total for precipitation and snowfall, a maximum for
+// snow depth) and its units are defined in the ghcn package.
 //
 // This is the non-concurrent version of the script, see
 // gcos_monthly_concurrent.go for the concurrent version.
@@ -22,18 +26,65 @@ package main
 // The data_path and out_path variables below must be set to
 // appropriate local directory paths.
 //
+// Besides the monthly value, each output row contains the minimum,
+// maximum, standard deviation and median of the daily values, and the
+// number of days above or below the thresholds set with the -above
+// and -below flags.  Months that fail the completeness rule set with
+// the -complete flag (by default the WMO "3/5 rule") have Complete=0
+// in the output, or are dropped if -drop-incomplete is set.  Values
+// that cannot be computed are left blank.
+//
+// Values flagged by the quality checks are skipped, the -qflag-reject,
+// -qflag-keep and -sources flags can be used to change which values
+// are used (see ghcn.Policy).
+//
+// Malformed lines are skipped, and files that cannot be read are left
+// out of the output.  A summary of these problems is printed at the
+// end of the run, and the malformed lines are written to the file
+// given by the -rejects flag.  The script exits with a non-zero status
+// if the fraction of malformed lines or unreadable files exceeds the
+// -max-error-rate flag (0.001 by default).
+//
+// A line showing the number of files done, the rates at which lines
+// are read and monthly records produced, the amount of data read, the
+// size of the heap and the estimated time remaining is printed every
+// -progress interval.  At the end of the run, the duration of each
+// phase, the amount of data read, the number of monthly records for
+// each year and the number of malformed lines and unreadable files are
+// written to the file gcos_monthly_metrics.json next to the output (see
+// ghcn.Metrics).
+//
+// If the -meta flag gives the location of the ghcnd-stations.txt and
+// ghcnd-inventory.txt files, the station name, location and network
+// flags are added to each output row.  The -country, -bbox and
+// -coverage flags select stations by country code, location and
+// period of record (see ghcn.StationFilter).
+//
+// If the -baseline flag gives a reference period (e.g. 1981-2010), a
+// baseline is computed for each station, element and calendar month
+// as the mean of the monthly values in the reference period, and the
+// difference between each monthly value and its baseline is added to
+// the output as the Anomaly column.  Baselines with fewer than
+// -baseline-min-years years of data are not used, these are listed in
+// a separate csv file.
+//
 // The data file format is available here:
 // ftp://ftp.ncdc.noaa.gov/pub/data/ghcn/daily/readme.txt
+//
+// The script uses the ghcn package in this repository, which must be
+// located in your GOPATH, e.g. by using:
+//     go get github.com/DrGo/godata_workshop/ghcn
 
 import (
 	"bufio"
 	"compress/gzip"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
-	"strconv"
-	"strings"
+
+	"github.com/DrGo/godata_workshop/ghcn"
 )
 
 var (
@@ -43,148 +94,300 @@ var (
 	// Path where the output file is written
 	out_path = "/nfs/kshedden/GHCN"
 
-	// The temperature type to process, should be either "TMAX" or
-	// "TMIN"
-	eltype = "TMAX"
+	// The element types to process, see ghcn.Elements for the
+	// types that can be used here
+	elements = []string{"PRCP", "SNOW", "SNWD", "TAVG", "TMIN", "TMAX"}
 
-	// io.Writer for the output file
-	wtr *gzip.Writer
-)
+	// The element types in the elements variable, as a set
+	use_element map[string]bool
 
-// The data in one line of the input file
-type lrec_t struct {
-	Id      string    // The station id
-	Year    int       // The year of the data point
-	Month   int       // The month of the data point (1..12)
-	Element string    // The data value type (TMAX or TMIN)
-	Values  []float64 // The daily values
-	IsValid []bool    // Validity flags for the data
-}
+	// Determines which daily values are used, can be configured
+	// from the command line
+	policy = ghcn.DefaultPolicy()
 
-// The summary record for one month
-type mrec_t struct {
-	Id     string  // The station id
-	Year   int     // The year of the data point
-	Month  int     // The month of the data point (1..12)
-	Mean   float64 // The mean value
-	Nvalid int     // The number of valid values in the mean
-}
+	// Records the malformed lines and unreadable files, the
+	// acceptable error rate can be configured from the command line
+	report = ghcn.NewReport()
+
+	// Prints the progress while the files are read, how often can be
+	// configured from the command line
+	progress = ghcn.NewProgress()
 
-// Parse one line of a raw file and put the results into a structure.
-func parse(line string) *lrec_t {
+	// Summarizes the run, written next to the output file at the end
+	metrics = ghcn.NewMetrics("gcos_monthly")
 
-	var rec lrec_t
-	var err error
+	// Computes the monthly summaries, the completeness rule and
+	// thresholds can be configured from the command line
+	summarizer = ghcn.NewSummarizer()
 
-	rec.Id = line[0:11]
+	// Location of ghcnd-stations.txt and ghcnd-inventory.txt.  If
+	// not empty, the station metadata are added to the output.
+	meta_path = ""
 
-	rec.Year, err = strconv.Atoi(line[11:15])
+	// The station metadata, if meta_path is set
+	stations map[string]*ghcn.Station
+
+	// Selects the stations to process, can be configured from the
+	// command line
+	filter ghcn.StationFilter
+
+	// If a reference period is set, anomalies relative to the
+	// baseline for each calendar month are added to the output
+	baseline = ghcn.BaselineRule{MinYears: 20}
+
+	// The baselines that could not be computed
+	base_fail []ghcn.ClimFailure
+
+	// io.Writer for the output file
+	wtr *gzip.Writer
+)
+
+// readFile reads one data file and returns the summary records for
+// the file, and the number of lines that were read.  Malformed lines
+// are skipped and recorded in the report.
+func readFile(fname string) ([]*ghcn.Month, int, error) {
+
+	// A file reader for the input file
+	fid, err := os.Open(fname)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
+	defer fid.Close()
 
-	rec.Month, err = strconv.Atoi(line[15:17])
+	// Wrap the file reader in a gzip reader, counting the bytes
+	// that are read
+	rdr, err := gzip.NewReader(progress.Reader(fid))
 	if err != nil {
-		panic(err)
+		return nil, 0, fmt.Errorf("%s: %v", fname, err)
 	}
+	defer rdr.Close()
+
+	scanner := bufio.NewScanner(rdr)
 
-	// Read all the daily temperature values.  See data format
-	// document for parsing details
-	for pos := 21; pos < len(line); pos += 8 {
+	// The baselines need all the data for the station, so we hold
+	// the summary records until the whole file has been read
+	var mrecs []*ghcn.Month
 
-		// First check the quality flag
-		if line[pos+6] != ' ' {
-			rec.Values = append(rec.Values, 0)
-			rec.IsValid = append(rec.IsValid, false)
+	// Read the lines of the file.  The record is reused for every
+	// line, the summaries do not refer to it.
+	var lrec ghcn.Record
+	lnum := 0
+
+	// The lines are counted in the progress every 1000 lines
+	defer func() {
+		progress.AddLines(lnum % 1000)
+	}()
+
+	for scanner.Scan() {
+
+		line := scanner.Bytes()
+		lnum++
+		if lnum%1000 == 0 {
+			progress.AddLines(1000)
+		}
+
+		// Check the element type first so we can skip the line
+		// if not being used.  Lines that are too short are
+		// rejected by the parser.
+		if len(line) >= 21 && !use_element[string(line[17:21])] {
 			continue
 		}
 
-		sval := strings.TrimLeft(line[pos:pos+5], " ")
-		v, err := strconv.ParseFloat(sval, 64)
+		err := ghcn.ParseBytes(line, policy, &lrec)
 		if err != nil {
-			panic(err)
+			report.Reject(&ghcn.LineError{File: fname, Line: lnum, Text: string(line), Err: err})
+			continue
+		}
+
+		if !filter.Keep(lrec.Id, lrec.Element) {
+			continue
+		}
+
+		mrec := summarizer.Summarize(&lrec)
+		if mrec != nil {
+			mrecs = append(mrecs, mrec)
 		}
-		rec.Values = append(rec.Values, v)
-		rec.IsValid = append(rec.IsValid, true)
 	}
 
-	return &rec
+	if err := scanner.Err(); err != nil {
+		return nil, lnum, fmt.Errorf("%s: line %d: %v", fname, lnum+1, err)
+	}
+
+	return mrecs, lnum, nil
 }
 
-// Convert a raw data record into a monthly summary record
-func summarize(lrec *lrec_t) *mrec_t {
+// processFile handles all processing for one data file (for one
+// station).  If the file cannot be read completely, it is recorded in
+// the report and nothing is written for it.
+func processFile(file os.FileInfo) {
+
+	fname := path.Join(data_path, file.Name())
+	mrecs, nlines, err := readFile(fname)
+	report.File(fname, nlines, err)
+	progress.FileDone()
+	if err != nil {
+		return
+	}
+
+	if baseline.Enabled() {
+		anomalies(mrecs)
+	}
+
+	// The lines of a data file are not necessarily in date order
+	ghcn.SortMonths(mrecs)
 
-	nvalid := 0
-	sum := 0.0
+	years := make(map[int]int64)
+	for _, mrec := range mrecs {
+		years[mrec.Year]++
+	}
+	metrics.AddYears(years)
+	progress.AddRecords(len(mrecs))
 
-	for j, x := range lrec.Values {
-		if lrec.IsValid[j] && x != -9999 {
-			sum += x
-			nvalid++
+	for _, mrec := range mrecs {
+		wtr.Write([]byte(formatRec(mrec)))
+	}
+}
+
+// setupElements checks that we know how to summarize each of the
+// requested element types.
+func setupElements() {
+	use_element = make(map[string]bool)
+	for _, e := range elements {
+		if ghcn.Elements[e] == nil {
+			msg := fmt.Sprintf("Unknown element type %s", e)
+			panic(msg)
 		}
+		use_element[e] = true
 	}
+}
 
-	mean := sum / float64(nvalid)
+// anomalies computes the baselines for the summary records of one
+// station, and sets the Anomaly field of each record.
+func anomalies(mrecs []*ghcn.Month) {
 
-	// In the raw data the temperature units are 0.1 degree C, we
-	// want to convert to degrees C.
-	mean /= 10
+	clim := ghcn.NewClimatology(baseline)
+	for _, mrec := range mrecs {
+		if !mrec.Complete {
+			continue
+		}
+		clim.Add(mrec.Id, mrec.Element, mrec.Year, mrec.Month, mrec.Value)
+	}
 
-	mrec := &mrec_t{Id: lrec.Id,
-		Year: lrec.Year, Month: lrec.Month, Nvalid: nvalid, Mean: mean}
+	for _, mrec := range mrecs {
+		mrec.Anomaly = clim.Anomaly(mrec.Id, mrec.Element, mrec.Month, mrec.Value)
+	}
 
-	return mrec
+	base_fail = append(base_fail, clim.Failures()...)
 }
 
-// All processing for one data file (for one station)
-func processFile(file os.FileInfo) {
+// writeFailures writes a csv file listing the station months for
+// which there are too few years in the reference period to compute a
+// baseline.
+func writeFailures(fname string) {
 
-	// A file reader for the input file
-	fname := path.Join(data_path, file.Name())
-	fid, err := os.Open(fname)
+	fid, err := os.Create(fname)
 	if err != nil {
 		panic(err)
 	}
 	defer fid.Close()
 
-	// Wrap the file reader in a gzip reader
-	rdr, err := gzip.NewReader(fid)
-	if err != nil {
-		panic(err)
+	fmt.Fprintf(fid, "Id,Element,Month,Nyears\n")
+	for _, f := range base_fail {
+		fmt.Fprintf(fid, "%s,%s,%d,%d\n", f.Id, f.Element, f.Month, f.Nyears)
 	}
-	defer rdr.Close()
+}
 
-	scanner := bufio.NewScanner(rdr)
+// setupStations reads the station metadata if it is available.
+func setupStations() {
 
-	// Read the lines of the file
-	for scanner.Scan() {
+	if meta_path != "" {
+		var err error
+		stations, err = ghcn.LoadStations(meta_path)
+		if err != nil {
+			panic(err)
+		}
+		filter.Stations = stations
+	}
 
-		line := scanner.Text()
+	if filter.NeedsMetadata() && stations == nil {
+		panic("The -bbox and -coverage flags require station metadata, see -meta")
+	}
+}
 
-		eltype_val := line[17:21]
-		if eltype_val != eltype {
-			continue
-		}
+// formatRec returns one line of the output file, including the
+// station metadata if available.
+func formatRec(mrec *ghcn.Month) string {
+
+	outline := mrec.CSV()
 
-		lrec := parse(line)
-		mrec := summarize(lrec)
+	if baseline.Enabled() {
+		outline += "," + ghcn.FormatValue(mrec.Anomaly)
+	}
 
-		outline := fmt.Sprintf("%s,%d,%d,%d,%.3f\n", mrec.Id, mrec.Year,
-			mrec.Month, mrec.Nvalid, mrec.Mean)
-		wtr.Write([]byte(outline))
+	if stations != nil {
+		outline += "," + stations[mrec.Id].CSV()
 	}
+
+	return outline + "\n"
 }
 
 func main() {
 
+	flag.StringVar(&meta_path, "meta", meta_path,
+		"Directory containing ghcnd-stations.txt and ghcnd-inventory.txt")
+	policy.RegisterFlags(flag.CommandLine)
+	summarizer.RegisterFlags(flag.CommandLine)
+	filter.RegisterFlags(flag.CommandLine)
+	baseline.RegisterFlags(flag.CommandLine)
+	report.RegisterFlags(flag.CommandLine)
+	progress.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	metrics.Phase("setup")
+	setupElements()
+	setupStations()
+
+	err := report.Open()
+	if err != nil {
+		panic(err)
+	}
+
+	metrics.Phase("process")
+	run()
+
+	// The output files are closed by now, so we can exit without
+	// losing data
+	err = report.Close()
+	if err != nil {
+		panic(err)
+	}
+	report.Summary(os.Stdout)
+
+	metrics.Finish(progress, report)
+	err = metrics.Write(path.Join(out_path, "gcos_monthly_metrics.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// run processes all the data files and writes the output.
+func run() {
+
 	files, err := ioutil.ReadDir(data_path)
 	if err != nil {
 		panic(err)
 	}
 
+	progress.AddFiles(files)
+	progress.Start()
+	defer progress.Stop()
+
 	// Create a file writer
-	fname := fmt.Sprintf("gcos_monthly_%s.csv.gz", eltype)
-	fname = path.Join(out_path, fname)
+	fname := path.Join(out_path, "gcos_monthly.csv.gz")
 	oid, err := os.Create(fname)
 	if err != nil {
 		panic(err)
@@ -196,11 +399,22 @@ func main() {
 	defer wtr.Close()
 
 	// Put a header into the output file
-	header := "Id,Year,Month,Nvalid,Mean\n"
-	wtr.Write([]byte(header))
+	header := ghcn.MonthHeader
+	if baseline.Enabled() {
+		header += ",Anomaly"
+	}
+	if stations != nil {
+		header += "," + ghcn.StationHeader
+	}
+	wtr.Write([]byte(header + "\n"))
 
 	// Process each file
 	for _, file := range files {
 		processFile(file)
 	}
+
+	// List the baselines that could not be computed
+	if baseline.Enabled() {
+		writeFailures(path.Join(out_path, "gcos_monthly_baseline_failures.csv"))
+	}
 }
@@ -1,27 +1,79 @@
 package main
 
-// This script constructs monthly averages from daily temperature
-// records for the GCOS surface network (GCOS GSN).
+// This script constructs monthly summaries from daily records for the
+// GCOS surface network (GCOS GSN).  Every element type listed in the
+// "elements" variable below is processed in a single pass over the
+// station files.  The rule used to summarize each element (a mean for
+// temperatures, a total for precipitation and snowfall, a maximum for
+// snow depth) and its units are defined in the ghcn package.
 //
 // This is the concurrent version of the script, see gcos_monthly.go
-// for the non-concurrent version.
+// for the non-concurrent version.  The files are processed by a fixed
+// number of workers (set with the -workers flag), and the results are
+// written in the order of the input files, so the output is identical
+// to the output of gcos_monthly.go.
 //
 // See gcos_monthly.go for informaiton about obtaining and preparing
 // the input data.
 //
 // The data_path and out_path variables below must be set to
 // appropriate local directory paths.
+//
+// Besides the monthly value, each output row contains the minimum,
+// maximum, standard deviation and median of the daily values, and the
+// number of days above or below the thresholds set with the -above
+// and -below flags.  Months that fail the completeness rule set with
+// the -complete flag (by default the WMO "3/5 rule") have Complete=0
+// in the output, or are dropped if -drop-incomplete is set.  Values
+// that cannot be computed are left blank.
+//
+// Values flagged by the quality checks are skipped, the -qflag-reject,
+// -qflag-keep and -sources flags can be used to change which values
+// are used (see ghcn.Policy).
+//
+// Malformed lines are skipped, and files that cannot be read are left
+// out of the output.  A summary of these problems is printed at the
+// end of the run, and the malformed lines are written to the file
+// given by the -rejects flag.  The script exits with a non-zero status
+// if the fraction of malformed lines or unreadable files exceeds the
+// -max-error-rate flag (0.001 by default).
+//
+// A line showing the number of files done, the rates at which lines
+// are read and monthly records produced, the amount of data read, the
+// size of the heap and the estimated time remaining is printed every
+// -progress interval.  At the end of the run, the duration of each
+// phase, the amount of data read, the number of monthly records for
+// each year and the number of malformed lines and unreadable files are
+// written to the file gcos_monthly_concurrent_metrics.json next to the output (see
+// ghcn.Metrics).
+//
+// If the -meta flag gives the location of the ghcnd-stations.txt and
+// ghcnd-inventory.txt files, the station name, location and network
+// flags are added to each output row.  The -country, -bbox and
+// -coverage flags select stations by country code, location and
+// period of record (see ghcn.StationFilter).
+//
+// If the -baseline flag gives a reference period (e.g. 1981-2010), a
+// baseline is computed for each station, element and calendar month
+// as the mean of the monthly values in the reference period, and the
+// difference between each monthly value and its baseline is added to
+// the output as the Anomaly column.  Baselines with fewer than
+// -baseline-min-years years of data are not used, these are listed in
+// a separate csv file.
 
 import (
 	"bufio"
 	"compress/gzip"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
-	"strconv"
-	"strings"
+	"runtime"
+	"sort"
 	"sync"
+
+	"github.com/DrGo/godata_workshop/ghcn"
 )
 
 var (
@@ -31,154 +83,361 @@ var (
 	// Path where the output file is written
 	out_path = "/nfs/kshedden/GHCN"
 
-	// The temperature type to process, should be either "TMAX" or
-	// "TMIN"
-	eltype = "TMAX"
+	// The element types to process, see ghcn.Elements for the
+	// types that can be used here
+	elements = []string{"PRCP", "SNOW", "SNWD", "TAVG", "TMIN", "TMAX"}
+
+	// The element types in the elements variable, as a set
+	use_element map[string]bool
+
+	// Determines which daily values are used, can be configured
+	// from the command line
+	policy = ghcn.DefaultPolicy()
+
+	// Records the malformed lines and unreadable files, the
+	// acceptable error rate can be configured from the command line
+	report = ghcn.NewReport()
+
+	// Prints the progress while the files are read, how often can be
+	// configured from the command line
+	progress = ghcn.NewProgress()
+
+	// Summarizes the run, written next to the output file at the end
+	metrics = ghcn.NewMetrics("gcos_monthly_concurrent")
+
+	// Computes the monthly summaries, the completeness rule and
+	// thresholds can be configured from the command line
+	summarizer = ghcn.NewSummarizer()
+
+	// Location of ghcnd-stations.txt and ghcnd-inventory.txt.  If
+	// not empty, the station metadata are added to the output.
+	meta_path = ""
+
+	// The station metadata, if meta_path is set
+	stations map[string]*ghcn.Station
+
+	// Selects the stations to process, can be configured from the
+	// command line
+	filter ghcn.StationFilter
+
+	// If a reference period is set, anomalies relative to the
+	// baseline for each calendar month are added to the output
+	baseline = ghcn.BaselineRule{MinYears: 20}
+
+	// The baselines that could not be computed
+	base_fail []ghcn.ClimFailure
+
+	// Protects base_fail
+	base_mu sync.Mutex
 
 	// Used to manage concurrency
 	wg sync.WaitGroup
 
-	// The summary results are communicated from the goroutines to
-	// the parent program using this channel
-	outc chan *mrec_t
+	// The number of files that are processed at the same time
+	workers = runtime.NumCPU()
+
+	// The files to process are sent to the workers using this
+	// channel
+	jobs chan job_t
+
+	// The summary results are communicated from the workers to the
+	// parent program using this channel
+	outc chan result_t
+
+	// Semaphore, used to limit the number of files that have been
+	// started but whose results have not yet been written
+	window chan bool
 )
 
-// The data in one line of the input file
-type lrec_t struct {
-	Id      string    // The station id
-	Year    int       // The year of the data point
-	Month   int       // The month of the data point (1..12)
-	Element string    // The data value type (TMAX or TMIN)
-	Values  []float64 // The daily values
-	IsValid []bool    // Validity flags for the data
+// One input file to be processed
+type job_t struct {
+	Index int         // The position of the file in the list of files
+	File  os.FileInfo // The file
 }
 
-// The summary record for one month
-type mrec_t struct {
-	Id     string  // The station id
-	Year   int     // The year of the data point
-	Month  int     // The month of the data point (1..12)
-	Mean   float64 // The mean value
-	Nvalid int     // The number of valid values in the mean
+// The summary records for one input file
+type result_t struct {
+	Index int           // The position of the file in the list of files
+	Recs  []*ghcn.Month // The summary records for the file
 }
 
-// Parse one line of a raw file and put the results into a structure.
-func parse(line string) *lrec_t {
-
-	var rec lrec_t
-	var err error
+// readFile reads one data file and returns the summary records for
+// the file, and the number of lines that were read.  Malformed lines
+// are skipped and recorded in the report.
+func readFile(fname string) ([]*ghcn.Month, int, error) {
 
-	rec.Id = line[0:11]
-
-	rec.Year, err = strconv.Atoi(line[11:15])
+	// A file reader for the input file
+	fid, err := os.Open(fname)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
+	defer fid.Close()
 
-	rec.Month, err = strconv.Atoi(line[15:17])
+	// Wrap the file reader in a gzip reader, counting the bytes
+	// that are read
+	rdr, err := gzip.NewReader(progress.Reader(fid))
 	if err != nil {
-		panic(err)
+		return nil, 0, fmt.Errorf("%s: %v", fname, err)
 	}
+	defer rdr.Close()
 
-	// Read all the daily temperature values.  See data format
-	// document for parsing details
-	for pos := 21; pos < len(line); pos += 8 {
+	scanner := bufio.NewScanner(rdr)
+
+	// The baselines need all the data for the station, so we hold
+	// the summary records until the whole file has been read
+	var mrecs []*ghcn.Month
+
+	// Read the lines of the file.  The record is reused for every
+	// line, the summaries do not refer to it.
+	var lrec ghcn.Record
+	lnum := 0
+
+	// The lines are counted in the progress every 1000 lines
+	defer func() {
+		progress.AddLines(lnum % 1000)
+	}()
+
+	for scanner.Scan() {
 
-		// First check the quality flag
-		if line[pos+6] != ' ' {
-			rec.Values = append(rec.Values, 0)
-			rec.IsValid = append(rec.IsValid, false)
+		line := scanner.Bytes()
+		lnum++
+		if lnum%1000 == 0 {
+			progress.AddLines(1000)
+		}
+
+		// Check the element type first so we can skip the line
+		// if not being used.  Lines that are too short are
+		// rejected by the parser.
+		if len(line) >= 21 && !use_element[string(line[17:21])] {
 			continue
 		}
 
-		sval := strings.TrimLeft(line[pos:pos+5], " ")
-		v, err := strconv.ParseFloat(sval, 64)
+		err := ghcn.ParseBytes(line, policy, &lrec)
 		if err != nil {
-			panic(err)
+			report.Reject(&ghcn.LineError{File: fname, Line: lnum, Text: string(line), Err: err})
+			continue
+		}
+
+		if !filter.Keep(lrec.Id, lrec.Element) {
+			continue
+		}
+
+		mrec := summarizer.Summarize(&lrec)
+		if mrec != nil {
+			mrecs = append(mrecs, mrec)
 		}
-		rec.Values = append(rec.Values, v)
-		rec.IsValid = append(rec.IsValid, true)
 	}
 
-	return &rec
+	if err := scanner.Err(); err != nil {
+		return nil, lnum, fmt.Errorf("%s: line %d: %v", fname, lnum+1, err)
+	}
+
+	return mrecs, lnum, nil
 }
 
-// Convert a raw data record into a monthly summary record
-func summarize(lrec *lrec_t) *mrec_t {
+// processFile handles all processing for one data file (for one
+// station), and returns the summary records for the file.  If the
+// file cannot be read completely, it is recorded in the report and no
+// records are returned.
+func processFile(file os.FileInfo) []*ghcn.Month {
+
+	fname := path.Join(data_path, file.Name())
+	mrecs, nlines, err := readFile(fname)
+	report.File(fname, nlines, err)
+	progress.FileDone()
+	if err != nil {
+		return nil
+	}
 
-	nvalid := 0
-	sum := 0.0
+	if baseline.Enabled() {
+		anomalies(mrecs)
+	}
 
-	for j, x := range lrec.Values {
-		if lrec.IsValid[j] && x != -9999 {
-			sum += x
-			nvalid++
+	// The lines of a data file are not necessarily in date order
+	ghcn.SortMonths(mrecs)
+
+	years := make(map[int]int64)
+	for _, mrec := range mrecs {
+		years[mrec.Year]++
+	}
+	metrics.AddYears(years)
+	progress.AddRecords(len(mrecs))
+
+	return mrecs
+}
+
+// worker processes the files sent through the jobs channel until it
+// is closed.
+func worker() {
+	defer wg.Done()
+	for j := range jobs {
+		outc <- result_t{j.Index, processFile(j.File)}
+	}
+}
+
+// setupElements checks that we know how to summarize each of the
+// requested element types.
+func setupElements() {
+	use_element = make(map[string]bool)
+	for _, e := range elements {
+		if ghcn.Elements[e] == nil {
+			msg := fmt.Sprintf("Unknown element type %s", e)
+			panic(msg)
 		}
+		use_element[e] = true
 	}
+}
 
-	mean := sum / float64(nvalid)
+// anomalies computes the baselines for the summary records of one
+// station, and sets the Anomaly field of each record.
+func anomalies(mrecs []*ghcn.Month) {
 
-	// In the raw data the temperature units are 0.1 degree C, we
-	// want to convert to degrees C.
-	mean /= 10
+	clim := ghcn.NewClimatology(baseline)
+	for _, mrec := range mrecs {
+		if !mrec.Complete {
+			continue
+		}
+		clim.Add(mrec.Id, mrec.Element, mrec.Year, mrec.Month, mrec.Value)
+	}
 
-	mrec := &mrec_t{Id: lrec.Id,
-		Year: lrec.Year, Month: lrec.Month, Nvalid: nvalid, Mean: mean}
+	for _, mrec := range mrecs {
+		mrec.Anomaly = clim.Anomaly(mrec.Id, mrec.Element, mrec.Month, mrec.Value)
+	}
 
-	return mrec
+	base_mu.Lock()
+	base_fail = append(base_fail, clim.Failures()...)
+	base_mu.Unlock()
 }
 
-// All processing for one data file (for one station)
-func processFile(file os.FileInfo) {
+// writeFailures writes a csv file listing the station months for
+// which there are too few years in the reference period to compute a
+// baseline.
+func writeFailures(fname string) {
 
-	// Signal that this file has been fully processed
-	defer func() { wg.Done() }()
+	// The files are processed concurrently
+	sort.Slice(base_fail, func(i, j int) bool {
+		a, b := base_fail[i], base_fail[j]
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		if a.Element != b.Element {
+			return a.Element < b.Element
+		}
+		return a.Month < b.Month
+	})
 
-	// A file reader for the input file
-	fname := path.Join(data_path, file.Name())
-	fid, err := os.Open(fname)
+	fid, err := os.Create(fname)
 	if err != nil {
 		panic(err)
 	}
 	defer fid.Close()
 
-	// Wrap the file reader in a gzip reader
-	rdr, err := gzip.NewReader(fid)
-	if err != nil {
-		panic(err)
+	fmt.Fprintf(fid, "Id,Element,Month,Nyears\n")
+	for _, f := range base_fail {
+		fmt.Fprintf(fid, "%s,%s,%d,%d\n", f.Id, f.Element, f.Month, f.Nyears)
 	}
-	defer rdr.Close()
+}
 
-	scanner := bufio.NewScanner(rdr)
+// setupStations reads the station metadata if it is available.
+func setupStations() {
 
-	// Read the lines of the file
-	for scanner.Scan() {
+	if meta_path != "" {
+		var err error
+		stations, err = ghcn.LoadStations(meta_path)
+		if err != nil {
+			panic(err)
+		}
+		filter.Stations = stations
+	}
 
-		line := scanner.Text()
+	if filter.NeedsMetadata() && stations == nil {
+		panic("The -bbox and -coverage flags require station metadata, see -meta")
+	}
+}
 
-		eltype_val := line[17:21]
-		if eltype_val != eltype {
-			continue
-		}
+// formatRec returns one line of the output file, including the
+// station metadata if available.
+func formatRec(mrec *ghcn.Month) string {
 
-		lrec := parse(line)
-		mrec := summarize(lrec)
-		outc <- mrec
+	outline := mrec.CSV()
+
+	if baseline.Enabled() {
+		outline += "," + ghcn.FormatValue(mrec.Anomaly)
 	}
+
+	if stations != nil {
+		outline += "," + stations[mrec.Id].CSV()
+	}
+
+	return outline + "\n"
 }
 
 func main() {
 
-	outc = make(chan *mrec_t)
+	flag.StringVar(&meta_path, "meta", meta_path,
+		"Directory containing ghcnd-stations.txt and ghcnd-inventory.txt")
+	policy.RegisterFlags(flag.CommandLine)
+	summarizer.RegisterFlags(flag.CommandLine)
+	filter.RegisterFlags(flag.CommandLine)
+	baseline.RegisterFlags(flag.CommandLine)
+	flag.IntVar(&workers, "workers", workers, "Number of files to process at the same time")
+	report.RegisterFlags(flag.CommandLine)
+	progress.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if workers < 1 {
+		panic("-workers must be at least 1")
+	}
+
+	metrics.Phase("setup")
+	setupElements()
+	setupStations()
+
+	err := report.Open()
+	if err != nil {
+		panic(err)
+	}
+
+	metrics.Phase("process")
+	run()
+
+	// The output files are closed by now, so we can exit without
+	// losing data
+	err = report.Close()
+	if err != nil {
+		panic(err)
+	}
+	report.Summary(os.Stdout)
+
+	metrics.Finish(progress, report)
+	err = metrics.Write(path.Join(out_path, "gcos_monthly_concurrent_metrics.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// run processes all the data files and writes the output.
+func run() {
+
+	jobs = make(chan job_t)
+	outc = make(chan result_t)
+	window = make(chan bool, 2*workers)
 
 	files, err := ioutil.ReadDir(data_path)
 	if err != nil {
 		panic(err)
 	}
 
+	progress.AddFiles(files)
+	progress.Start()
+	defer progress.Stop()
+
 	// Create a file writer
-	fname := fmt.Sprintf("gcos_monthly_%s_concurrent.csv.gz", eltype)
-	fname = path.Join(out_path, fname)
+	fname := path.Join(out_path, "gcos_monthly_concurrent.csv.gz")
 	oid, err := os.Create(fname)
 	if err != nil {
 		panic(err)
@@ -190,26 +449,64 @@ func main() {
 	defer wtr.Close()
 
 	// Put a header into the output file
-	header := "Id,Year,Month,Nvalid,Mean\n"
-	wtr.Write([]byte(header))
+	header := ghcn.MonthHeader
+	if baseline.Enabled() {
+		header += ",Anomaly"
+	}
+	if stations != nil {
+		header += "," + ghcn.StationHeader
+	}
+	wtr.Write([]byte(header + "\n"))
 
-	// Process each file
-	for _, file := range files {
+	// Start the workers
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go processFile(file)
+		go worker()
 	}
 
-	// Wait until all files are done, then close the channel to
+	// Send the files to the workers in order.  A file is only
+	// started when there is room in the window, so that a slow
+	// file cannot cause the results of too many later files to be
+	// held in memory.
+	go func() {
+		for i, file := range files {
+			window <- true
+			jobs <- job_t{i, file}
+		}
+		close(jobs)
+	}()
+
+	// Wait until all workers are done, then close the channel to
 	// signal below that all the data have been processed.
 	go func() {
 		wg.Wait()
 		close(outc)
 	}()
 
-	// Retrieve the results and write to disk
-	for mrec := range outc {
-		outline := fmt.Sprintf("%s,%d,%d,%d,%.3f\n", mrec.Id, mrec.Year,
-			mrec.Month, mrec.Nvalid, mrec.Mean)
-		wtr.Write([]byte(outline))
+	// Retrieve the results and write them to disk in the order of
+	// the input files, so that the output is the same as the output
+	// of gcos_monthly.go.  Results that arrive early are held until
+	// the results of all previous files have been written.
+	pending := make(map[int][]*ghcn.Month)
+	next := 0
+	for res := range outc {
+		pending[res.Index] = res.Recs
+		for {
+			mrecs, ok := pending[next]
+			if !ok {
+				break
+			}
+			for _, mrec := range mrecs {
+				wtr.Write([]byte(formatRec(mrec)))
+			}
+			delete(pending, next)
+			next++
+			<-window
+		}
+	}
+
+	// List the baselines that could not be computed
+	if baseline.Enabled() {
+		writeFailures(path.Join(out_path, "gcos_monthly_concurrent_baseline_failures.csv"))
 	}
 }
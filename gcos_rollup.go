@@ -0,0 +1,128 @@
+package main
+
+// This script takes the monthly summaries produced by gcos_monthly.go
+// (or gcos_monthly_concurrent.go) and combines them into seasonal
+// (DJF, MAM, JJA, SON) and annual summaries for each station and
+// element.
+//
+// The monthly values are combined using the same rule that was used
+// to construct them from the daily values, e.g. the seasonal mean of
+// TMAX is the mean of the monthly means, while the seasonal PRCP is
+// the total of the monthly totals.  December is assigned to the
+// winter (DJF) of the following year.  Annual values are computed for
+// calendar years, or for water years (October through September,
+// labeled by the year in which they end) if the -water-year flag is
+// set.
+//
+// Only complete months (Complete=1 in the monthly file) are used.  A
+// season or year is complete if it has at least -season-min-months or
+// -annual-min-months complete months (by default all of them).
+// Periods that are not complete have Complete=0 and blank Value and
+// Anomaly columns in the output, or are dropped if -drop-incomplete is
+// set.  If the monthly file has an
+// Anomaly column, the anomalies are summarized as well.
+//
+// The out_path variable below must be set to the directory containing
+// the monthly file, the seasonal and annual files are written to the
+// same directory.
+//
+// The script uses the ghcn package in this repository, which must be
+// located in your GOPATH, e.g. by using:
+//     go get github.com/DrGo/godata_workshop/ghcn
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"os"
+	"path"
+
+	"github.com/DrGo/godata_workshop/ghcn"
+)
+
+var (
+	// Path where the monthly file is located, and where the output
+	// files are written
+	out_path = "/nfs/kshedden/GHCN"
+
+	// The name of the monthly file
+	in_file = "gcos_monthly.csv.gz"
+
+	// Combines the monthly values, can be configured from the
+	// command line
+	rollup = ghcn.NewRollup()
+)
+
+// readMonthly reads all the monthly summaries into the rollup.  It
+// returns true if the monthly file has an Anomaly column.
+func readMonthly() bool {
+
+	fid, err := os.Open(path.Join(out_path, in_file))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	mr, err := ghcn.NewMonthReader(rdr)
+	if err != nil {
+		panic(err)
+	}
+
+	for {
+		m, err := mr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		rollup.Add(m)
+	}
+
+	return mr.HasAnomaly
+}
+
+// writePeriods writes seasonal or annual summaries to a gzipped csv
+// file.
+func writePeriods(fname string, per []*ghcn.Period, anomaly bool) {
+
+	oid, err := os.Create(path.Join(out_path, fname))
+	if err != nil {
+		panic(err)
+	}
+	defer oid.Close()
+
+	wtr := gzip.NewWriter(oid)
+	defer wtr.Close()
+
+	header := ghcn.PeriodHeader
+	if anomaly {
+		header += ",Anomaly"
+	}
+	wtr.Write([]byte(header + "\n"))
+
+	for _, p := range per {
+		outline := p.CSV()
+		if anomaly {
+			outline += "," + ghcn.FormatValue(p.Anomaly)
+		}
+		wtr.Write([]byte(outline + "\n"))
+	}
+}
+
+func main() {
+
+	flag.StringVar(&in_file, "in", in_file, "Name of the monthly file in out_path")
+	rollup.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	anomaly := readMonthly()
+
+	writePeriods("gcos_seasonal.csv.gz", rollup.SeasonResults(), anomaly)
+	writePeriods("gcos_annual.csv.gz", rollup.AnnualResults(), anomaly)
+}
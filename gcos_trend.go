@@ -0,0 +1,238 @@
+package main
+
+// This script estimates the trend in the monthly or annual series of
+// each station and element, using the files produced by
+// gcos_monthly.go (or gcos_monthly_concurrent.go) and gcos_rollup.go.
+//
+// Three analyses are carried out for each series: an ordinary least
+// squares (OLS) regression on time, the Theil-Sen slope (the median of
+// the slopes between all pairs of points), and the Mann-Kendall test
+// for a monotone trend.  The output file contains one row per station
+// and element, with the slopes (in units per decade), their
+// confidence intervals, the p-values, and the number of observations
+// and years that were used.
+//
+// Only complete months (or years) are used, and series with fewer than
+// -min-years years of data are skipped.  For monthly series, the
+// -deseasonalize flag removes the mean of each calendar month before
+// estimating the trend.  The -anomaly flag uses the Anomaly column
+// (see the -baseline flag of gcos_monthly.go) instead of the Value
+// column.  The seasonal file written by gcos_rollup.go has one row per
+// season and year, the -period flag selects the season (e.g. DJF) whose
+// trend is estimated.  A file with several values for a station,
+// element and year (or month) is rejected.
+//
+// The out_path variable below must be set to the directory containing
+// the input file, the output is written to the same directory, with
+// "_trend" added to the input file name.
+//
+// The script uses the ghcn package in this repository, which must be
+// located in your GOPATH, e.g. by using:
+//     go get github.com/DrGo/godata_workshop/ghcn
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/DrGo/godata_workshop/ghcn"
+)
+
+var (
+	// Path where the input file is located, and where the output
+	// file is written
+	out_path = "/nfs/kshedden/GHCN"
+
+	// The name of the input file, either monthly or annual
+	in_file = "gcos_monthly.csv.gz"
+
+	// Only use this element type, all element types are used if
+	// empty
+	element = ""
+
+	// Only use the rows of a seasonal file for this period (e.g.
+	// "DJF"), must be set for files with several periods per year
+	period = ""
+
+	// If true, remove the mean of each calendar month from monthly
+	// series
+	deseason bool
+
+	// If true, use the anomalies rather than the values
+	use_anomaly bool
+
+	// Series with fewer years of data are skipped
+	min_years = 10
+
+	// The coverage probability of the confidence intervals
+	level = 0.95
+
+	// The series for each station and element
+	series map[skey_t]*series_t
+)
+
+// Identifies one series
+type skey_t struct {
+	Id      string // The station id
+	Element string // The element type
+}
+
+// The data for one series
+type series_t struct {
+	Time  []float64 // The time of each value, in fractional years
+	Month []int     // The calendar month of each value, 0 for annual data
+	Value []float64 // The data values
+}
+
+// readSeries reads the input file and splits it into series.
+func readSeries() {
+
+	fid, err := os.Open(path.Join(out_path, in_file))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	rdr, err := gzip.NewReader(fid)
+	if err != nil {
+		panic(err)
+	}
+	defer rdr.Close()
+
+	mr, err := ghcn.NewMonthReader(rdr)
+	if err != nil {
+		panic(err)
+	}
+	if use_anomaly && !mr.HasAnomaly {
+		panic("The input file has no Anomaly column")
+	}
+	if period != "" && !mr.HasPeriod {
+		panic("The input file has no Period column")
+	}
+	mr.Period = period
+
+	series = make(map[skey_t]*series_t)
+	for {
+		m, err := mr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+
+		if element != "" && m.Element != element {
+			continue
+		}
+
+		v := m.Value
+		if use_anomaly {
+			v = m.Anomaly
+		}
+		if !m.Complete || math.IsNaN(v) {
+			continue
+		}
+
+		k := skey_t{m.Id, m.Element}
+		s, ok := series[k]
+		if !ok {
+			s = new(series_t)
+			series[k] = s
+		}
+
+		// Place each value at the middle of its month or year
+		t := float64(m.Year) + 0.5
+		if m.Month > 0 {
+			t = float64(m.Year) + (float64(m.Month)-0.5)/12
+		}
+
+		s.Time = append(s.Time, t)
+		s.Month = append(s.Month, m.Month)
+		s.Value = append(s.Value, v)
+	}
+}
+
+// checkSeries panics if a series has several values at the same time,
+// e.g. the four seasons of a seasonal file read without -period.
+func checkSeries() {
+
+	for k, s := range series {
+		t := append([]float64(nil), s.Time...)
+		sort.Float64s(t)
+		for i := 1; i < len(t); i++ {
+			if t[i] == t[i-1] {
+				msg := fmt.Sprintf("%s %s has several values in %d", k.Id, k.Element, int(t[i]))
+				if period == "" {
+					msg += ", use -period to select one period of a seasonal file"
+				}
+				panic(msg)
+			}
+		}
+	}
+}
+
+// writeTrends estimates the trend for each series and writes the
+// results to a gzipped csv file.
+func writeTrends() {
+
+	var keys []skey_t
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Id != keys[j].Id {
+			return keys[i].Id < keys[j].Id
+		}
+		return keys[i].Element < keys[j].Element
+	})
+
+	fname := strings.TrimSuffix(in_file, ".csv.gz") + "_trend.csv.gz"
+	oid, err := os.Create(path.Join(out_path, fname))
+	if err != nil {
+		panic(err)
+	}
+	defer oid.Close()
+
+	wtr := gzip.NewWriter(oid)
+	defer wtr.Close()
+
+	wtr.Write([]byte("Id,Element," + ghcn.TrendHeader + "\n"))
+
+	for _, k := range keys {
+		s := series[k]
+
+		y := s.Value
+		if deseason && s.Month[0] > 0 {
+			y = ghcn.Deseasonalize(s.Month, y)
+		}
+
+		tr := ghcn.EstimateTrend(s.Time, y, level)
+		if tr.Nyears < min_years {
+			continue
+		}
+
+		outline := fmt.Sprintf("%s,%s,%s\n", k.Id, k.Element, tr.CSV())
+		wtr.Write([]byte(outline))
+	}
+}
+
+func main() {
+
+	flag.StringVar(&in_file, "in", in_file, "Name of the monthly or annual file in out_path")
+	flag.StringVar(&element, "element", element, "Only use this element type")
+	flag.StringVar(&period, "period", period, "Only use this period of a seasonal file, e.g. DJF")
+	flag.BoolVar(&deseason, "deseasonalize", deseason, "Remove the mean of each calendar month")
+	flag.BoolVar(&use_anomaly, "anomaly", use_anomaly, "Use the anomalies instead of the values")
+	flag.IntVar(&min_years, "min-years", min_years, "Minimum number of years in a series")
+	flag.Float64Var(&level, "level", level, "Coverage probability of the confidence intervals")
+	flag.Parse()
+
+	readSeries()
+	checkSeries()
+	writeTrends()
+}
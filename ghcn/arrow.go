@@ -0,0 +1,453 @@
+package ghcn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// This file contains a writer for the Arrow IPC file format, also
+// known as Feather version 2, which can be read by pandas
+// (pandas.read_feather), R (arrow::read_feather) and other Arrow
+// implementations.  Only the parts of the format needed for the GHCN
+// tables are supported: one or more record batches of uncompressed
+// utf8, date32, int32 and float64 columns.
+//
+// See https://arrow.apache.org/docs/format/Columnar.html
+
+// Table is a set of aligned, named columns.  Each column is a
+// []string, []Date, []int32 or []float64.
+type Table struct {
+	Names    []string
+	Columns  []interface{}
+	Valid    [][]bool          // Valid[j] is nil if column j has no missing values
+	Metadata map[string]string // Key/value pairs stored with the schema
+}
+
+// Add appends a column to the table.  If valid is not nil, the rows
+// where valid is false are missing.
+func (t *Table) Add(name string, col interface{}, valid []bool) {
+	t.Names = append(t.Names, name)
+	t.Columns = append(t.Columns, col)
+	t.Valid = append(t.Valid, valid)
+}
+
+// Len returns the number of rows in the table.
+func (t *Table) Len() int {
+	if len(t.Columns) == 0 {
+		return 0
+	}
+	return colLen(t.Columns[0])
+}
+
+// check returns an error if the columns are not of a supported type
+// or are not aligned.
+func (t *Table) check() error {
+	n := t.Len()
+	for j, col := range t.Columns {
+		m := colLen(col)
+		if m < 0 {
+			return fmt.Errorf("column %s: unsupported type %T", t.Names[j], col)
+		}
+		if m != n {
+			return fmt.Errorf("column %s has %d rows, expected %d", t.Names[j], m, n)
+		}
+		if t.Valid[j] != nil && len(t.Valid[j]) != n {
+			return fmt.Errorf("column %s: validity has %d rows, expected %d",
+				t.Names[j], len(t.Valid[j]), n)
+		}
+	}
+	return nil
+}
+
+// conforms returns an error if t does not have the names and column
+// types of schema, or, if nulls is true, if the columns that have
+// validity slices differ.
+func (t *Table) conforms(schema *Table, nulls bool) error {
+	if len(t.Columns) != len(schema.Columns) {
+		return fmt.Errorf("table has %d columns, expected %d", len(t.Columns), len(schema.Columns))
+	}
+	for j, col := range t.Columns {
+		if t.Names[j] != schema.Names[j] {
+			return fmt.Errorf("column %d is %s, expected %s", j, t.Names[j], schema.Names[j])
+		}
+		if fmt.Sprintf("%T", col) != fmt.Sprintf("%T", schema.Columns[j]) {
+			return fmt.Errorf("column %s has type %T, expected %T", t.Names[j], col, schema.Columns[j])
+		}
+		if nulls && (t.Valid[j] == nil) != (schema.Valid[j] == nil) {
+			return fmt.Errorf("column %s: the missing values differ from the schema", t.Names[j])
+		}
+	}
+	return nil
+}
+
+// colLen returns the length of a column, or -1 if the column type is
+// not supported.
+func colLen(col interface{}) int {
+	switch x := col.(type) {
+	case []string:
+		return len(x)
+	case []Date:
+		return len(x)
+	case []int32:
+		return len(x)
+	case []float64:
+		return len(x)
+	}
+	return -1
+}
+
+// nullCount returns the number of missing values in a column.
+func nullCount(valid []bool) int {
+	var n int
+	for _, v := range valid {
+		if !v {
+			n++
+		}
+	}
+	return n
+}
+
+// Arrow metadata constants, from Schema.fbs and Message.fbs.
+const (
+	arrowV5 = 4 // MetadataVersion.V5
+
+	arrowSchema      = 1 // MessageHeader.Schema
+	arrowRecordBatch = 3 // MessageHeader.RecordBatch
+
+	arrowInt   = 2 // Type.Int
+	arrowFloat = 3 // Type.FloatingPoint
+	arrowUtf8  = 5 // Type.Utf8
+	arrowDate  = 8 // Type.Date
+
+	arrowDouble = 2 // Precision.DOUBLE
+	arrowDay    = 0 // DateUnit.DAY
+)
+
+var arrowMagic = []byte("ARROW1")
+
+// arrowSchemaTable builds the Schema table for t.
+func arrowSchemaTable(b *fbBuilder, t *Table) int {
+
+	var fields []int
+	for j, col := range t.Columns {
+		var typ, ttyp int
+		switch col.(type) {
+		case []string:
+			ttyp = arrowUtf8
+			typ = b.table()
+		case []Date:
+			ttyp = arrowDate
+			typ = b.table(fbScalar(0, 2, arrowDay))
+		case []int32:
+			ttyp = arrowInt
+			typ = b.table(fbScalar(0, 4, 32), fbScalar(1, 1, 1))
+		case []float64:
+			ttyp = arrowFloat
+			typ = b.table(fbScalar(0, 2, arrowDouble))
+		}
+		name := b.string(t.Names[j])
+		children := b.refs(nil)
+		fields = append(fields, b.table(
+			fbRef(0, name),
+			fbScalar(1, 1, 1), // nullable
+			fbScalar(2, 1, uint64(ttyp)),
+			fbRef(3, typ),
+			fbRef(5, children)))
+	}
+	vfields := b.refs(fields)
+
+	// Store the metadata in sorted order so that the output is
+	// reproducible.
+	var keys []string
+	for k := range t.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var kv []int
+	for _, k := range keys {
+		key := b.string(k)
+		val := b.string(t.Metadata[k])
+		kv = append(kv, b.table(fbRef(0, key), fbRef(1, val)))
+	}
+
+	f := []fbField{fbScalar(0, 2, 0), fbRef(1, vfields)} // little endian
+	if len(kv) > 0 {
+		f = append(f, fbRef(2, b.refs(kv)))
+	}
+	return b.table(f...)
+}
+
+// arrowMessage returns an encapsulated IPC message, consisting of a
+// continuation marker, the length of the metadata, and the Message
+// flatbuffer.  The length of the result is a multiple of 8.
+func arrowMessage(b *fbBuilder, htype, header int, bodylen int64) []byte {
+	msg := b.table(
+		fbScalar(0, 2, arrowV5),
+		fbScalar(1, 1, uint64(htype)),
+		fbRef(2, header),
+		fbScalar(3, 8, uint64(bodylen)))
+	fb := b.finish(msg)
+
+	out := make([]byte, 8, 8+len(fb))
+	binary.LittleEndian.PutUint32(out[0:4], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(fb)))
+	return append(out, fb...)
+}
+
+// pad8 returns the number of bytes needed to pad n to a multiple of
+// 8.
+func pad8(n int64) int64 {
+	return (8 - n%8) % 8
+}
+
+// arrowBuffers returns the lengths of the buffers of column j: the
+// validity bitmap (empty if no values are missing), then the offsets
+// (strings only), then the values.
+func arrowBuffers(t *Table, j int) ([]int64, error) {
+
+	n := int64(colLen(t.Columns[j]))
+	var nv int64
+	if nullCount(t.Valid[j]) > 0 {
+		nv = (n + 7) / 8
+	}
+
+	switch x := t.Columns[j].(type) {
+	case []string:
+		var m int64
+		for _, s := range x {
+			m += int64(len(s))
+		}
+		if m > math.MaxInt32 {
+			return nil, fmt.Errorf("column %s: too much string data", t.Names[j])
+		}
+		return []int64{nv, 4 * (n + 1), m}, nil
+	case []Date, []int32:
+		return []int64{nv, 4 * n}, nil
+	default:
+		return []int64{nv, 8 * n}, nil
+	}
+}
+
+// writeArrowColumn writes the buffers of column j, each padded to a
+// multiple of 8 bytes.
+func writeArrowColumn(w *bufio.Writer, t *Table, j int, lens []int64) error {
+
+	var zero [8]byte
+	var buf [8]byte
+	pad := func(n int64) {
+		w.Write(zero[0:pad8(n)])
+	}
+
+	if lens[0] > 0 {
+		bits := make([]byte, lens[0])
+		for i, v := range t.Valid[j] {
+			if v {
+				bits[i/8] |= 1 << uint(i%8)
+			}
+		}
+		w.Write(bits)
+		pad(lens[0])
+	}
+
+	switch x := t.Columns[j].(type) {
+	case []string:
+		var off uint32
+		for _, s := range x {
+			binary.LittleEndian.PutUint32(buf[0:4], off)
+			w.Write(buf[0:4])
+			off += uint32(len(s))
+		}
+		binary.LittleEndian.PutUint32(buf[0:4], off)
+		w.Write(buf[0:4])
+		pad(lens[1])
+		for _, s := range x {
+			w.WriteString(s)
+		}
+	case []Date:
+		for _, v := range x {
+			binary.LittleEndian.PutUint32(buf[0:4], uint32(v))
+			w.Write(buf[0:4])
+		}
+	case []int32:
+		for _, v := range x {
+			binary.LittleEndian.PutUint32(buf[0:4], uint32(v))
+			w.Write(buf[0:4])
+		}
+	case []float64:
+		for _, v := range x {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+			w.Write(buf[:])
+		}
+	}
+	_, err := w.Write(zero[0:pad8(lens[len(lens)-1])])
+
+	return err
+}
+
+// ArrowWriter writes an Arrow IPC file in parts, so that tables that
+// do not fit in memory can be written.  Each part is written as a
+// record batch when it is passed to Write, and the footer is written
+// by Close.
+type ArrowWriter struct {
+	wtr    *bufio.Writer
+	schema *Table
+	pos    int64  // The position in the file
+	blocks []byte // The footer Block structs of the record batches
+}
+
+// NewArrowWriter returns a writer that writes tables with the names
+// and column types of schema to w.  The metadata of schema is stored
+// in the file, its rows are not written.
+func NewArrowWriter(w io.Writer, schema *Table) (*ArrowWriter, error) {
+
+	err := schema.check()
+	if err != nil {
+		return nil, err
+	}
+
+	aw := &ArrowWriter{wtr: bufio.NewWriter(w), schema: schema}
+
+	// The file starts with the magic string, padded to 8 bytes.
+	aw.wtr.Write(arrowMagic)
+	aw.wtr.Write([]byte{0, 0})
+	aw.pos = 8
+
+	b := new(fbBuilder)
+	msg := arrowMessage(b, arrowSchema, arrowSchemaTable(b, schema), 0)
+	_, err = aw.wtr.Write(msg)
+	aw.pos += int64(len(msg))
+
+	return aw, err
+}
+
+// Write writes t, which must have the same names and column types as
+// the schema, as a record batch.
+func (aw *ArrowWriter) Write(t *Table) error {
+
+	err := t.check()
+	if err != nil {
+		return err
+	}
+	err = t.conforms(aw.schema, false)
+	if err != nil {
+		return err
+	}
+
+	// Lay out the buffers of the record batch body, and describe
+	// them with FieldNode and Buffer structs.
+	var nodes, buffers []byte
+	var lens [][]int64
+	var bodylen int64
+	n := uint64(t.Len())
+	for j := range t.Columns {
+		l, err := arrowBuffers(t, j)
+		if err != nil {
+			return err
+		}
+		lens = append(lens, l)
+
+		var node [16]byte
+		binary.LittleEndian.PutUint64(node[0:8], n)
+		binary.LittleEndian.PutUint64(node[8:16], uint64(nullCount(t.Valid[j])))
+		nodes = append(nodes, node[:]...)
+
+		for _, m := range l {
+			var buf [16]byte
+			binary.LittleEndian.PutUint64(buf[0:8], uint64(bodylen))
+			binary.LittleEndian.PutUint64(buf[8:16], uint64(m))
+			buffers = append(buffers, buf[:]...)
+			bodylen += m + pad8(m)
+		}
+	}
+
+	b := new(fbBuilder)
+	vnodes := b.structs(nodes, len(nodes)/16, 8)
+	vbuffers := b.structs(buffers, len(buffers)/16, 8)
+	batch := b.table(fbScalar(0, 8, n), fbRef(1, vnodes), fbRef(2, vbuffers))
+	meta := arrowMessage(b, arrowRecordBatch, batch, bodylen)
+
+	// The footer Block struct for the record batch.
+	var block [24]byte
+	binary.LittleEndian.PutUint64(block[0:8], uint64(aw.pos))
+	binary.LittleEndian.PutUint32(block[8:12], uint32(len(meta)))
+	binary.LittleEndian.PutUint64(block[16:24], uint64(bodylen))
+	aw.blocks = append(aw.blocks, block[:]...)
+
+	aw.wtr.Write(meta)
+	for j := range t.Columns {
+		err = writeArrowColumn(aw.wtr, t, j, lens[j])
+		if err != nil {
+			return err
+		}
+	}
+	aw.pos += int64(len(meta)) + bodylen
+
+	return nil
+}
+
+// Close writes the footer, and flushes the output.  It does not close
+// the underlying writer.
+func (aw *ArrowWriter) Close() error {
+
+	// End of stream marker
+	aw.wtr.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0})
+
+	// The footer repeats the schema, and gives the locations of the
+	// record batches.
+	b := new(fbBuilder)
+	fschema := arrowSchemaTable(b, aw.schema)
+	dicts := b.structs(nil, 0, 8)
+	batches := b.structs(aw.blocks, len(aw.blocks)/24, 8)
+	footer := b.finish(b.table(
+		fbScalar(0, 2, arrowV5),
+		fbRef(1, fschema),
+		fbRef(2, dicts),
+		fbRef(3, batches)))
+	aw.wtr.Write(footer)
+
+	var flen [4]byte
+	binary.LittleEndian.PutUint32(flen[:], uint32(len(footer)))
+	aw.wtr.Write(flen[:])
+	aw.wtr.Write(arrowMagic)
+
+	return aw.wtr.Flush()
+}
+
+// WriteArrow writes t to w in the Arrow IPC file format, as a single
+// record batch.
+func WriteArrow(w io.Writer, t *Table) error {
+
+	aw, err := NewArrowWriter(w, t)
+	if err != nil {
+		return err
+	}
+	err = aw.Write(t)
+	if err != nil {
+		return err
+	}
+
+	return aw.Close()
+}
+
+// WriteFeather writes t to the file fname in the Arrow IPC file
+// (Feather version 2) format.
+func WriteFeather(fname string, t *Table) error {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	err = WriteArrow(fid, t)
+	if err != nil {
+		return err
+	}
+
+	return fid.Close()
+}
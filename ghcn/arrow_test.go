@@ -0,0 +1,474 @@
+package ghcn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite the files in testdata")
+
+// fbTable is a table in a FlatBuffers buffer, which the tests decode
+// to check the metadata written by fbBuilder.  Problems with the
+// layout are reported to t.
+type fbTable struct {
+	t   *testing.T
+	buf []byte
+	pos int
+}
+
+// fbRoot returns the root table of a buffer.
+func fbRoot(t *testing.T, buf []byte) fbTable {
+	if len(buf)%8 != 0 {
+		t.Errorf("the flatbuffer has length %d, which is not a multiple of 8", len(buf))
+	}
+	return fbTable{t, buf, int(binary.LittleEndian.Uint32(buf))}
+}
+
+// field returns the position of a field, or zero if the field is not
+// present.
+func (f fbTable) field(slot int) int {
+	vt := f.pos - int(int32(binary.LittleEndian.Uint32(f.buf[f.pos:])))
+	if vt%2 != 0 || f.pos%4 != 0 {
+		f.t.Errorf("the table at %d or its vtable at %d is not aligned", f.pos, vt)
+	}
+	vlen := int(binary.LittleEndian.Uint16(f.buf[vt:]))
+	tlen := int(binary.LittleEndian.Uint16(f.buf[vt+2:]))
+	if 4+2*slot >= vlen {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(f.buf[vt+4+2*slot:]))
+	if off >= tlen {
+		f.t.Errorf("field %d of the table at %d is at %d, past the end of the table", slot, f.pos, off)
+	}
+	if off == 0 {
+		return 0
+	}
+	return f.pos + off
+}
+
+// scalar returns a scalar field of the given size in bytes, which must
+// be present.
+func (f fbTable) scalar(slot, size int) uint64 {
+	p := f.field(slot)
+	if p == 0 {
+		f.t.Errorf("field %d of the table at %d is missing", slot, f.pos)
+		return 0
+	}
+	if p%size != 0 {
+		f.t.Errorf("field %d of the table at %d is not aligned to %d bytes", slot, f.pos, size)
+	}
+	var b [8]byte
+	copy(b[:], f.buf[p:p+size])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// ref returns the position of the object referenced by a field.
+func (f fbTable) ref(slot int) int {
+	p := f.field(slot)
+	if p == 0 {
+		f.t.Errorf("field %d of the table at %d is missing", slot, f.pos)
+		return 0
+	}
+	if p%4 != 0 {
+		f.t.Errorf("reference %d of the table at %d is not aligned", slot, f.pos)
+	}
+	return p + int(binary.LittleEndian.Uint32(f.buf[p:]))
+}
+
+func (f fbTable) table(slot int) fbTable {
+	return fbTable{f.t, f.buf, f.ref(slot)}
+}
+
+func (f fbTable) string(slot int) string {
+	p := f.ref(slot)
+	n := int(binary.LittleEndian.Uint32(f.buf[p:]))
+	if f.buf[p+4+n] != 0 {
+		f.t.Errorf("the string at %d is not null terminated", p)
+	}
+	return string(f.buf[p+4 : p+4+n])
+}
+
+// vector returns the position of the first element of a vector, and
+// the number of elements.
+func (f fbTable) vector(slot int) (int, int) {
+	p := f.ref(slot)
+	return p + 4, int(binary.LittleEndian.Uint32(f.buf[p:]))
+}
+
+// structs returns the contents of a vector of structs of the given
+// size, which contain 64 bit values.
+func (f fbTable) structs(slot, size int) []byte {
+	p, n := f.vector(slot)
+	if p%8 != 0 {
+		f.t.Errorf("the structs at %d are not aligned to 8 bytes", p)
+	}
+	return f.buf[p : p+n*size]
+}
+
+func (f fbTable) tables(slot int) []fbTable {
+	p, n := f.vector(slot)
+	var tabs []fbTable
+	for i := 0; i < n; i++ {
+		q := p + 4*i
+		tabs = append(tabs, fbTable{f.t, f.buf, q + int(binary.LittleEndian.Uint32(f.buf[q:]))})
+	}
+	return tabs
+}
+
+// readArrowSchema decodes a Schema table, and returns a table with no
+// rows and the names, column types and metadata of the schema.
+func readArrowSchema(t *testing.T, s fbTable) *Table {
+
+	if s.scalar(0, 2) != 0 {
+		t.Errorf("the schema is not little endian")
+	}
+
+	tab := new(Table)
+	for _, f := range s.tables(1) {
+		name := f.string(0)
+		if f.scalar(1, 1) != 1 {
+			t.Errorf("field %s is not nullable", name)
+		}
+		if _, n := f.vector(5); n != 0 {
+			t.Errorf("field %s has %d children", name, n)
+		}
+		typ := f.table(3)
+		var col interface{}
+		switch f.scalar(2, 1) {
+		case arrowUtf8:
+			col = []string{}
+		case arrowDate:
+			// The default unit is milliseconds, so the unit
+			// must be present.
+			if typ.scalar(0, 2) != arrowDay {
+				t.Errorf("field %s: the dates are not in days", name)
+			}
+			col = []Date{}
+		case arrowInt:
+			if typ.scalar(0, 4) != 32 || typ.scalar(1, 1) != 1 {
+				t.Errorf("field %s: not a signed 32 bit integer", name)
+			}
+			col = []int32{}
+		case arrowFloat:
+			if typ.scalar(0, 2) != arrowDouble {
+				t.Errorf("field %s: not a double", name)
+			}
+			col = []float64{}
+		default:
+			t.Errorf("field %s has type %d", name, f.scalar(2, 1))
+		}
+		tab.Add(name, col, nil)
+	}
+
+	if s.field(2) != 0 {
+		tab.Metadata = make(map[string]string)
+		for _, kv := range s.tables(2) {
+			tab.Metadata[kv.string(0)] = kv.string(1)
+		}
+	}
+
+	return tab
+}
+
+// readArrowMessage checks the encapsulated message at position pos of
+// a file, and returns the Message table.  If metalen is not zero, it is
+// the length of the message given by the footer.
+func readArrowMessage(t *testing.T, b []byte, pos, metalen int) (fbTable, int) {
+
+	if pos%8 != 0 {
+		t.Errorf("the message at %d is not aligned to 8 bytes", pos)
+	}
+	if c := binary.LittleEndian.Uint32(b[pos:]); c != 0xFFFFFFFF {
+		t.Errorf("the message at %d has no continuation marker", pos)
+	}
+	n := int(binary.LittleEndian.Uint32(b[pos+4:]))
+	if metalen != 0 && n+8 != metalen {
+		t.Errorf("the message at %d has length %d, the footer gives %d", pos, n+8, metalen)
+	}
+	msg := fbRoot(t, b[pos+8:pos+8+n])
+	if v := msg.scalar(0, 2); v != arrowV5 {
+		t.Errorf("the message at %d has version %d", pos, v)
+	}
+
+	return msg, pos + 8 + n
+}
+
+// readArrow decodes an Arrow IPC file, checking its layout, and returns
+// its schema and record batches.  The missing values of the batches
+// are zero.
+func readArrow(t *testing.T, b []byte) (*Table, []*Table) {
+
+	n := len(b)
+	if !bytes.Equal(b[0:8], append(arrowMagic, 0, 0)) || !bytes.Equal(b[n-6:], arrowMagic) {
+		t.Fatalf("the file does not start and end with the magic string")
+	}
+	flen := int(binary.LittleEndian.Uint32(b[n-10:]))
+	fpos := n - 10 - flen
+	if fpos%8 != 0 {
+		t.Errorf("the footer at %d is not aligned to 8 bytes", fpos)
+	}
+	if !bytes.Equal(b[fpos-8:fpos], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0}) {
+		t.Errorf("there is no end of stream marker before the footer")
+	}
+
+	footer := fbRoot(t, b[fpos:fpos+flen])
+	if v := footer.scalar(0, 2); v != arrowV5 {
+		t.Errorf("the footer has version %d", v)
+	}
+	schema := readArrowSchema(t, footer.table(1))
+	if _, n := footer.vector(2); n != 0 {
+		t.Errorf("the footer has %d dictionaries", n)
+	}
+
+	// The schema message follows the magic string.
+	msg, pos := readArrowMessage(t, b, 8, 0)
+	if h := msg.scalar(1, 1); h != arrowSchema {
+		t.Fatalf("the first message has type %d", h)
+	}
+	if s := readArrowSchema(t, msg.table(2)); !reflect.DeepEqual(s, schema) {
+		t.Errorf("the schema message %+v differs from the footer %+v", s, schema)
+	}
+
+	// The record batches follow each other, in the order of the
+	// footer blocks.
+	var batches []*Table
+	blocks := footer.structs(3, 24)
+	for k := 0; k < len(blocks); k += 24 {
+		off := int(binary.LittleEndian.Uint64(blocks[k:]))
+		metalen := int(binary.LittleEndian.Uint32(blocks[k+8:]))
+		bodylen := int(binary.LittleEndian.Uint64(blocks[k+16:]))
+		if off != pos {
+			t.Errorf("batch %d is at %d, expected %d", len(batches), off, pos)
+		}
+		msg, pos = readArrowMessage(t, b, off, metalen)
+		if h := msg.scalar(1, 1); h != arrowRecordBatch {
+			t.Fatalf("batch %d has message type %d", len(batches), h)
+		}
+		if bl := int(msg.scalar(3, 8)); bl != bodylen || bl%8 != 0 {
+			t.Errorf("batch %d has a body of %d bytes, the footer gives %d", len(batches), bl, bodylen)
+		}
+		body := b[pos : pos+bodylen]
+		pos += bodylen
+
+		rb := msg.table(2)
+		nrow := int(rb.scalar(0, 8))
+		nodes := rb.structs(1, 16)
+		bufs := rb.structs(2, 16)
+		if len(nodes) != 16*len(schema.Columns) {
+			t.Fatalf("batch %d has %d field nodes", len(batches), len(nodes)/16)
+		}
+
+		// next returns the next buffer of the body, which must
+		// follow the previous buffer after padding.
+		var end int
+		next := func() []byte {
+			if len(bufs) < 16 {
+				t.Fatalf("batch %d has too few buffers", len(batches))
+			}
+			o := int(binary.LittleEndian.Uint64(bufs[0:]))
+			m := int(binary.LittleEndian.Uint64(bufs[8:]))
+			bufs = bufs[16:]
+			if o != end || o+m > len(body) {
+				t.Fatalf("batch %d: a buffer is at %d with length %d, expected at %d in a body of %d bytes",
+					len(batches), o, m, end, len(body))
+			}
+			end = o + m + int(pad8(int64(m)))
+			return body[o : o+m]
+		}
+
+		batch := &Table{Metadata: schema.Metadata}
+		for j, col := range schema.Columns {
+			name := schema.Names[j]
+			if l := int(binary.LittleEndian.Uint64(nodes[16*j:])); l != nrow {
+				t.Errorf("batch %d column %s has length %d, expected %d", len(batches), name, l, nrow)
+			}
+			nulls := int(binary.LittleEndian.Uint64(nodes[16*j+8:]))
+
+			var valid []bool
+			bits := next()
+			if nulls > 0 {
+				if len(bits) != (nrow+7)/8 {
+					t.Fatalf("batch %d column %s has a bitmap of %d bytes", len(batches), name, len(bits))
+				}
+				valid = make([]bool, nrow)
+				for i := range valid {
+					valid[i] = bits[i/8]&(1<<uint(i%8)) != 0
+				}
+				if c := nullCount(valid); c != nulls {
+					t.Errorf("batch %d column %s has %d nulls, the node gives %d", len(batches), name, c, nulls)
+				}
+			} else if len(bits) != 0 {
+				t.Errorf("batch %d column %s has a bitmap but no nulls", len(batches), name)
+			}
+
+			switch col.(type) {
+			case []string:
+				offs, data := next(), next()
+				x := make([]string, nrow)
+				for i := range x {
+					lo := binary.LittleEndian.Uint32(offs[4*i:])
+					hi := binary.LittleEndian.Uint32(offs[4*i+4:])
+					x[i] = string(data[lo:hi])
+				}
+				col = x
+			case []Date:
+				data := next()
+				x := make([]Date, nrow)
+				for i := range x {
+					x[i] = Date(int32(binary.LittleEndian.Uint32(data[4*i:])))
+				}
+				col = x
+			case []int32:
+				data := next()
+				x := make([]int32, nrow)
+				for i := range x {
+					x[i] = int32(binary.LittleEndian.Uint32(data[4*i:]))
+				}
+				col = x
+			case []float64:
+				data := next()
+				x := make([]float64, nrow)
+				for i := range x {
+					x[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+				}
+				col = x
+			}
+			batch.Add(name, col, valid)
+		}
+		if len(bufs) != 0 || end != len(body) {
+			t.Errorf("batch %d has unused buffers or body bytes", len(batches))
+		}
+		batches = append(batches, batch)
+	}
+	if pos != fpos-8 {
+		t.Errorf("the last batch ends at %d, the end of stream marker is at %d", pos, fpos-8)
+	}
+
+	return schema, batches
+}
+
+// arrowParts returns t in parts of the given number of rows, with no
+// validity slice for the columns that have no missing values in a
+// part, and zero for the missing values.
+func arrowParts(t *Table, parts int) []*Table {
+
+	var tabs []*Table
+	for lo := 0; lo == 0 || lo < t.Len(); lo += parts {
+		hi := lo + parts
+		if hi > t.Len() {
+			hi = t.Len()
+		}
+		part := &Table{Metadata: t.Metadata}
+		for j, col := range t.Columns {
+			var valid []bool
+			if t.Valid[j] != nil && nullCount(t.Valid[j][lo:hi]) > 0 {
+				valid = t.Valid[j][lo:hi]
+			}
+			part.Add(t.Names[j], sliceColumn(col, lo, hi), valid)
+		}
+		tabs = append(tabs, part)
+	}
+
+	return tabs
+}
+
+func TestArrowWriter(t *testing.T) {
+
+	for _, tc := range []struct {
+		rows, parts int
+		fixture     string // The expected file in testdata, if any
+	}{
+		{rows: 10, parts: 4, fixture: "table.feather"},
+		{rows: 10, parts: 10},
+		{rows: 100, parts: 33},
+		{rows: 0, parts: 1},
+	} {
+		want := testTable(tc.rows)
+		var buf bytes.Buffer
+		aw, err := NewArrowWriter(&buf, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := arrowParts(want, tc.parts)
+		for _, p := range parts {
+			err = aw.Write(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = aw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema, batches := readArrow(t, buf.Bytes())
+		if !reflect.DeepEqual(schema.Names, want.Names) || !reflect.DeepEqual(schema.Metadata, want.Metadata) {
+			t.Errorf("%d rows: the schema is %v %v, expected %v %v", tc.rows,
+				schema.Names, schema.Metadata, want.Names, want.Metadata)
+		}
+		for j, col := range schema.Columns {
+			if reflect.TypeOf(col) != reflect.TypeOf(want.Columns[j]) {
+				t.Errorf("%d rows: column %s has type %T", tc.rows, want.Names[j], col)
+			}
+		}
+		if len(batches) != len(parts) {
+			t.Fatalf("%d rows: %d batches, expected %d", tc.rows, len(batches), len(parts))
+		}
+		for k, p := range parts {
+			for j := range p.Columns {
+				if colLen(p.Columns[j]) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(batches[k].Columns[j], p.Columns[j]) ||
+					!reflect.DeepEqual(batches[k].Valid[j], p.Valid[j]) {
+					t.Errorf("%d rows: batch %d column %s differs", tc.rows, k, p.Names[j])
+				}
+			}
+		}
+
+		if tc.fixture == "" {
+			continue
+		}
+		fname := filepath.Join("testdata", tc.fixture)
+		if *update {
+			err = ioutil.WriteFile(fname, buf.Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		fixture, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), fixture) {
+			t.Errorf("%d rows: the file differs from %s", tc.rows, fname)
+		}
+	}
+}
+
+func TestArrowWriterSchema(t *testing.T) {
+
+	schema := testTable(3)
+	aw, err := NewArrowWriter(ioutil.Discard, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := new(Table)
+	other.Add("Id", []string{"a"}, nil)
+	if err := aw.Write(other); err == nil {
+		t.Errorf("no error for a table with other columns")
+	}
+
+	other = testTable(3)
+	other.Columns[4] = []float64{1, 2, 3}
+	if err := aw.Write(other); err == nil {
+		t.Errorf("no error for a column of another type")
+	}
+}
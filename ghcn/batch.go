@@ -0,0 +1,163 @@
+package ghcn
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// This file contains the fixed size records that hold the daily
+// values of a columnized store until they are sorted, and the batches
+// in which the goroutines that read the data files send the values to
+// the goroutines that encode them.  Each key (partition) is encoded by
+// one goroutine (its shard), so that the values of a key are encoded
+// in the order in which they were sent.
+
+// Obs is one daily value of one element.
+type Obs struct {
+	Id      string  // The station id
+	Year    int     // The year of the data point
+	Month   int     // The month of the data point (1..12)
+	Day     int     // The day within the month (1..31)
+	Element int     // The position of the element in the store
+	Value   float64 // The data value, in the units of the element
+	MFlag   byte    // The measurement flag
+	QFlag   byte    // The quality flag
+	SFlag   byte    // The source flag
+}
+
+// The layout of an encoded Obs: the station id, the date and the
+// element form the sort key, the first ObsDateLen bytes identify the
+// station and date.
+const (
+	ObsIdLen   = 11
+	ObsDateLen = ObsIdLen + 4
+	ObsKeyLen  = ObsDateLen + 1
+	ObsLen     = ObsKeyLen + 8 + 3
+)
+
+// Encode encodes r as a fixed size record of ObsLen bytes.  The first
+// ObsKeyLen bytes contain the station id, year, month, day and
+// element, so that sorting on these bytes sorts by station then by
+// date, and the records of each station and date are adjacent.
+func (r *Obs) Encode(b []byte) {
+	copy(b[0:ObsIdLen], r.Id)
+	binary.BigEndian.PutUint16(b[ObsIdLen:ObsIdLen+2], uint16(r.Year))
+	b[ObsIdLen+2] = byte(r.Month)
+	b[ObsIdLen+3] = byte(r.Day)
+	b[ObsDateLen] = byte(r.Element)
+	binary.LittleEndian.PutUint64(b[ObsKeyLen:ObsKeyLen+8], math.Float64bits(r.Value))
+	b[ObsKeyLen+8] = r.MFlag
+	b[ObsKeyLen+9] = r.QFlag
+	b[ObsKeyLen+10] = r.SFlag
+}
+
+// Decode decodes a record written by Encode.  The id string is only
+// allocated if it differs from the id already in r.
+func (r *Obs) Decode(b []byte) {
+	if r.Id != string(b[0:ObsIdLen]) {
+		r.Id = string(b[0:ObsIdLen])
+	}
+	r.Year = int(binary.BigEndian.Uint16(b[ObsIdLen : ObsIdLen+2]))
+	r.Month = int(b[ObsIdLen+2])
+	r.Day = int(b[ObsIdLen+3])
+	r.Element = int(b[ObsDateLen])
+	r.Value = math.Float64frombits(binary.LittleEndian.Uint64(b[ObsKeyLen : ObsKeyLen+8]))
+	r.MFlag = b[ObsKeyLen+8]
+	r.QFlag = b[ObsKeyLen+9]
+	r.SFlag = b[ObsKeyLen+10]
+}
+
+// KeyObs is a value and the key of its partition.
+type KeyObs struct {
+	Key string
+	Obs Obs
+}
+
+// ShardOf returns the shard, out of n, that encodes the values with a
+// key, using the FNV-1a hash of the key.
+func ShardOf(key string, n int) int {
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// Sender collects the values read by one goroutine into one batch per
+// shard, and passes each batch to its send function when it is full
+// or when Flush is called.  The send function owns the batches that
+// it is given.  A Sender is not safe for concurrent use.
+type Sender struct {
+	size    int
+	send    func(shard int, batch []KeyObs)
+	batches [][]KeyObs
+
+	// The shards of the keys that were seen, so that each key is
+	// only hashed once
+	shards map[string]int
+}
+
+// NewSender returns a Sender for nshards shards, that sends batches
+// of size values.
+func NewSender(nshards, size int, send func(shard int, batch []KeyObs)) *Sender {
+	return &Sender{size: size, send: send, batches: make([][]KeyObs, nshards),
+		shards: make(map[string]int)}
+}
+
+// Add adds a value to the batch of the shard of key, and sends the
+// batch if it is full.
+func (s *Sender) Add(key string, r *Obs) {
+	k, ok := s.shards[key]
+	if !ok {
+		k = ShardOf(key, len(s.batches))
+		s.shards[key] = k
+	}
+	if s.batches[k] == nil {
+		s.batches[k] = make([]KeyObs, 0, s.size)
+	}
+	s.batches[k] = append(s.batches[k], KeyObs{Key: key, Obs: *r})
+	if len(s.batches[k]) >= s.size {
+		s.flush(k)
+	}
+}
+
+// flush sends the batch of one shard if it is not empty.
+func (s *Sender) flush(k int) {
+	if len(s.batches[k]) == 0 {
+		return
+	}
+	s.send(k, s.batches[k])
+	s.batches[k] = nil
+}
+
+// Flush sends the batches that are not empty.
+func (s *Sender) Flush() {
+	for k := range s.batches {
+		s.flush(k)
+	}
+}
+
+// EncodeBatch encodes the values of a batch, and calls add with the
+// key and the records of each run of consecutive values with the same
+// key.  The records are encoded in buf, which is returned so that it
+// can be reused for the next batch.  EncodeBatch stops at the first
+// error returned by add.
+func EncodeBatch(batch []KeyObs, buf []byte, add func(key string, data []byte) error) ([]byte, error) {
+
+	var rec [ObsLen]byte
+	buf = buf[0:0]
+	for i := range batch {
+		batch[i].Obs.Encode(rec[:])
+		buf = append(buf, rec[:]...)
+
+		key := batch[i].Key
+		if i+1 == len(batch) || batch[i+1].Key != key {
+			if err := add(key, buf); err != nil {
+				return buf, err
+			}
+			buf = buf[0:0]
+		}
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,256 @@
+package ghcn
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestObsEncode(t *testing.T) {
+
+	obs := []Obs{
+		{"USW00094728", 1990, 12, 31, 2, -1.5, 'T', ' ', '0'},
+		{"USW00094728", 1991, 1, 1, 0, 22.25, ' ', 'I', 'S'},
+		{"USW00094728", 1991, 1, 1, 1, 0, ' ', ' ', ' '},
+		{"CA006158355", 2017, 2, 28, 0, 1e-3, ' ', ' ', 'C'},
+	}
+
+	var recs [][]byte
+	for i := range obs {
+		b := make([]byte, ObsLen)
+		obs[i].Encode(b)
+		var r Obs
+		r.Decode(b)
+		if r != obs[i] {
+			t.Errorf("decoded %+v, expected %+v", r, obs[i])
+		}
+		recs = append(recs, b)
+	}
+
+	// The keys sort by station, date and element.
+	sort.Slice(recs, func(i, j int) bool {
+		return bytes.Compare(recs[i][0:ObsKeyLen], recs[j][0:ObsKeyLen]) < 0
+	})
+	var order []Obs
+	for _, b := range recs {
+		var r Obs
+		r.Decode(b)
+		order = append(order, r)
+	}
+	want := []Obs{obs[3], obs[0], obs[1], obs[2]}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("sorted records are %v, expected %v", order, want)
+	}
+}
+
+func TestSender(t *testing.T) {
+
+	const nshards = 3
+	var sent [nshards][]KeyObs
+	var sizes []int
+	s := NewSender(nshards, 4, func(k int, batch []KeyObs) {
+		sent[k] = append(sent[k], batch...)
+		sizes = append(sizes, len(batch))
+	})
+
+	keys := []string{"1990", "1991", "1992", "1993", "1994"}
+	for i := 0; i < 50; i++ {
+		key := keys[i%len(keys)]
+		s.Add(key, &Obs{Id: "USW00094728", Year: 1990 + i%len(keys), Day: i})
+	}
+	s.Flush()
+	s.Flush()
+
+	n := 0
+	for k := range sent {
+		for _, v := range sent[k] {
+			if ShardOf(v.Key, nshards) != k {
+				t.Errorf("key %s was sent to shard %d", v.Key, k)
+			}
+			if v.Key != strconv.Itoa(v.Obs.Year) {
+				t.Errorf("value %+v was sent with key %s", v.Obs, v.Key)
+			}
+			n++
+		}
+	}
+	if n != 50 {
+		t.Errorf("%d values were sent, expected 50", n)
+	}
+	for _, size := range sizes {
+		if size < 1 || size > 4 {
+			t.Errorf("a batch of %d values was sent", size)
+		}
+	}
+
+	// The values of a key are sent in order.
+	for k := range sent {
+		last := make(map[string]int)
+		for _, v := range sent[k] {
+			if d, ok := last[v.Key]; ok && v.Obs.Day <= d {
+				t.Errorf("value %d of key %s was sent after value %d", v.Obs.Day, v.Key, d)
+			}
+			last[v.Key] = v.Obs.Day
+		}
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+
+	batch := []KeyObs{
+		{"1990", Obs{Id: "USW00094728", Year: 1990, Day: 1}},
+		{"1990", Obs{Id: "USW00094728", Year: 1990, Day: 2}},
+		{"1991", Obs{Id: "USW00094728", Year: 1991, Day: 1}},
+		{"1990", Obs{Id: "USW00094728", Year: 1990, Day: 3}},
+	}
+
+	var keys []string
+	var days [][]int
+	add := func(key string, data []byte) error {
+		var d []int
+		for len(data) > 0 {
+			var r Obs
+			r.Decode(data[0:ObsLen])
+			d = append(d, r.Day)
+			data = data[ObsLen:]
+		}
+		keys = append(keys, key)
+		days = append(days, d)
+		return nil
+	}
+
+	_, err := EncodeBatch(batch, nil, add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1990", "1991", "1990"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys are %v, expected %v", keys, want)
+	}
+	if want := [][]int{{1, 2}, {1}, {3}}; !reflect.DeepEqual(days, want) {
+		t.Errorf("days are %v, expected %v", days, want)
+	}
+}
+
+// benchObs parses n of the lines using one goroutine per CPU, and
+// calls send with the index of the goroutine, the key (year) of the
+// line and each valid value.  When a goroutine is done, it calls done
+// with its index.
+func benchObs(lines [][]byte, n int, send func(p int, key string, r *Obs), done func(p int)) {
+
+	pol := DefaultPolicy()
+	np := runtime.GOMAXPROCS(0)
+
+	var wg sync.WaitGroup
+	for p := 0; p < np; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			var rec Record
+			for i := p; i < n; i += np {
+				err := ParseBytes(lines[i%len(lines)], pol, &rec)
+				if err != nil {
+					panic(err)
+				}
+				key := strconv.Itoa(rec.Year)
+				for j := 0; j < rec.NDays; j++ {
+					if !rec.IsValid[j] {
+						continue
+					}
+					r := Obs{Id: rec.Id, Year: rec.Year, Month: rec.Month, Day: j + 1,
+						Value: rec.Values[j] / 10, MFlag: rec.MFlag[j], QFlag: rec.QFlag[j],
+						SFlag: rec.SFlag[j]}
+					send(p, key, &r)
+				}
+			}
+			done(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// BenchmarkSendBaseline times the original transport of
+// gcos_columnize.go: each value is sent through an unbuffered channel
+// to a single goroutine, which gob encodes it into the buffer of its
+// year.  The buffers are discarded when they reach 1MB.
+func BenchmarkSendBaseline(b *testing.B) {
+
+	lines := testLines(1000)
+	ch := make(chan Obs)
+	fin := make(chan bool)
+
+	go func() {
+		bufs := make(map[int]*bytes.Buffer)
+		encs := make(map[int]*gob.Encoder)
+		for r := range ch {
+			if encs[r.Year] == nil {
+				bufs[r.Year] = new(bytes.Buffer)
+				encs[r.Year] = gob.NewEncoder(bufs[r.Year])
+			}
+			err := encs[r.Year].Encode(r)
+			if err != nil {
+				panic(err)
+			}
+			if bufs[r.Year].Len() > 1<<20 {
+				bufs[r.Year].Truncate(0)
+			}
+		}
+		fin <- true
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	benchObs(lines, b.N, func(p int, key string, r *Obs) { ch <- *r }, func(int) {})
+	close(ch)
+	<-fin
+}
+
+// BenchmarkSend times the transport of gcos_columnize.go: the values
+// are sent with a Sender per goroutine, in batches of 1024 values, to
+// 4 shards that encode them with EncodeBatch and add them to a
+// Spiller, whose buffers are discarded when they are spilled.
+func BenchmarkSend(b *testing.B) {
+
+	const nshards, size = 4, 1024
+	lines := testLines(1000)
+
+	sp, err := NewSpiller(1<<28, SpillLargest, func(string, []byte) error { return nil })
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	chans := make([]chan []KeyObs, nshards)
+	var wg sync.WaitGroup
+	for k := range chans {
+		chans[k] = make(chan []KeyObs, runtime.GOMAXPROCS(0))
+		wg.Add(1)
+		go func(ch chan []KeyObs) {
+			defer wg.Done()
+			var buf []byte
+			for batch := range ch {
+				var err error
+				buf, err = EncodeBatch(batch, buf, sp.Add)
+				if err != nil {
+					panic(err)
+				}
+			}
+		}(chans[k])
+	}
+
+	senders := make([]*Sender, runtime.GOMAXPROCS(0))
+	for p := range senders {
+		senders[p] = NewSender(nshards, size, func(k int, batch []KeyObs) { chans[k] <- batch })
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	benchObs(lines, b.N, func(p int, key string, r *Obs) { senders[p].Add(key, r) },
+		func(p int) { senders[p].Flush() })
+	for _, ch := range chans {
+		close(ch)
+	}
+	wg.Wait()
+}
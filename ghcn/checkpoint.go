@@ -0,0 +1,116 @@
+package ghcn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// CheckpointFile is the name of the file in the top level directory of
+// a columnized store that records the progress of a run that has not
+// finished.
+const CheckpointFile = "checkpoint.json"
+
+// The phases of a columnizing run, see Checkpoint.
+const (
+	PhaseIngest = "ingest" // The input files are being read
+	PhaseSort   = "sort"   // The partitions are being sorted and written
+)
+
+// Checkpoint records the progress of a run that builds a columnized
+// store, so that a run that was interrupted can be resumed rather than
+// repeated.
+type Checkpoint struct {
+
+	// Describes the settings of the run.  A run with other settings
+	// cannot be resumed.
+	Config string
+
+	// PhaseIngest or PhaseSort
+	Phase string
+
+	// The manifest of the run, including the contributions of the
+	// input files that have been read in full
+	Manifest *Manifest
+
+	// The input files that are read in full
+	Changed []string
+
+	// The partitions that are rebuilt.  The list only includes the
+	// partitions of the changed files once all the changed files have
+	// been read.
+	Affected []string
+
+	// The input files whose data are in the temporary files
+	Done []string
+
+	// The number of lines in the files in Done, and the number of
+	// them that were malformed
+	Lines, Rejects int
+
+	// The size in bytes of the temporary file of each partition that
+	// holds the data from the files in Done
+	Sizes map[string]int64
+
+	// The partitions whose output files are complete, and the number
+	// of values in them that could not be represented and were
+	// stored as missing
+	Sorted  []string
+	Dropped int
+}
+
+// ReadCheckpoint reads the checkpoint of the store in directory dir.
+// If there is no checkpoint, nil is returned without an error.
+func ReadCheckpoint(dir string) (*Checkpoint, error) {
+
+	b, err := ioutil.ReadFile(path.Join(dir, CheckpointFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := new(Checkpoint)
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", CheckpointFile, err)
+	}
+	if c.Manifest == nil {
+		return nil, fmt.Errorf("%s: no manifest", CheckpointFile)
+	}
+	if c.Manifest.Files == nil {
+		c.Manifest.Files = make(map[string]*InputFile)
+	}
+	if c.Sizes == nil {
+		c.Sizes = make(map[string]int64)
+	}
+
+	return c, nil
+}
+
+// Write writes the checkpoint to the store in directory dir.  The
+// checkpoint is replaced atomically, so that a run that is interrupted
+// while writing it can resume from the previous checkpoint.
+func (c *Checkpoint) Write(dir string) error {
+
+	sort.Strings(c.Changed)
+	sort.Strings(c.Affected)
+	sort.Strings(c.Done)
+	sort.Strings(c.Sorted)
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fname := path.Join(dir, CheckpointFile)
+	err = ioutil.WriteFile(fname+".tmp", append(b, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fname+".tmp", fname)
+}
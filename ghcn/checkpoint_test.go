@@ -0,0 +1,92 @@
+package ghcn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// There is no checkpoint after a run that finished.
+	c, err := ReadCheckpoint(dir)
+	if err != nil || c != nil {
+		t.Fatalf("reading a missing checkpoint gives %v, %v", c, err)
+	}
+
+	m := NewManifest("partitioning=year")
+	m.Files["a.dly"] = &InputFile{Size: 100, ModTime: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		Hash: "abc", Stations: []string{"USW00094728"}, Years: []int{1990}, Parts: []string{"1990"}}
+	m.Files["b.dly"] = &InputFile{Size: 10, ModTime: time.Date(2020, 5, 2, 12, 0, 0, 0, time.UTC)}
+
+	for _, c := range []*Checkpoint{
+		{
+			Config:   "partitioning=year",
+			Phase:    PhaseIngest,
+			Manifest: m,
+			Changed:  []string{"b.dly", "a.dly"},
+			Done:     []string{"a.dly"},
+			Sizes:    map[string]int64{"1990": 1200},
+		},
+		{
+			Config:   "partitioning=year",
+			Phase:    PhaseSort,
+			Manifest: m,
+			Changed:  []string{"b.dly", "a.dly"},
+			Affected: []string{"1991", "1990"},
+			Done:     []string{"b.dly", "a.dly"},
+			Sizes:    map[string]int64{"1990": 1200, "1991": 0},
+			Sorted:   []string{"1991"},
+		},
+	} {
+		err = c.Write(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadCheckpoint(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("%s: read %+v, expected %+v", c.Phase, got, c)
+		}
+		if got.Changed[0] != "a.dly" {
+			t.Errorf("%s: the lists are not sorted: %v", c.Phase, got.Changed)
+		}
+		if _, err := os.Stat(filepath.Join(dir, CheckpointFile+".tmp")); !os.IsNotExist(err) {
+			t.Errorf("%s: the temporary file is left", c.Phase)
+		}
+	}
+
+	// The maps of a checkpoint are not nil after reading.
+	c = &Checkpoint{Phase: PhaseIngest, Manifest: &Manifest{}}
+	err = c.Write(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = ReadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Manifest.Files == nil || c.Sizes == nil {
+		t.Errorf("read %+v", c)
+	}
+
+	// A checkpoint must have a manifest.
+	err = ioutil.WriteFile(filepath.Join(dir, CheckpointFile), []byte(`{"Phase": "sort"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCheckpoint(dir); err == nil {
+		t.Errorf("no error for a checkpoint without manifest")
+	}
+}
@@ -0,0 +1,164 @@
+package ghcn
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// BaselineRule defines the reference period used to compute
+// climatological baselines, and how many years of data must be
+// present in the reference period for a baseline to be used.
+type BaselineRule struct {
+	FirstYear int // First year of the reference period
+	LastYear  int // Last year of the reference period
+	MinYears  int // Minimum number of years present in the reference period
+}
+
+// Enabled returns true if a reference period has been set.
+func (r *BaselineRule) Enabled() bool {
+	return r.FirstYear != 0 || r.LastYear != 0
+}
+
+// RegisterFlags defines the -baseline and -baseline-min-years command
+// line flags that can be used to configure the rule.
+func (r *BaselineRule) RegisterFlags(fs *flag.FlagSet) {
+
+	fs.Func("baseline", "Reference period first-last (e.g. 1981-2010) for anomalies",
+		func(s string) error {
+			_, err := fmt.Sscanf(s, "%d-%d", &r.FirstYear, &r.LastYear)
+			if err != nil {
+				return fmt.Errorf("baseline %q: %v", s, err)
+			}
+			return nil
+		})
+
+	fs.IntVar(&r.MinYears, "baseline-min-years", r.MinYears,
+		"Minimum number of years in the reference period needed for a baseline")
+}
+
+// climKey identifies one baseline: a station, an element and a
+// calendar month.
+type climKey struct {
+	Id      string
+	Element string
+	Month   int
+}
+
+// climSum accumulates the values within the reference period for one
+// baseline.
+type climSum struct {
+	sum    float64
+	nyears int
+}
+
+// Climatology computes per-station, per-element, per-calendar-month
+// baselines from monthly values, and anomalies relative to these
+// baselines.  All the monthly values for a station should be added
+// before any anomalies for the station are computed.
+type Climatology struct {
+	Rule BaselineRule
+
+	sums map[climKey]*climSum
+
+	// The station/element pairs for which values have been added
+	seen map[[2]string]bool
+}
+
+// ClimFailure describes a baseline that could not be computed because
+// too few years were present in the reference period.
+type ClimFailure struct {
+	Id      string // The station id
+	Element string // The element type
+	Month   int    // The calendar month (1..12)
+	Nyears  int    // The number of years present in the reference period
+}
+
+// NewClimatology returns a Climatology that computes baselines
+// following the given rule.
+func NewClimatology(rule BaselineRule) *Climatology {
+	return &Climatology{
+		Rule: rule,
+		sums: make(map[climKey]*climSum),
+		seen: make(map[[2]string]bool),
+	}
+}
+
+// Add includes one monthly value in the baseline calculations.  Values
+// outside the reference period, and NaN values, are ignored.
+func (c *Climatology) Add(id, element string, year, month int, value float64) {
+
+	c.seen[[2]string{id, element}] = true
+
+	if year < c.Rule.FirstYear || year > c.Rule.LastYear || math.IsNaN(value) {
+		return
+	}
+
+	k := climKey{id, element, month}
+	cs, ok := c.sums[k]
+	if !ok {
+		cs = new(climSum)
+		c.sums[k] = cs
+	}
+	cs.sum += value
+	cs.nyears++
+}
+
+// Baseline returns the baseline (mean over the reference period) for
+// the given station, element and calendar month.  The second returned
+// value is false if the baseline does not satisfy the rule.
+func (c *Climatology) Baseline(id, element string, month int) (float64, bool) {
+
+	cs, ok := c.sums[climKey{id, element, month}]
+	if !ok || cs.nyears == 0 || cs.nyears < c.Rule.MinYears {
+		return math.NaN(), false
+	}
+
+	return cs.sum / float64(cs.nyears), true
+}
+
+// Anomaly returns the difference between value and the corresponding
+// baseline, or NaN if there is no baseline.
+func (c *Climatology) Anomaly(id, element string, month int, value float64) float64 {
+
+	b, ok := c.Baseline(id, element, month)
+	if !ok {
+		return math.NaN()
+	}
+
+	return value - b
+}
+
+// Failures returns the baselines that do not satisfy the rule, for
+// every station and element for which values were added, sorted by
+// station, element and month.
+func (c *Climatology) Failures() []ClimFailure {
+
+	var fail []ClimFailure
+	for se := range c.seen {
+		for month := 1; month <= 12; month++ {
+			_, ok := c.Baseline(se[0], se[1], month)
+			if ok {
+				continue
+			}
+			n := 0
+			if cs, ok := c.sums[climKey{se[0], se[1], month}]; ok {
+				n = cs.nyears
+			}
+			fail = append(fail, ClimFailure{se[0], se[1], month, n})
+		}
+	}
+
+	sort.Slice(fail, func(i, j int) bool {
+		if fail[i].Id != fail[j].Id {
+			return fail[i].Id < fail[j].Id
+		}
+		if fail[i].Element != fail[j].Element {
+			return fail[i].Element < fail[j].Element
+		}
+		return fail[i].Month < fail[j].Month
+	})
+
+	return fail
+}
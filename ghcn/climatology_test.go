@@ -0,0 +1,106 @@
+package ghcn
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestClimatology(t *testing.T) {
+
+	nan := math.NaN()
+	c := NewClimatology(BaselineRule{FirstYear: 1981, LastYear: 1983, MinYears: 2})
+
+	for _, v := range []struct {
+		id, element string
+		year, month int
+		value       float64
+	}{
+		{"USW00094728", "TMAX", 1980, 1, 100}, // Before the reference period
+		{"USW00094728", "TMAX", 1981, 1, 1},
+		{"USW00094728", "TMAX", 1982, 1, 3},
+		{"USW00094728", "TMAX", 1983, 1, nan},
+		{"USW00094728", "TMAX", 1984, 1, 100}, // After the reference period
+		{"USW00094728", "TMAX", 1981, 2, 4},
+		{"USW00094728", "TMAX", 1990, 3, 4},
+		{"CA006158355", "PRCP", 1981, 1, 10},
+		{"CA006158355", "PRCP", 1982, 1, 20},
+		{"CA006158355", "PRCP", 1983, 1, 30},
+	} {
+		c.Add(v.id, v.element, v.year, v.month, v.value)
+	}
+
+	for _, tc := range []struct {
+		id, element string
+		month       int
+		baseline    float64
+		ok          bool
+		value       float64
+		anomaly     float64
+	}{
+		{"USW00094728", "TMAX", 1, 2, true, 5, 3},
+		{"USW00094728", "TMAX", 2, nan, false, 5, nan},
+		{"USW00094728", "TMAX", 3, nan, false, 5, nan},
+		{"USW00094728", "PRCP", 1, nan, false, 5, nan},
+		{"CA006158355", "PRCP", 1, 20, true, 15, -5},
+	} {
+		b, ok := c.Baseline(tc.id, tc.element, tc.month)
+		if !near(b, tc.baseline, 1e-12) || ok != tc.ok {
+			t.Errorf("baseline of %s %s %d is %v %v, expected %v %v", tc.id, tc.element,
+				tc.month, b, ok, tc.baseline, tc.ok)
+		}
+		if a := c.Anomaly(tc.id, tc.element, tc.month, tc.value); !near(a, tc.anomaly, 1e-12) {
+			t.Errorf("anomaly of %v for %s %s %d is %v, expected %v", tc.value, tc.id,
+				tc.element, tc.month, a, tc.anomaly)
+		}
+	}
+
+	// Every month without a baseline of the station/element pairs
+	// that have values is a failure.
+	var want []ClimFailure
+	for m := 2; m <= 12; m++ {
+		want = append(want, ClimFailure{"CA006158355", "PRCP", m, 0})
+	}
+	want = append(want, ClimFailure{"USW00094728", "TMAX", 2, 1})
+	for m := 3; m <= 12; m++ {
+		want = append(want, ClimFailure{"USW00094728", "TMAX", m, 0})
+	}
+	if f := c.Failures(); !reflect.DeepEqual(f, want) {
+		t.Errorf("failures are\n%v\nexpected\n%v", f, want)
+	}
+}
+
+func TestBaselineRule(t *testing.T) {
+
+	for _, tc := range []struct {
+		args    []string
+		rule    BaselineRule
+		enabled bool
+	}{
+		{nil, BaselineRule{}, false},
+		{[]string{"-baseline", "1981-2010"}, BaselineRule{FirstYear: 1981, LastYear: 2010}, true},
+		{[]string{"-baseline", "1961-1990", "-baseline-min-years", "20"},
+			BaselineRule{FirstYear: 1961, LastYear: 1990, MinYears: 20}, true},
+	} {
+		var r BaselineRule
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		r.RegisterFlags(fs)
+		err := fs.Parse(tc.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != tc.rule || r.Enabled() != tc.enabled {
+			t.Errorf("%v: rule %+v, enabled %v", tc.args, r, r.Enabled())
+		}
+	}
+
+	var r BaselineRule
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	r.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-baseline", "1981"}); err == nil {
+		t.Errorf("no error for an incomplete reference period")
+	}
+}
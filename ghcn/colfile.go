@@ -0,0 +1,436 @@
+package ghcn
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+)
+
+// This file contains the writers for the column files of the
+// columnized store, and the format marker that tells readers which
+// layout a partition uses.
+//
+// Layout version 1 (written by the original gcos_columnize.go, there
+// is no format file):
+//
+// ids.gz: the station ids, as newline delimited text
+// dates.gz: the dates, as newline delimited iso dates (e.g. 1909-03-15)
+// values.gz: the values, as little endian float64 values
+//
+// Layout version 2:
+//
+// format.json: the Format, see below
+// idtable.gz: the distinct station ids, as newline delimited text
+// ids.gz: for each observation, the position of its station id in
+//     idtable.gz, as little endian int32 values
+// dates.gz: the dates, as little endian int32 days since 1970-01-01
+// values.gz: the values, as little endian float64 values, or as
+//     little endian int16 values that are multiplied by Format.Scale
+// stats.json: the statistics of the partition and of its blocks (see
+//     colstats.go).  This file is optional.
+//
+// Layout version 3 (several elements, one row per station and date):
+//
+// format.json: the Format, whose Elements field lists the elements
+// idtable.gz, ids.gz, dates.gz: as in version 2
+// values_E.gz: the values of element E (e.g. values_TMAX.gz), as in
+//     version 2, with zero for the rows where E is missing
+// valid_E.gz: a bitmap with one bit per row that is set if element E
+//     is present, with the bits of each byte used from the least
+//     significant bit on
+// stats.json: as in version 2, this file is required
+
+// FormatFile is the name of the file that describes the layout of a
+// partition.
+const FormatFile = "format.json"
+
+// Format describes the layout of the files in one partition of the
+// columnized store.
+type Format struct {
+	Version  int      // The layout version
+	Values   string   // The type of the values, "float64" or "int16"
+	Scale    float64  // For int16 values, the value of one unit
+	Elements []string `json:",omitempty"` // The elements, for layout version 3
+}
+
+// ReadFormat reads the format file in directory dir.  Directories
+// without a format file use layout version 1.
+func ReadFormat(dir string) (*Format, error) {
+
+	b, err := ioutil.ReadFile(path.Join(dir, FormatFile))
+	if os.IsNotExist(err) {
+		return &Format{Version: 1, Values: "float64"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f := new(Format)
+	err = json.Unmarshal(b, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// WriteFormat writes the format file in directory dir.
+func WriteFormat(dir string, f *Format) error {
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, FormatFile), append(b, '\n'), 0600)
+}
+
+// writeGz creates a gzip compressed file and calls w to write its
+// contents.
+func writeGz(fname string, w func(*bufio.Writer) error) error {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	gz := gzip.NewWriter(fid)
+	wtr := bufio.NewWriter(gz)
+
+	err = w(wtr)
+	if err != nil {
+		return err
+	}
+	err = wtr.Flush()
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+
+	return fid.Close()
+}
+
+// WriteStrings writes x to a gzip compressed file as newline delimited
+// text.
+func WriteStrings(x []string, fname string) error {
+	return writeGz(fname, func(w *bufio.Writer) error {
+		for _, s := range x {
+			w.WriteString(s)
+			w.WriteByte('\n')
+		}
+		return nil
+	})
+}
+
+// gzWriter is a gzip compressed file that is written sequentially.
+type gzWriter struct {
+	fid *os.File
+	gz  *gzip.Writer
+	wtr *bufio.Writer
+}
+
+func createGz(fname string) (*gzWriter, error) {
+	fid, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(fid)
+	return &gzWriter{fid: fid, gz: gz, wtr: bufio.NewWriter(gz)}, nil
+}
+
+// endMember finishes the current gzip member, so that the data that
+// are written next can be decompressed starting from the returned
+// offset.
+func (g *gzWriter) endMember() (int64, error) {
+	err := g.wtr.Flush()
+	if err != nil {
+		return 0, err
+	}
+	err = g.gz.Close()
+	if err != nil {
+		return 0, err
+	}
+	g.gz.Reset(g.fid)
+	return g.fid.Seek(0, io.SeekCurrent)
+}
+
+func (g *gzWriter) Close() error {
+	err := g.wtr.Flush()
+	if e := g.gz.Close(); err == nil {
+		err = e
+	}
+	if e := g.fid.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// PartWriter writes the column files of one partition in layout
+// version 2, or in layout version 3 if Format.Elements is not empty.
+// The rows are written one at a time, so a partition of any size can
+// be written.  The id table, the statistics and the format file are
+// written by Close.
+type PartWriter struct {
+
+	// The number of rows in each block (see colstats.go), which may
+	// be changed before the first call to Write.  In layout version
+	// 3 it is rounded up to a multiple of 8, so that the validity
+	// bitmaps of each block start at a byte boundary.
+	BlockSize int
+
+	dir    string
+	format Format
+	files  []*gzWriter
+	codes  map[string]int32
+	ids    []string
+	stats  PartStats
+	block  *BlockStats
+	bits   []byte // The validity bits of the current rows, by element
+	nbit   uint   // The number of rows in bits
+	one    [1]float64
+	buf    [8]byte
+}
+
+// NewPartWriter creates the column files for a partition in directory
+// dir, which must exist.  The Values and Scale fields of format
+// determine how the values are stored, and the Elements field lists
+// the elements of a partition with several elements.
+func NewPartWriter(dir string, format *Format) (*PartWriter, error) {
+
+	w := &PartWriter{BlockSize: DefaultBlockSize, dir: dir, format: *format,
+		codes: make(map[string]int32)}
+	w.format.Version = 2
+	switch w.format.Values {
+	case "", "float64":
+		w.format.Values = "float64"
+	case "int16":
+		if w.format.Scale <= 0 {
+			return nil, fmt.Errorf("invalid scale %v for int16 values", w.format.Scale)
+		}
+	default:
+		return nil, fmt.Errorf("unknown value type %q", w.format.Values)
+	}
+
+	fnames := []string{"ids.gz", "dates.gz", "values.gz"}
+	if len(w.format.Elements) > 0 {
+		w.format.Version = 3
+		w.format.Elements = append([]string(nil), w.format.Elements...)
+		w.bits = make([]byte, len(w.format.Elements))
+		fnames = fnames[0:2]
+		for _, e := range w.format.Elements {
+			fnames = append(fnames, "values_"+e+".gz", "valid_"+e+".gz")
+		}
+	}
+
+	for _, fn := range fnames {
+		g, err := createGz(path.Join(dir, fn))
+		if err != nil {
+			for _, g := range w.files {
+				g.Close()
+			}
+			return nil, err
+		}
+		w.files = append(w.files, g)
+	}
+
+	return w, nil
+}
+
+// startBlock finishes the current block, if any, and starts a new
+// one.
+func (w *PartWriter) startBlock() error {
+
+	b := BlockStats{Offsets: make([]int64, len(w.files))}
+	if w.block != nil {
+		w.stats.merge(&w.block.ColumnStats)
+		w.flushBits()
+		for j, g := range w.files {
+			var err error
+			b.Offsets[j], err = g.endMember()
+			if err != nil {
+				return err
+			}
+		}
+	} else if len(w.format.Elements) > 0 {
+		w.BlockSize = (w.BlockSize + 7) / 8 * 8
+	}
+	if len(w.format.Elements) > 0 {
+		b.Values = make([]FloatStats, len(w.format.Elements))
+	}
+
+	w.stats.Blocks = append(w.stats.Blocks, b)
+	w.block = &w.stats.Blocks[len(w.stats.Blocks)-1]
+
+	return nil
+}
+
+// flushBits writes the validity bits of the rows that have not been
+// written, padding the last byte with zeros.
+func (w *PartWriter) flushBits() {
+	if w.nbit == 0 {
+		return
+	}
+	for k, b := range w.bits {
+		w.files[3+2*k].wtr.WriteByte(b)
+		w.bits[k] = 0
+	}
+	w.nbit = 0
+}
+
+// Fits returns true if value can be stored in a partition with this
+// format, which is always the case for float64 values.  int16 values
+// hold multiples of Scale from math.MinInt16*Scale to
+// math.MaxInt16*Scale.
+func (f *Format) Fits(value float64) bool {
+	if f.Values != "int16" {
+		return true
+	}
+	u := math.Round(value / f.Scale)
+	return u >= math.MinInt16 && u <= math.MaxInt16
+}
+
+// putValue writes one value to g, and returns the value that a reader
+// obtains.  An error is returned if the value does not fit in an int16
+// value with the given scale.
+func (w *PartWriter) putValue(g *gzWriter, value float64) (float64, error) {
+
+	if w.format.Values == "int16" {
+		if !w.format.Fits(value) {
+			return 0, fmt.Errorf("value %v does not fit in int16 with scale %v",
+				value, w.format.Scale)
+		}
+		u := math.Round(value / w.format.Scale)
+		binary.LittleEndian.PutUint16(w.buf[0:2], uint16(int16(u)))
+		_, err := g.wtr.Write(w.buf[0:2])
+		return u / (1 / w.format.Scale), err
+	}
+
+	binary.LittleEndian.PutUint64(w.buf[:], math.Float64bits(value))
+	_, err := g.wtr.Write(w.buf[:])
+	return value, err
+}
+
+// Write adds one observation to a partition of one element.  An error
+// is returned if the value does not fit in an int16 value with the
+// given scale.
+func (w *PartWriter) Write(id string, date Date, value float64) error {
+	w.one[0] = value
+	return w.WriteRow(id, date, w.one[:], nil)
+}
+
+// WriteRow adds one row to the partition.  For a partition of several
+// elements, values and valid give the value of each element in the
+// order of Format.Elements, and whether it is present, the values of
+// the missing elements are not used.  For a partition of one element,
+// values contains the value and valid is nil.
+func (w *PartWriter) WriteRow(id string, date Date, values []float64, valid []bool) error {
+
+	nel := len(w.format.Elements)
+	if nel == 0 && (len(values) != 1 || valid != nil) {
+		return fmt.Errorf("a partition of one element needs one value per row")
+	}
+	if nel > 0 && (len(values) != nel || len(valid) != nel) {
+		return fmt.Errorf("a row has %d values, expected %d", len(values), nel)
+	}
+
+	if w.block == nil || w.block.Rows >= w.BlockSize {
+		err := w.startBlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	code, ok := w.codes[id]
+	if !ok {
+		code = int32(len(w.ids))
+		w.codes[id] = code
+		w.ids = append(w.ids, id)
+	}
+
+	binary.LittleEndian.PutUint32(w.buf[0:4], uint32(code))
+	w.files[0].wtr.Write(w.buf[0:4])
+
+	binary.LittleEndian.PutUint32(w.buf[0:4], uint32(date))
+	w.files[1].wtr.Write(w.buf[0:4])
+
+	b := w.block
+	b.Rows++
+	b.Id.add(id)
+	b.Date.add(date)
+
+	// The statistics describe the values as they are read.
+	if nel == 0 {
+		v, err := w.putValue(w.files[2], values[0])
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", id, date, err)
+		}
+		b.Value.add(v)
+		return nil
+	}
+
+	for k, x := range values {
+		if !valid[k] {
+			x = 0
+		}
+		v, err := w.putValue(w.files[2+2*k], x)
+		if err != nil {
+			return fmt.Errorf("%s %s %s: %v", id, date, w.format.Elements[k], err)
+		}
+		if valid[k] {
+			w.bits[k] |= 1 << w.nbit
+			b.Values[k].add(v)
+		} else {
+			b.Values[k].NullCount++
+		}
+	}
+	w.nbit++
+	if w.nbit == 8 {
+		w.flushBits()
+	}
+
+	return nil
+}
+
+// Close finishes the column files, and writes the id table, the
+// statistics and the format file.  The format file is written last,
+// so that a partition with a format file is complete.
+func (w *PartWriter) Close() error {
+
+	if w.block != nil {
+		w.stats.merge(&w.block.ColumnStats)
+	}
+	w.stats.BlockSize = w.BlockSize
+	w.flushBits()
+
+	var err error
+	for _, g := range w.files {
+		if e := g.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = WriteStrings(w.ids, path.Join(w.dir, "idtable.gz"))
+	if err != nil {
+		return err
+	}
+
+	err = WriteStats(w.dir, &w.stats)
+	if err != nil {
+		return err
+	}
+
+	return WriteFormat(w.dir, &w.format)
+}
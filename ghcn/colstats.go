@@ -0,0 +1,223 @@
+package ghcn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+)
+
+// This file contains the statistics that are stored with each
+// partition of the columnized store.  The rows of a partition are
+// written in blocks of PartWriter.BlockSize rows, and each block is a
+// separate gzip member in each column file, so that a reader can seek
+// to a block and decompress it without reading the blocks before it.
+// The statistics of the partition and of each block are stored in
+// the file stats.json, which readers use to skip the partitions and
+// blocks that cannot contain rows that pass a filter.
+
+// StatsFile is the name of the file that holds the statistics of a
+// partition.
+const StatsFile = "stats.json"
+
+// DefaultBlockSize is the default number of rows in each block.
+const DefaultBlockSize = 1 << 16
+
+// StringStats summarizes a column of strings.
+type StringStats struct {
+	Count     int // The number of values that are not null
+	NullCount int // The number of null (empty) values
+	Min, Max  string
+}
+
+// DateStats summarizes a column of dates.
+type DateStats struct {
+	Count     int
+	NullCount int
+	Min, Max  Date // In days since 1970-01-01
+}
+
+// FloatStats summarizes a column of floating point values.  NaN values
+// are counted as null.
+type FloatStats struct {
+	Count     int
+	NullCount int
+	Min, Max  float64
+}
+
+// ColumnStats summarizes the id, date and value columns of a set of
+// rows.  For a partition of several elements, Values summarizes the
+// value column of each element, in which the missing values are null,
+// and Value is not used.
+type ColumnStats struct {
+	Rows   int
+	Id     StringStats
+	Date   DateStats
+	Value  FloatStats
+	Values []FloatStats `json:",omitempty"`
+}
+
+// BlockStats describes one block of rows in a partition.
+type BlockStats struct {
+	ColumnStats
+
+	// The byte offsets at which the block starts in each column
+	// file: ids.gz, dates.gz and values.gz, or for a partition of
+	// several elements, ids.gz, dates.gz and the values and valid
+	// files of each element
+	Offsets []int64
+}
+
+// PartStats describes a partition and its blocks.
+type PartStats struct {
+	ColumnStats
+	BlockSize int
+	Blocks    []BlockStats
+}
+
+func (s *StringStats) add(x string) {
+	if x == "" {
+		s.NullCount++
+		return
+	}
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 0 || x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+}
+
+func (s *StringStats) merge(t *StringStats) {
+	if t.Count > 0 {
+		if s.Count == 0 || t.Min < s.Min {
+			s.Min = t.Min
+		}
+		if s.Count == 0 || t.Max > s.Max {
+			s.Max = t.Max
+		}
+	}
+	s.Count += t.Count
+	s.NullCount += t.NullCount
+}
+
+func (s *DateStats) add(x Date) {
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 0 || x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+}
+
+func (s *DateStats) merge(t *DateStats) {
+	if t.Count > 0 {
+		if s.Count == 0 || t.Min < s.Min {
+			s.Min = t.Min
+		}
+		if s.Count == 0 || t.Max > s.Max {
+			s.Max = t.Max
+		}
+	}
+	s.Count += t.Count
+	s.NullCount += t.NullCount
+}
+
+func (s *FloatStats) add(x float64) {
+	if math.IsNaN(x) {
+		s.NullCount++
+		return
+	}
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 0 || x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+}
+
+func (s *FloatStats) merge(t *FloatStats) {
+	if t.Count > 0 {
+		if s.Count == 0 || t.Min < s.Min {
+			s.Min = t.Min
+		}
+		if s.Count == 0 || t.Max > s.Max {
+			s.Max = t.Max
+		}
+	}
+	s.Count += t.Count
+	s.NullCount += t.NullCount
+}
+
+func (s *ColumnStats) merge(t *ColumnStats) {
+	s.Rows += t.Rows
+	s.Id.merge(&t.Id)
+	s.Date.merge(&t.Date)
+	s.Value.merge(&t.Value)
+	if len(s.Values) < len(t.Values) {
+		s.Values = append(s.Values, make([]FloatStats, len(t.Values)-len(s.Values))...)
+	}
+	for k := range t.Values {
+		s.Values[k].merge(&t.Values[k])
+	}
+}
+
+// hasPrefix reports whether the strings in s may include a string that
+// starts with prefix.
+func (s *StringStats) hasPrefix(prefix string) bool {
+	if s.Count == 0 || s.Max < prefix {
+		return false
+	}
+	m := s.Min
+	if len(m) > len(prefix) {
+		m = m[0:len(prefix)]
+	}
+	return m <= prefix
+}
+
+// contains reports whether the strings in s may include any of the
+// strings in x.
+func (s *StringStats) contains(x map[string]bool) bool {
+	for v := range x {
+		if s.Count > 0 && v >= s.Min && v <= s.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadStats reads the statistics of the partition in directory dir.
+// If there is no statistics file, nil is returned without an error.
+func ReadStats(dir string) (*PartStats, error) {
+
+	b, err := ioutil.ReadFile(path.Join(dir, StatsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := new(PartStats)
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %v", dir, StatsFile, err)
+	}
+
+	return s, nil
+}
+
+// WriteStats writes the statistics of the partition in directory dir.
+func WriteStats(dir string, s *PartStats) error {
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, StatsFile), append(b, '\n'), 0600)
+}
@@ -0,0 +1,55 @@
+package ghcn
+
+import (
+	"fmt"
+	"time"
+)
+
+// Date is a calendar date, stored as the number of days since
+// 1970-01-01.
+type Date int32
+
+// epoch is the date with value zero
+var epoch = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// NewDate returns the Date for the given year, month (1..12) and day.
+func NewDate(year, month, day int) Date {
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	return DateOf(t)
+}
+
+// DateOf returns the Date of a time, which should be in UTC.
+func DateOf(t time.Time) Date {
+	s := t.Unix()
+	d := s / 86400
+	if s%86400 < 0 {
+		d--
+	}
+	return Date(d)
+}
+
+// Time returns the date as a time at midnight UTC.
+func (d Date) Time() time.Time {
+	return epoch.AddDate(0, 0, int(d))
+}
+
+// YMD returns the year, month (1..12) and day of the date.
+func (d Date) YMD() (int, int, int) {
+	y, m, day := d.Time().Date()
+	return y, int(m), day
+}
+
+// String returns the date in ISO format, e.g. 1909-03-15.
+func (d Date) String() string {
+	y, m, day := d.YMD()
+	return fmt.Sprintf("%04d-%02d-%02d", y, m, day)
+}
+
+// ParseDate parses a date in ISO format, e.g. 1909-03-15.
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return 0, err
+	}
+	return DateOf(t), nil
+}
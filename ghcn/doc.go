@@ -0,0 +1,8 @@
+// Package ghcn contains code that is shared by the scripts in this
+// workshop that process GHCN-Daily (Global Historical Climatology
+// Network) data, i.e. gcos_monthly.go, gcos_monthly_concurrent.go and
+// gcos_columnize.go.
+//
+// The data file format is available here:
+// ftp://ftp.ncdc.noaa.gov/pub/data/ghcn/daily/readme.txt
+package ghcn
@@ -0,0 +1,93 @@
+package ghcn
+
+import "math"
+
+// Agg identifies the rule used to combine the daily values for one
+// station month into a single monthly value.
+type Agg int
+
+const (
+	// Mean is the average of the valid daily values
+	Mean Agg = iota
+
+	// Total is the sum of the valid daily values
+	Total
+
+	// Max is the largest valid daily value
+	Max
+)
+
+// String returns the name of the aggregation rule.
+func (a Agg) String() string {
+	switch a {
+	case Mean:
+		return "mean"
+	case Total:
+		return "total"
+	case Max:
+		return "max"
+	}
+	return "unknown"
+}
+
+// Element describes how the values of one GHCN-Daily element type are
+// summarized.
+type Element struct {
+	Name  string  // The element code, e.g. "TMAX"
+	Agg   Agg     // How daily values are combined into a monthly value
+	Scale float64 // Multiply raw values by Scale to obtain Units
+	Units string  // The units of the scaled values
+}
+
+// Elements contains the rules for the element types that we know how
+// to summarize.  The raw units are documented in the data format
+// readme.
+var Elements = map[string]*Element{
+	// Precipitation, raw units are 0.1 mm
+	"PRCP": {Name: "PRCP", Agg: Total, Scale: 0.1, Units: "mm"},
+
+	// Snowfall, raw units are mm
+	"SNOW": {Name: "SNOW", Agg: Total, Scale: 1, Units: "mm"},
+
+	// Snow depth, raw units are mm
+	"SNWD": {Name: "SNWD", Agg: Max, Scale: 1, Units: "mm"},
+
+	// Average temperature, raw units are 0.1 degree C
+	"TAVG": {Name: "TAVG", Agg: Mean, Scale: 0.1, Units: "C"},
+
+	// Maximum temperature, raw units are 0.1 degree C
+	"TMAX": {Name: "TMAX", Agg: Mean, Scale: 0.1, Units: "C"},
+
+	// Minimum temperature, raw units are 0.1 degree C
+	"TMIN": {Name: "TMIN", Agg: Mean, Scale: 0.1, Units: "C"},
+}
+
+// Aggregate combines the valid raw daily values in x into one monthly
+// value, in the scaled units of the element.  NaN is returned if x is
+// empty.
+func (e *Element) Aggregate(x []float64) float64 {
+
+	if len(x) == 0 {
+		return math.NaN()
+	}
+
+	var v float64
+	switch e.Agg {
+	case Mean, Total:
+		for _, y := range x {
+			v += y
+		}
+		if e.Agg == Mean {
+			v /= float64(len(x))
+		}
+	case Max:
+		v = x[0]
+		for _, y := range x[1:] {
+			if y > v {
+				v = y
+			}
+		}
+	}
+
+	return v * e.Scale
+}
@@ -0,0 +1,387 @@
+package ghcn
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// This file contains an external merge sort for fixed size binary
+// records.  Records are collected in memory until the memory budget
+// is reached, then sorted and written to a temporary file (a run).
+// When all the records have been added, the runs are merged.  At most
+// FanIn runs are merged at once, if there are more runs they are
+// first merged in groups into longer runs, in as many passes as
+// needed.  Only one buffered block per run is held in memory during a
+// merge.
+
+// Sorter sorts fixed size records by a key formed by their leading
+// bytes, using a limited amount of memory for the records.
+type Sorter struct {
+	dir     string
+	recsize int
+	keysize int
+	budget  int
+
+	buf    []byte
+	runs   []string
+	nfiles int // The number of run files created
+
+	// The largest number of runs that are merged at once, which can
+	// be changed before Sort is called
+	FanIn int
+
+	// The number of records added, the number of runs that were
+	// written to disk, and the number of merge passes that combined
+	// runs into longer runs
+	Nrec    int
+	Nruns   int
+	Npasses int
+}
+
+// DefaultFanIn is the largest number of runs that a Sorter merges at
+// once, unless its FanIn is changed.
+const DefaultFanIn = 64
+
+// NewSorter returns a Sorter for records of recsize bytes, that are
+// ordered by the first keysize bytes (compared as unsigned bytes).
+// The records held in memory use at most budget bytes, and the runs
+// are written to directory dir.
+func NewSorter(dir string, recsize, keysize, budget int) *Sorter {
+	if budget < recsize {
+		budget = recsize
+	}
+	return &Sorter{dir: dir, recsize: recsize, keysize: keysize, budget: budget, FanIn: DefaultFanIn}
+}
+
+// Add adds a copy of rec to the sorter.
+func (s *Sorter) Add(rec []byte) error {
+
+	if len(rec) != s.recsize {
+		return fmt.Errorf("record has %d bytes, expected %d", len(rec), s.recsize)
+	}
+
+	// The buffer holds as many records as fit in the budget, and is
+	// never grown by append.
+	if s.buf == nil {
+		s.buf = make([]byte, 0, s.budget/s.recsize*s.recsize)
+	}
+	if len(s.buf) == cap(s.buf) {
+		err := s.spill()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.buf = append(s.buf, rec...)
+	s.Nrec++
+
+	return nil
+}
+
+// records sorts the records in a buffer.
+type records struct {
+	buf     []byte
+	recsize int
+	keysize int
+	tmp     []byte
+}
+
+func (r *records) Len() int {
+	return len(r.buf) / r.recsize
+}
+
+func (r *records) rec(i int) []byte {
+	return r.buf[i*r.recsize : (i+1)*r.recsize]
+}
+
+func (r *records) Less(i, j int) bool {
+	return bytes.Compare(r.rec(i)[0:r.keysize], r.rec(j)[0:r.keysize]) < 0
+}
+
+func (r *records) Swap(i, j int) {
+	copy(r.tmp, r.rec(i))
+	copy(r.rec(i), r.rec(j))
+	copy(r.rec(j), r.tmp)
+}
+
+func (s *Sorter) sortBuf() {
+	r := &records{buf: s.buf, recsize: s.recsize, keysize: s.keysize, tmp: make([]byte, s.recsize)}
+	sort.Stable(r)
+}
+
+// spill sorts the records in memory and writes them to a new run.
+func (s *Sorter) spill() error {
+
+	s.sortBuf()
+
+	fname := s.runName()
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, fname)
+	s.Nruns++
+
+	_, err = fid.Write(s.buf)
+	if err != nil {
+		fid.Close()
+		return err
+	}
+	s.buf = s.buf[0:0]
+
+	return fid.Close()
+}
+
+// runName returns the name of a new run file.
+func (s *Sorter) runName() string {
+	s.nfiles++
+	return path.Join(s.dir, fmt.Sprintf("run%04d.bin", s.nfiles-1))
+}
+
+// Sort returns a Merger that yields the records in sorted order.  If
+// all of the records fit in memory, no runs are written.  The Sorter
+// should not be used after calling Sort.
+func (s *Sorter) Sort() (*Merger, error) {
+
+	if len(s.runs) == 0 {
+		s.sortBuf()
+		return &Merger{recsize: s.recsize, keysize: s.keysize, mem: s.buf}, nil
+	}
+
+	if len(s.buf) > 0 {
+		err := s.spill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.buf = nil
+
+	fanin := s.FanIn
+	if fanin < 2 {
+		fanin = 2
+	}
+
+	// Merge groups of consecutive runs, which keeps the sort stable,
+	// until few enough runs are left.
+	for len(s.runs) > fanin {
+		var runs []string
+		for i := 0; i < len(s.runs); i += fanin {
+			j := i + fanin
+			if j > len(s.runs) {
+				j = len(s.runs)
+			}
+			if j-i == 1 {
+				runs = append(runs, s.runs[i])
+				continue
+			}
+			fname, err := s.mergeRuns(s.runs[i:j])
+			if err != nil {
+				for _, f := range append(runs, s.runs[i:]...) {
+					os.Remove(f)
+				}
+				return nil, err
+			}
+			runs = append(runs, fname)
+		}
+		s.runs = runs
+		s.Npasses++
+	}
+
+	// Each run gets an equal share of the budget for its read
+	// buffer.
+	return s.merge(s.runs, s.budget/len(s.runs))
+}
+
+// mergeRuns merges the given runs into a new run, and removes them.
+// The read buffers and the write buffer get equal shares of the
+// budget.
+func (s *Sorter) mergeRuns(runs []string) (string, error) {
+
+	bsize := s.budget / (len(runs) + 1)
+	m, err := s.merge(runs, bsize)
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+
+	fname := s.runName()
+	fid, err := os.Create(fname)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+	if bsize < 4096 {
+		bsize = 4096
+	}
+	wtr := bufio.NewWriterSize(fid, bsize)
+
+	for {
+		rec, err := m.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			os.Remove(fname)
+			return "", err
+		}
+		wtr.Write(rec)
+	}
+
+	err = wtr.Flush()
+	if err == nil {
+		err = fid.Close()
+	}
+	if err != nil {
+		os.Remove(fname)
+		return "", err
+	}
+
+	return fname, m.Close()
+}
+
+// merge returns a Merger for the given runs, each read with a buffer
+// of bsize bytes (at least 4096).
+func (s *Sorter) merge(runs []string, bsize int) (*Merger, error) {
+
+	if bsize < 4096 {
+		bsize = 4096
+	}
+
+	m := &Merger{recsize: s.recsize, keysize: s.keysize}
+	for i, fname := range runs {
+		fid, err := os.Open(fname)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		r := &run{fid: fid, rdr: bufio.NewReaderSize(fid, bsize), rec: make([]byte, s.recsize), index: i}
+		m.runs = append(m.runs, r)
+		err = r.next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.heap.runs = append(m.heap.runs, r)
+	}
+	m.heap.keysize = s.keysize
+	heap.Init(&m.heap)
+
+	return m, nil
+}
+
+// run is a sorted run that is being merged.
+type run struct {
+	fid   *os.File
+	rdr   *bufio.Reader
+	rec   []byte
+	index int
+}
+
+func (r *run) next() error {
+	_, err := io.ReadFull(r.rdr, r.rec)
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%s: truncated run", r.fid.Name())
+	}
+	return err
+}
+
+// runHeap orders the runs by their current record, and then by run,
+// so that the merge is stable.
+type runHeap struct {
+	runs    []*run
+	keysize int
+}
+
+func (h *runHeap) Len() int {
+	return len(h.runs)
+}
+
+func (h *runHeap) Less(i, j int) bool {
+	c := bytes.Compare(h.runs[i].rec[0:h.keysize], h.runs[j].rec[0:h.keysize])
+	if c != 0 {
+		return c < 0
+	}
+	return h.runs[i].index < h.runs[j].index
+}
+
+func (h *runHeap) Swap(i, j int) {
+	h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	h.runs = append(h.runs, x.(*run))
+}
+
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[0 : len(h.runs)-1]
+	return r
+}
+
+// Merger yields the sorted records from a Sorter.
+type Merger struct {
+	recsize int
+	keysize int
+
+	// The records, if they all fit in memory
+	mem []byte
+
+	runs []*run
+	heap runHeap
+	last *run
+}
+
+// Next returns the next record, or io.EOF after the last record.  The
+// record is only valid until the next call to Next.
+func (m *Merger) Next() ([]byte, error) {
+
+	if m.runs == nil {
+		if len(m.mem) == 0 {
+			return nil, io.EOF
+		}
+		rec := m.mem[0:m.recsize]
+		m.mem = m.mem[m.recsize:]
+		return rec, nil
+	}
+
+	// Advance the run that yielded the previous record.
+	if m.last != nil {
+		err := m.last.next()
+		if err == io.EOF {
+			heap.Remove(&m.heap, 0)
+		} else if err != nil {
+			return nil, err
+		} else {
+			heap.Fix(&m.heap, 0)
+		}
+		m.last = nil
+	}
+
+	if m.heap.Len() == 0 {
+		return nil, io.EOF
+	}
+	m.last = m.heap.runs[0]
+
+	return m.last.rec, nil
+}
+
+// Close closes and removes the runs.
+func (m *Merger) Close() error {
+	var err error
+	for _, r := range m.runs {
+		r.fid.Close()
+		if e := os.Remove(r.fid.Name()); e != nil && err == nil {
+			err = e
+		}
+	}
+	m.runs = nil
+	m.mem = nil
+	return err
+}
@@ -0,0 +1,103 @@
+package ghcn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestSorter(t *testing.T) {
+
+	// The records have a 2 byte key, with many ties, followed by the
+	// position at which the record was added, which shows whether the
+	// sort is stable.
+	const recsize = 6
+	const keysize = 2
+
+	for _, tc := range []struct {
+		n      int // The number of records
+		budget int
+		fanin  int
+		runs   int // The expected number of runs
+		passes int // The expected number of merge passes
+	}{
+		{n: 0, budget: 1000, fanin: 64},
+		{n: 100, budget: 1000, fanin: 64},
+		{n: 1000, budget: 6000, fanin: 64},
+		{n: 1000, budget: 600, fanin: 64, runs: 10},
+		{n: 1000, budget: 601, fanin: 64, runs: 10},
+		{n: 1000, budget: 600, fanin: 4, runs: 10, passes: 1},
+		{n: 1000, budget: 60, fanin: 3, runs: 100, passes: 4},
+		{n: 1000, budget: 6, fanin: 2, runs: 1000, passes: 9},
+	} {
+		dir, err := ioutil.TempDir("", "extsort")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		rng := rand.New(rand.NewSource(int64(tc.n)))
+		var want [][]byte
+		s := NewSorter(dir, recsize, keysize, tc.budget)
+		s.FanIn = tc.fanin
+		for i := 0; i < tc.n; i++ {
+			rec := make([]byte, recsize)
+			binary.BigEndian.PutUint16(rec[0:2], uint16(rng.Intn(50)))
+			binary.BigEndian.PutUint32(rec[2:6], uint32(i))
+			want = append(want, rec)
+			err = s.Add(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cap(s.buf) > tc.budget {
+				t.Fatalf("%+v: the buffer has capacity %d", tc, cap(s.buf))
+			}
+		}
+		sort.SliceStable(want, func(i, j int) bool {
+			return bytes.Compare(want[i][0:keysize], want[j][0:keysize]) < 0
+		})
+
+		m, err := s.Sort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Nrec != tc.n || s.Nruns != tc.runs || s.Npasses != tc.passes {
+			t.Errorf("%+v: %d records, %d runs and %d passes", tc, s.Nrec, s.Nruns, s.Npasses)
+		}
+		if len(m.runs) > tc.fanin {
+			t.Errorf("%+v: merging %d runs", tc, len(m.runs))
+		}
+
+		for i := 0; ; i++ {
+			rec, err := m.Next()
+			if err == io.EOF {
+				if i != tc.n {
+					t.Errorf("%+v: %d records returned", tc, i)
+				}
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if i >= tc.n || !bytes.Equal(rec, want[i]) {
+				t.Fatalf("%+v: record %d is %v, expected %v", tc, i, rec, want[i])
+			}
+		}
+
+		err = m.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) > 0 {
+			t.Errorf("%+v: %d files are left after Close", tc, len(files))
+		}
+	}
+}
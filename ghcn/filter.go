@@ -0,0 +1,130 @@
+package ghcn
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// StationFilter selects stations by country, location, or period of
+// record.  The zero value selects all stations.
+type StationFilter struct {
+
+	// FIPS country codes of the stations to keep, all countries
+	// are kept if empty
+	Countries []string
+
+	// If HasBox is true, only stations inside the bounding box
+	// are kept
+	HasBox                         bool
+	MinLat, MinLon, MaxLat, MaxLon float64
+
+	// If FirstYear and LastYear are not zero, only stations whose
+	// period of record for the element covers FirstYear..LastYear
+	// are kept
+	FirstYear, LastYear int
+
+	// The station metadata, needed for the bounding box and period
+	// of record filters
+	Stations map[string]*Station
+}
+
+// NeedsMetadata returns true if the filter cannot be applied using
+// only the station id.
+func (f *StationFilter) NeedsMetadata() bool {
+	return f.HasBox || f.FirstYear != 0 || f.LastYear != 0
+}
+
+// Keep returns true if the data for the given element at the given
+// station should be used.  If element is empty, the period of record
+// filter is satisfied by any element.
+func (f *StationFilter) Keep(id, element string) bool {
+
+	if len(f.Countries) > 0 {
+		ok := false
+		for _, c := range f.Countries {
+			if strings.HasPrefix(id, c) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if !f.NeedsMetadata() {
+		return true
+	}
+
+	st, ok := f.Stations[id]
+	if !ok {
+		return false
+	}
+
+	if f.HasBox {
+		if st.Latitude < f.MinLat || st.Latitude > f.MaxLat {
+			return false
+		}
+		if st.Longitude < f.MinLon || st.Longitude > f.MaxLon {
+			return false
+		}
+	}
+
+	if f.FirstYear != 0 || f.LastYear != 0 {
+		covers := func(inv [2]int) bool {
+			return inv[0] <= f.FirstYear && inv[1] >= f.LastYear
+		}
+		if element != "" {
+			inv, ok := st.Inventory[element]
+			return ok && covers(inv)
+		}
+		for _, inv := range st.Inventory {
+			if covers(inv) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// String describes the filter settings, not including the station
+// metadata.
+func (f *StationFilter) String() string {
+	return fmt.Sprintf("countries=%s box=%v:%g,%g,%g,%g coverage=%d-%d",
+		strings.Join(f.Countries, ","), f.HasBox, f.MinLat, f.MinLon, f.MaxLat, f.MaxLon,
+		f.FirstYear, f.LastYear)
+}
+
+// RegisterFlags defines the -country, -bbox and -coverage command line
+// flags that can be used to configure the filter.
+func (f *StationFilter) RegisterFlags(fs *flag.FlagSet) {
+
+	fs.Func("country", "Comma separated FIPS country codes of stations to use",
+		func(s string) error {
+			f.Countries = strings.Split(s, ",")
+			return nil
+		})
+
+	fs.Func("bbox", "Bounding box minlat,minlon,maxlat,maxlon of stations to use",
+		func(s string) error {
+			_, err := fmt.Sscanf(s, "%g,%g,%g,%g", &f.MinLat, &f.MinLon,
+				&f.MaxLat, &f.MaxLon)
+			if err != nil {
+				return fmt.Errorf("bbox %q: %v", s, err)
+			}
+			f.HasBox = true
+			return nil
+		})
+
+	fs.Func("coverage", "Use only stations with data covering the years first-last",
+		func(s string) error {
+			_, err := fmt.Sscanf(s, "%d-%d", &f.FirstYear, &f.LastYear)
+			if err != nil {
+				return fmt.Errorf("coverage %q: %v", s, err)
+			}
+			return nil
+		})
+}
@@ -0,0 +1,82 @@
+package ghcn
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestStationFilter(t *testing.T) {
+
+	stations, err := ReadStations(strings.NewReader(testStations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReadInventory(strings.NewReader(testInventory), stations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stations kept by each filter, for the elements TMAX, SNOW
+	// and any element
+	for _, tc := range []struct {
+		args []string
+		keep map[string]string
+	}{
+		{
+			args: nil,
+			keep: map[string]string{"TMAX": "USW CA0 ASN USC", "SNOW": "USW CA0 ASN USC", "": "USW CA0 ASN USC"},
+		},
+		{
+			args: []string{"-country", "US,AS"},
+			keep: map[string]string{"TMAX": "USW ASN USC", "": "USW ASN USC"},
+		},
+		{
+			// North America, the stations that are not in the
+			// station file are not kept.
+			args: []string{"-bbox", "10,-130,70,-50"},
+			keep: map[string]string{"TMAX": "USW CA0", "": "USW CA0"},
+		},
+		{
+			// The edges of the box are inside.
+			args: []string{"-bbox", "40.7789,-80,43.6667,-73.9692"},
+			keep: map[string]string{"TMAX": "USW CA0"},
+		},
+		{
+			args: []string{"-bbox", "40.78,-80,43.6,-73.9692"},
+			keep: map[string]string{"TMAX": ""},
+		},
+		{
+			args: []string{"-coverage", "1860-2016"},
+			keep: map[string]string{"TMAX": "CA0", "SNOW": "", "PRCP": "", "": "CA0"},
+		},
+		{
+			args: []string{"-coverage", "1970-2017"},
+			keep: map[string]string{"TMAX": "USW CA0", "SNOW": "CA0", "TMIN": "", "": "USW CA0"},
+		},
+		{
+			args: []string{"-country", "CA", "-coverage", "1850-2017", "-bbox", "-90,-180,90,180"},
+			keep: map[string]string{"TMAX": "CA0", "SNOW": "", "": "CA0"},
+		},
+	} {
+		f := StationFilter{Stations: stations}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f.RegisterFlags(fs)
+		err := fs.Parse(tc.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for element, want := range tc.keep {
+			var keep []string
+			for _, id := range []string{"USW00094728", "CA006158355", "ASN00086071", "USC00305801"} {
+				if f.Keep(id, element) {
+					keep = append(keep, id[0:3])
+				}
+			}
+			if got := strings.Join(keep, " "); got != want {
+				t.Errorf("%v: the stations kept for %q are %q, expected %q", tc.args, element, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package ghcn
+
+import "encoding/binary"
+
+// This file contains a minimal FlatBuffers builder, sufficient for
+// writing the metadata of Arrow IPC files (see arrow.go).  As in the
+// reference implementation, the buffer is built from back to front,
+// so that all references point forward.  Positions are given as the
+// distance from the end of the buffer, which does not change as more
+// data are prepended.
+//
+// See https://google.github.io/flatbuffers/flatbuffers_internals.html
+
+type fbBuilder struct {
+	buf []byte // The end of the buffer under construction
+}
+
+// fbField is one field of a table, either a scalar of the given size
+// in bytes, or (if size is zero) a reference to an object that has
+// already been built.
+type fbField struct {
+	slot int    // The position of the field in the schema
+	size int    // The size of a scalar, or 0 for references
+	val  uint64 // The scalar value
+	ref  int    // The position of the referenced object
+}
+
+func fbScalar(slot, size int, val uint64) fbField {
+	return fbField{slot: slot, size: size, val: val}
+}
+
+func fbRef(slot, ref int) fbField {
+	return fbField{slot: slot, ref: ref}
+}
+
+// pos returns the current position, i.e. the position of the most
+// recently built object.
+func (b *fbBuilder) pos() int {
+	return len(b.buf)
+}
+
+func (b *fbBuilder) prepend(p []byte) {
+	nb := make([]byte, len(p)+len(b.buf))
+	copy(nb, p)
+	copy(nb[len(p):], b.buf)
+	b.buf = nb
+}
+
+// align pads the buffer so that the position will be a multiple of
+// size after n more bytes are prepended.
+func (b *fbBuilder) align(size, n int) {
+	if r := (len(b.buf) + n) % size; r != 0 {
+		b.prepend(make([]byte, size-r))
+	}
+}
+
+func (b *fbBuilder) uint32(x uint32) {
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], x)
+	b.prepend(p[:])
+}
+
+// uoffset prepends a reference to the object at position ref.
+func (b *fbBuilder) uoffset(ref int) {
+	b.align(4, 4)
+	b.uint32(uint32(b.pos() + 4 - ref))
+}
+
+// string builds a null terminated string.
+func (b *fbBuilder) string(s string) int {
+	b.align(4, len(s)+1)
+	b.prepend(append([]byte(s), 0))
+	b.uint32(uint32(len(s)))
+	return b.pos()
+}
+
+// structs builds a vector of n structs, whose contents are in data.
+// Structs containing 64 bit values must be aligned to 8 bytes.
+func (b *fbBuilder) structs(data []byte, n, align int) int {
+	b.align(align, len(data))
+	b.prepend(data)
+	b.align(4, 4)
+	b.uint32(uint32(n))
+	return b.pos()
+}
+
+// refs builds a vector of references to objects that have already
+// been built.
+func (b *fbBuilder) refs(refs []int) int {
+	b.align(4, 4*len(refs))
+	for i := len(refs) - 1; i >= 0; i-- {
+		b.uoffset(refs[i])
+	}
+	b.uint32(uint32(len(refs)))
+	return b.pos()
+}
+
+// table builds a table containing the given fields, followed by its
+// vtable.
+func (b *fbBuilder) table(fields ...fbField) int {
+
+	start := b.pos()
+	var nslot int
+	offs := make(map[int]int)
+	for _, f := range fields {
+		if f.size == 0 {
+			b.uoffset(f.ref)
+		} else {
+			var p [8]byte
+			binary.LittleEndian.PutUint64(p[:], f.val)
+			b.align(f.size, f.size)
+			b.prepend(p[0:f.size])
+		}
+		offs[f.slot] = b.pos()
+		if f.slot >= nslot {
+			nslot = f.slot + 1
+		}
+	}
+
+	// The table starts with the offset to its vtable, filled in
+	// below.
+	b.align(4, 4)
+	b.uint32(0)
+	tab := b.pos()
+
+	vt := make([]byte, 4+2*nslot)
+	binary.LittleEndian.PutUint16(vt[0:2], uint16(len(vt)))
+	binary.LittleEndian.PutUint16(vt[2:4], uint16(tab-start))
+	for slot, p := range offs {
+		binary.LittleEndian.PutUint16(vt[4+2*slot:], uint16(tab-p))
+	}
+	b.align(2, len(vt))
+	b.prepend(vt)
+
+	// The vtable is found by subtracting this value from the
+	// location of the table.
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-tab:], uint32(b.pos()-tab))
+
+	return tab
+}
+
+// finish adds the reference to the root table and returns the
+// buffer, whose length is a multiple of 8.
+func (b *fbBuilder) finish(root int) []byte {
+	b.align(8, 4)
+	b.uint32(uint32(b.pos() + 4 - root))
+	return b.buf
+}
@@ -0,0 +1,147 @@
+package ghcn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// ManifestFile is the name of the file in the top level directory of
+// a columnized store that lists the input files used to build it.
+const ManifestFile = "manifest.json"
+
+// Manifest records the input files that were used to build a
+// columnized store, and the partitions that each file contributed
+// to, so that the store can be updated when only some of the input
+// files change.
+type Manifest struct {
+
+	// Describes the settings used to build the store.  A store
+	// built with other settings cannot be updated incrementally.
+	Config string
+
+	// The input files, by file name
+	Files map[string]*InputFile
+}
+
+// InputFile describes one input file of a columnized store.
+type InputFile struct {
+	Size     int64
+	ModTime  time.Time
+	Hash     string   // The SHA-256 hash of the file contents in hex, empty if it could not be read
+	Stations []string // The stations with data in the store
+	Years    []int    // The years with data in the store
+	Parts    []string // The partitions with data in the store
+}
+
+// NewManifest returns an empty manifest for the given settings.
+func NewManifest(config string) *Manifest {
+	return &Manifest{Config: config, Files: make(map[string]*InputFile)}
+}
+
+// ReadManifest reads the manifest of the store in directory dir.  If
+// there is no manifest, nil is returned without an error.
+func ReadManifest(dir string) (*Manifest, error) {
+
+	b, err := ioutil.ReadFile(path.Join(dir, ManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := new(Manifest)
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ManifestFile, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]*InputFile)
+	}
+
+	return m, nil
+}
+
+// Write writes the manifest to the store in directory dir.  The lists
+// in each file entry are sorted so that the output is reproducible.
+func (m *Manifest) Write(dir string) error {
+
+	for _, f := range m.Files {
+		sort.Strings(f.Stations)
+		sort.Ints(f.Years)
+		sort.Strings(f.Parts)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so that an
+	// interrupted write does not leave a truncated manifest.
+	fname := path.Join(dir, ManifestFile)
+	err = ioutil.WriteFile(fname+".tmp", append(b, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fname+".tmp", fname)
+}
+
+// HashFile returns the SHA-256 hash of the contents of a file, in hex.
+func HashFile(fname string) (string, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, fid)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check compares the file fname, named name in the manifest, to its
+// manifest entry.  If the size and modification time match, the file
+// is assumed to be unchanged and the contents are not read.
+// Otherwise the hash of the contents is compared.  The returned entry
+// describes the current file, with the contributions from the old
+// entry if the file is unchanged, and none otherwise.  A file whose
+// entry has no hash is always changed.
+func (m *Manifest) Check(name, fname string, fi os.FileInfo) (bool, *InputFile, error) {
+
+	cur := &InputFile{Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+
+	old, ok := m.Files[name]
+	if ok && old.Hash != "" && old.Size == cur.Size && old.ModTime.Equal(cur.ModTime) {
+		cur.Hash = old.Hash
+	} else {
+		var err error
+		cur.Hash, err = HashFile(fname)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	if !ok || old.Hash != cur.Hash {
+		return false, cur, nil
+	}
+
+	cur.Stations = old.Stations
+	cur.Years = old.Years
+	cur.Parts = old.Parts
+
+	return true, cur, nil
+}
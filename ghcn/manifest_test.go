@@ -0,0 +1,150 @@
+package ghcn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// There is no manifest in a new store.
+	m, err := ReadManifest(dir)
+	if err != nil || m != nil {
+		t.Fatalf("reading a missing manifest gives %v, %v", m, err)
+	}
+
+	m = NewManifest("partitioning=year")
+	m.Files["a.dly"] = &InputFile{Size: 100, ModTime: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		Hash: "abc", Stations: []string{"USW00094728", "CA006158355"}, Years: []int{1991, 1990},
+		Parts: []string{"1991", "1990"}}
+	m.Files["b.dly"] = &InputFile{Size: 0, ModTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err = m.Write(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("read %+v, expected %+v", got, m)
+	}
+	if f := got.Files["a.dly"]; f.Years[0] != 1990 || f.Stations[0] != "CA006158355" {
+		t.Errorf("the lists of an entry are not sorted: %+v", f)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("the temporary file is left")
+	}
+
+	// A manifest that cannot be parsed is an error.
+	err = ioutil.WriteFile(filepath.Join(dir, ManifestFile), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(dir); err == nil {
+		t.Errorf("no error for a truncated manifest")
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "a.dly")
+	write := func(data string, mtime time.Time) os.FileInfo {
+		err := ioutil.WriteFile(fname, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(fname, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+
+	t0 := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	fi := write("abc", t0)
+	hash, err := HashFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &InputFile{Size: 3, ModTime: t0, Hash: hash, Stations: []string{"USW00094728"},
+		Years: []int{1990}, Parts: []string{"1990"}}
+
+	for _, tc := range []struct {
+		name      string
+		data      string
+		mtime     time.Time
+		hash      string // The hash in the manifest entry
+		missing   bool   // Whether the file has no manifest entry
+		unchanged bool
+	}{
+		{name: "unchanged", data: "abc", mtime: t0, hash: hash, unchanged: true},
+		{name: "touched", data: "abc", mtime: t1, hash: hash, unchanged: true},
+		{name: "changed", data: "abd", mtime: t1, hash: hash},
+		{name: "no hash", data: "abc", mtime: t0},
+		{name: "new", data: "abc", mtime: t0, hash: hash, missing: true},
+	} {
+		fi = write(tc.data, tc.mtime)
+		m := NewManifest("")
+		if !tc.missing {
+			e := *old
+			e.Hash = tc.hash
+			m.Files["a.dly"] = &e
+		}
+
+		unchanged, cur, err := m.Check("a.dly", fname, fi)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if unchanged != tc.unchanged {
+			t.Errorf("%s: unchanged is %v", tc.name, unchanged)
+		}
+		want, err := HashFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur.Hash != want || cur.Size != fi.Size() || !cur.ModTime.Equal(tc.mtime) {
+			t.Errorf("%s: the entry is %+v", tc.name, cur)
+		}
+		if unchanged != (cur.Parts != nil) {
+			t.Errorf("%s: the entry has the partitions %v", tc.name, cur.Parts)
+		}
+	}
+
+	// A file whose size and time are unchanged is not read, so the
+	// hash in the manifest is kept.
+	m := NewManifest("")
+	e := *old
+	e.Hash = "stale"
+	m.Files["a.dly"] = &e
+	fi = write("abc", t0)
+	unchanged, cur, err := m.Check("a.dly", fname, fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unchanged || cur.Hash != "stale" {
+		t.Errorf("the file was read: %v, %+v", unchanged, cur)
+	}
+}
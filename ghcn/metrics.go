@@ -0,0 +1,134 @@
+package ghcn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// MetricsFile is the name of the file in the top level directory of a
+// columnized store that summarizes the run that built it.
+const MetricsFile = "metrics.json"
+
+// Metrics summarizes one run of a pipeline: the time spent in each
+// phase, the amount of data read, the number of records for each year
+// and the problems found in the data files.  The counts cover the data
+// read during the run, which may be only part of the data if the run
+// updated earlier output.  Metrics can be used by several goroutines
+// at the same time.
+type Metrics struct {
+	Program string
+	Start   time.Time
+	Seconds float64 // The duration of the run
+	Phases  []PhaseTime
+
+	Files   int64 // The number of data files read
+	Lines   int64 // The number of lines read
+	Bytes   int64 // The number of bytes read, before decompression
+	Records int64 // The number of records produced
+
+	// The number of records for each year
+	Years map[int]int64
+
+	// The number of malformed lines, and the number of files that
+	// could not be read
+	RejectedLines int
+	BadFiles      int
+
+	// Other values describing the run, by name
+	Extra map[string]interface{} `json:",omitempty"`
+
+	mu sync.Mutex
+
+	// The start of the current phase, if running is true
+	phase   time.Time
+	running bool
+}
+
+// PhaseTime is the duration of one phase of a run.
+type PhaseTime struct {
+	Name    string
+	Seconds float64
+}
+
+// NewMetrics returns the Metrics for a run of the given program,
+// which starts now.
+func NewMetrics(program string) *Metrics {
+	return &Metrics{Program: program, Start: time.Now(), Years: make(map[int]int64)}
+}
+
+// Phase ends the current phase, if any, and starts the phase with the
+// given name.
+func (m *Metrics) Phase(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endPhase()
+	m.Phases = append(m.Phases, PhaseTime{Name: name})
+	m.phase = time.Now()
+	m.running = true
+}
+
+func (m *Metrics) endPhase() {
+	if m.running {
+		m.Phases[len(m.Phases)-1].Seconds = time.Since(m.phase).Seconds()
+		m.running = false
+	}
+}
+
+// AddYears adds counts of records by year.
+func (m *Metrics) AddYears(years map[int]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for y, n := range years {
+		m.Years[y] += n
+	}
+}
+
+// Set records another value describing the run.
+func (m *Metrics) Set(name string, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Extra == nil {
+		m.Extra = make(map[string]interface{})
+	}
+	m.Extra[name] = value
+}
+
+// Finish ends the current phase and the run, and takes the counts from
+// the progress p and the report r.  Either may be nil.
+func (m *Metrics) Finish(p *Progress, r *Report) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.endPhase()
+	m.Seconds = time.Since(m.Start).Seconds()
+
+	if p != nil {
+		m.Files, m.Lines, m.Records, m.Bytes = p.Counts()
+	}
+	if r != nil {
+		_, m.RejectedLines, m.BadFiles = r.Totals()
+	}
+}
+
+// Write writes the metrics as JSON to the file fname, replacing it
+// atomically.
+func (m *Metrics) Write(fname string) error {
+
+	m.mu.Lock()
+	b, err := json.MarshalIndent(m, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(fname+".tmp", append(b, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fname+".tmp", fname)
+}
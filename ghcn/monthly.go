@@ -0,0 +1,498 @@
+package ghcn
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Month is the summary of the daily values of one element for one
+// station month.  All values are in the reporting units of the
+// element (see Element).  Statistics that cannot be computed (e.g.
+// because there are no valid days) are NaN.
+type Month struct {
+	Id       string  // The station id
+	Element  string  // The data value type (e.g. TMAX or PRCP)
+	Year     int     // The year of the data point
+	Month    int     // The month of the data point (1..12)
+	Nvalid   int     // The number of valid values in the summary
+	Value    float64 // The monthly value (mean, total or max)
+	Min      float64 // The smallest daily value
+	Max      float64 // The largest daily value
+	SD       float64 // The standard deviation of the daily values
+	Median   float64 // The median of the daily values
+	Nabove   int     // The number of days above the upper threshold (-1 if no threshold)
+	Nbelow   int     // The number of days below the lower threshold (-1 if no threshold)
+	Complete bool    // True if the month satisfies the completeness rule
+	Anomaly  float64 // Difference between Value and the baseline, if computed
+}
+
+// MonthHeader is the CSV header for the fields written by Month.CSV.
+const MonthHeader = "Id,Element,Year,Month,Nvalid,Value,Min,Max,SD,Median,Nabove,Nbelow,Complete"
+
+// FormatValue formats a floating point value for the CSV output files.
+// NaN values are written as empty fields.
+func FormatValue(x float64) string {
+	if math.IsNaN(x) {
+		return ""
+	}
+	return strconv.FormatFloat(x, 'f', 3, 64)
+}
+
+// formatCount formats a count, with negative values (meaning that the
+// count was not computed) written as empty fields.
+func formatCount(n int) string {
+	if n < 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// CSV returns the fields of the summary in the order given by
+// MonthHeader, formatted as comma separated values.  The Anomaly field
+// is not included.
+func (m *Month) CSV() string {
+
+	complete := 0
+	if m.Complete {
+		complete = 1
+	}
+
+	return fmt.Sprintf("%s,%s,%d,%d,%d,%s,%s,%s,%s,%s,%s,%s,%d", m.Id,
+		m.Element, m.Year, m.Month, m.Nvalid, FormatValue(m.Value),
+		FormatValue(m.Min), FormatValue(m.Max), FormatValue(m.SD),
+		FormatValue(m.Median), formatCount(m.Nabove),
+		formatCount(m.Nbelow), complete)
+}
+
+// DaysIn returns the number of days in the given month.
+func DaysIn(year, month int) int {
+	return time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// Completeness decides whether a station month has enough valid days
+// to be summarized.  valid contains the validity of each day of the
+// month (with days past the end of the month already removed).
+type Completeness interface {
+	Complete(valid []bool) bool
+}
+
+// WMORule is the WMO "3/5 rule": a month is complete if no more than
+// MaxMissing days are missing, and no more than MaxConsecutive
+// consecutive days are missing.
+type WMORule struct {
+	MaxMissing     int
+	MaxConsecutive int
+}
+
+// Complete implements the Completeness interface.
+func (r WMORule) Complete(valid []bool) bool {
+
+	nmiss, run := 0, 0
+	for _, v := range valid {
+		if v {
+			run = 0
+			continue
+		}
+		nmiss++
+		run++
+		if nmiss > r.MaxMissing || run > r.MaxConsecutive {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MinDaysRule treats a month as complete if at least MinDays days are
+// valid.
+type MinDaysRule struct {
+	MinDays int
+}
+
+// Complete implements the Completeness interface.
+func (r MinDaysRule) Complete(valid []bool) bool {
+
+	n := 0
+	for _, v := range valid {
+		if v {
+			n++
+		}
+	}
+
+	return n >= r.MinDays
+}
+
+// ParseCompleteness returns the completeness rule described by s,
+// which is one of "wmo" (the WMO 3/5 rule), "min:N" (at least N valid
+// days) or "any" (at least one valid day).
+func ParseCompleteness(s string) (Completeness, error) {
+
+	switch {
+	case s == "wmo":
+		return WMORule{MaxMissing: 10, MaxConsecutive: 4}, nil
+	case s == "any":
+		return MinDaysRule{MinDays: 1}, nil
+	case strings.HasPrefix(s, "min:"):
+		n, err := strconv.Atoi(s[4:])
+		if err != nil {
+			return nil, fmt.Errorf("completeness rule %q: %v", s, err)
+		}
+		return MinDaysRule{MinDays: n}, nil
+	}
+
+	return nil, fmt.Errorf("unknown completeness rule %q", s)
+}
+
+// Summarizer converts raw data records into monthly summaries.
+type Summarizer struct {
+
+	// Decides which months are complete
+	Rule Completeness
+
+	// If true, Summarize returns nil for incomplete months,
+	// otherwise incomplete months are returned with Complete set
+	// to false
+	Drop bool
+
+	// Thresholds, in reporting units, by element type.  Nabove
+	// counts the days with values strictly greater than the Above
+	// threshold, Nbelow counts the days with values strictly less
+	// than the Below threshold.
+	Above map[string]float64
+	Below map[string]float64
+}
+
+// NewSummarizer returns a Summarizer that uses the WMO 3/5 rule and
+// flags (rather than drops) incomplete months.  The default thresholds
+// count summer days (TMAX above 25 C) and frost days (TMIN below 0 C).
+func NewSummarizer() *Summarizer {
+	return &Summarizer{
+		Rule:  WMORule{MaxMissing: 10, MaxConsecutive: 4},
+		Above: map[string]float64{"TMAX": 25},
+		Below: map[string]float64{"TMIN": 0},
+	}
+}
+
+// thresholdFlag parses thresholds of the form "TMAX=30,PRCP=1".
+func thresholdFlag(m map[string]float64) func(string) error {
+	return func(s string) error {
+		for k := range m {
+			delete(m, k)
+		}
+		for _, kv := range strings.Split(s, ",") {
+			if kv == "" {
+				continue
+			}
+			f := strings.SplitN(kv, "=", 2)
+			if len(f) != 2 {
+				return fmt.Errorf("threshold %q is not of the form ELEMENT=value", kv)
+			}
+			v, err := strconv.ParseFloat(f[1], 64)
+			if err != nil {
+				return fmt.Errorf("threshold %q: %v", kv, err)
+			}
+			m[f[0]] = v
+		}
+		return nil
+	}
+}
+
+// RegisterFlags defines the -complete, -drop-incomplete, -above and
+// -below command line flags that can be used to configure the
+// summarizer.
+func (s *Summarizer) RegisterFlags(fs *flag.FlagSet) {
+
+	fs.Func("complete", "Completeness rule for months: wmo, any, or min:N (default wmo)",
+		func(v string) error {
+			r, err := ParseCompleteness(v)
+			if err != nil {
+				return err
+			}
+			s.Rule = r
+			return nil
+		})
+
+	fs.BoolVar(&s.Drop, "drop-incomplete", s.Drop,
+		"Drop months that fail the completeness rule instead of flagging them")
+	fs.Func("above", "Upper thresholds for counting days, e.g. TMAX=30,PRCP=1",
+		thresholdFlag(s.Above))
+	fs.Func("below", "Lower thresholds for counting days, e.g. TMIN=0",
+		thresholdFlag(s.Below))
+}
+
+// Summarize converts a raw data record into a monthly summary
+// record.  Only days that are valid according to the parsing policy
+// are used.  If the month is incomplete and s.Drop is true, or if the
+// element type is not in Elements (so that there is no rule for
+// summarizing it), nil is returned.
+func (s *Summarizer) Summarize(rec *Record) *Month {
+
+	el, ok := Elements[rec.Element]
+	if !ok {
+		return nil
+	}
+
+	// The record always has 31 slots, slots past the end of the
+	// month are not days and do not count as missing.  Slots that
+	// were not present in the line are never valid.
+	valid := rec.IsValid[:DaysIn(rec.Year, rec.Month)]
+
+	var raw, x []float64
+	for j, v := range valid {
+		if v {
+			raw = append(raw, rec.Values[j])
+			x = append(x, rec.Values[j]*el.Scale)
+		}
+	}
+
+	m := &Month{
+		Id:       rec.Id,
+		Element:  rec.Element,
+		Year:     rec.Year,
+		Month:    rec.Month,
+		Nvalid:   len(x),
+		Complete: len(x) > 0 && s.Rule.Complete(valid),
+		Anomaly:  math.NaN(),
+	}
+
+	if !m.Complete && s.Drop {
+		return nil
+	}
+
+	// The element rule takes care of both the aggregation and the
+	// conversion from raw units (e.g. 0.1 degree C) to the
+	// reporting units (e.g. degrees C).
+	m.Value = el.Aggregate(raw)
+	m.Min, m.Max, m.SD, m.Median = describe(x)
+
+	m.Nabove, m.Nbelow = -1, -1
+	if t, ok := s.Above[rec.Element]; ok {
+		m.Nabove = 0
+		for _, v := range x {
+			if v > t {
+				m.Nabove++
+			}
+		}
+	}
+	if t, ok := s.Below[rec.Element]; ok {
+		m.Nbelow = 0
+		for _, v := range x {
+			if v < t {
+				m.Nbelow++
+			}
+		}
+	}
+
+	return m
+}
+
+// describe returns the minimum, maximum, standard deviation and median
+// of x.  NaN is returned for statistics that cannot be computed from
+// the number of values in x.
+func describe(x []float64) (min, max, sd, median float64) {
+
+	n := len(x)
+	if n == 0 {
+		return math.NaN(), math.NaN(), math.NaN(), math.NaN()
+	}
+
+	z := make([]float64, n)
+	copy(z, x)
+	sort.Float64s(z)
+
+	min, max = z[0], z[n-1]
+	if n%2 == 1 {
+		median = z[n/2]
+	} else {
+		median = (z[n/2-1] + z[n/2]) / 2
+	}
+
+	if n < 2 {
+		return min, max, math.NaN(), median
+	}
+
+	var mean float64
+	for _, v := range z {
+		mean += v
+	}
+	mean /= float64(n)
+
+	var ss float64
+	for _, v := range z {
+		ss += (v - mean) * (v - mean)
+	}
+	sd = math.Sqrt(ss / float64(n-1))
+
+	return min, max, sd, median
+}
+
+// MonthReader reads monthly summaries from a CSV file written by
+// gcos_monthly.go or gcos_monthly_concurrent.go.  The columns are
+// located using the header, so extra columns (e.g. the station
+// metadata) are allowed.  The Id, Element, Year and Value columns are
+// required.  If there is no Month column (e.g. in the annual tables
+// written by gcos_rollup.go), Month is set to zero.  If there is no
+// Complete column, every month with a value is treated as complete.
+// If there is no Anomaly column, Anomaly is set to NaN.  The seasonal
+// files written by gcos_rollup.go have several rows per year, one per
+// season in the Period column, Period selects one of them.
+type MonthReader struct {
+	rdr *csv.Reader
+
+	// The position of each column in the file, -1 if absent
+	id, element, year, month, nvalid, value, complete, anomaly, period int
+
+	// The line number of the last line read
+	lnum int
+
+	// True if the file contains an Anomaly column, or a Period column
+	HasAnomaly bool
+	HasPeriod  bool
+
+	// If not empty, only the rows whose Period column has this value
+	// (e.g. "DJF") are returned.  It can only be set if HasPeriod is
+	// true.
+	Period string
+}
+
+// NewMonthReader returns a MonthReader that reads from r.  The header
+// is read immediately.
+func NewMonthReader(r io.Reader) (*MonthReader, error) {
+
+	mr := &MonthReader{rdr: csv.NewReader(r)}
+	mr.rdr.ReuseRecord = true
+
+	header, err := mr.rdr.Read()
+	if err != nil {
+		return nil, err
+	}
+	mr.lnum = 1
+
+	col := make(map[string]int)
+	for i, h := range header {
+		col[h] = i
+	}
+	pos := func(name string) int {
+		if i, ok := col[name]; ok {
+			return i
+		}
+		return -1
+	}
+
+	mr.id = pos("Id")
+	mr.element = pos("Element")
+	mr.year = pos("Year")
+	mr.month = pos("Month")
+	mr.nvalid = pos("Nvalid")
+	mr.value = pos("Value")
+	mr.complete = pos("Complete")
+	mr.anomaly = pos("Anomaly")
+	mr.period = pos("Period")
+	mr.HasAnomaly = mr.anomaly != -1
+	mr.HasPeriod = mr.period != -1
+
+	for _, c := range []string{"Id", "Element", "Year", "Value"} {
+		if pos(c) == -1 {
+			return nil, fmt.Errorf("monthly file has no %s column", c)
+		}
+	}
+
+	return mr, nil
+}
+
+// parseValue parses a value written by FormatValue.
+func parseValue(s string) (float64, error) {
+	if s == "" {
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Read returns the next monthly summary, or io.EOF when there are no
+// more.  Only the identifying fields, Nvalid, Value, Complete and
+// Anomaly are filled in, the other statistics are NaN.
+func (mr *MonthReader) Read() (*Month, error) {
+
+	if mr.Period != "" && !mr.HasPeriod {
+		return nil, fmt.Errorf("monthly file has no Period column")
+	}
+
+	var rec []string
+	var err error
+	for {
+		rec, err = mr.rdr.Read()
+		if err != nil {
+			return nil, err
+		}
+		mr.lnum++
+		if mr.Period == "" || rec[mr.period] == mr.Period {
+			break
+		}
+	}
+
+	nan := math.NaN()
+	m := &Month{Id: rec[mr.id], Element: rec[mr.element], Min: nan, Max: nan,
+		SD: nan, Median: nan, Nabove: -1, Nbelow: -1, Anomaly: nan}
+
+	m.Year, err = strconv.Atoi(rec[mr.year])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", mr.lnum, err)
+	}
+
+	if mr.month != -1 {
+		m.Month, err = strconv.Atoi(rec[mr.month])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", mr.lnum, err)
+		}
+	}
+
+	if mr.nvalid != -1 {
+		m.Nvalid, err = strconv.Atoi(rec[mr.nvalid])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", mr.lnum, err)
+		}
+	}
+
+	m.Value, err = parseValue(rec[mr.value])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", mr.lnum, err)
+	}
+
+	if mr.complete != -1 {
+		m.Complete = rec[mr.complete] == "1"
+	} else {
+		m.Complete = !math.IsNaN(m.Value)
+	}
+
+	if mr.anomaly != -1 {
+		m.Anomaly, err = parseValue(rec[mr.anomaly])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", mr.lnum, err)
+		}
+	}
+
+	return m, nil
+}
+
+// SortMonths sorts monthly summaries by station, year and month.  The
+// sort is stable, so the summaries for different elements in the same
+// station month stay in their original order.
+func SortMonths(mrecs []*Month) {
+	sort.SliceStable(mrecs, func(i, j int) bool {
+		a, b := mrecs[i], mrecs[j]
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		return a.Month < b.Month
+	})
+}
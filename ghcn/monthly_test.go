@@ -0,0 +1,347 @@
+package ghcn
+
+import (
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// days returns the validity of n days, with the given days (counted
+// from 0) missing.
+func days(n int, missing ...int) []bool {
+	valid := make([]bool, n)
+	for i := range valid {
+		valid[i] = true
+	}
+	for _, i := range missing {
+		valid[i] = false
+	}
+	return valid
+}
+
+// span returns the integers lo, lo+step, ... that are less than hi.
+func span(lo, hi, step int) []int {
+	var x []int
+	for i := lo; i < hi; i += step {
+		x = append(x, i)
+	}
+	return x
+}
+
+func TestCompleteness(t *testing.T) {
+
+	wmo := WMORule{MaxMissing: 10, MaxConsecutive: 4}
+
+	for _, tc := range []struct {
+		name     string
+		rule     Completeness
+		valid    []bool
+		complete bool
+	}{
+		{"no days missing", wmo, days(31), true},
+		{"10 days missing", wmo, days(31, span(0, 20, 2)...), true},
+		{"11 days missing", wmo, days(31, span(0, 22, 2)...), false},
+		{"4 consecutive days missing", wmo, days(31, span(10, 14, 1)...), true},
+		{"5 consecutive days missing", wmo, days(31, span(10, 15, 1)...), false},
+		{"5 consecutive days missing at the end", wmo, days(28, span(23, 28, 1)...), false},
+		{"10 days missing in runs of 4", wmo, days(30, 0, 1, 2, 3, 10, 11, 12, 13, 28, 29), true},
+		{"all days missing", wmo, days(30, span(0, 30, 1)...), false},
+		{"min:20 with 20 days", MinDaysRule{MinDays: 20}, days(30, span(0, 10, 1)...), true},
+		{"min:20 with 19 days", MinDaysRule{MinDays: 20}, days(30, span(0, 11, 1)...), false},
+		{"any with one day", MinDaysRule{MinDays: 1}, days(30, span(1, 30, 1)...), true},
+		{"any with no days", MinDaysRule{MinDays: 1}, days(30, span(0, 30, 1)...), false},
+	} {
+		if c := tc.rule.Complete(tc.valid); c != tc.complete {
+			t.Errorf("%s: complete is %v, expected %v", tc.name, c, tc.complete)
+		}
+	}
+}
+
+func TestParseCompleteness(t *testing.T) {
+
+	for _, tc := range []struct {
+		s    string
+		rule Completeness
+	}{
+		{"wmo", WMORule{MaxMissing: 10, MaxConsecutive: 4}},
+		{"any", MinDaysRule{MinDays: 1}},
+		{"min:20", MinDaysRule{MinDays: 20}},
+	} {
+		rule, err := ParseCompleteness(tc.s)
+		if err != nil {
+			t.Errorf("%s: %v", tc.s, err)
+		} else if !reflect.DeepEqual(rule, tc.rule) {
+			t.Errorf("%s: parsed as %+v, expected %+v", tc.s, rule, tc.rule)
+		}
+	}
+
+	for _, s := range []string{"", "WMO", "min:", "min:x", "max:3"} {
+		if _, err := ParseCompleteness(s); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+
+	nan := math.NaN()
+	for _, tc := range []struct {
+		x                    []float64
+		min, max, sd, median float64
+	}{
+		{nil, nan, nan, nan, nan},
+		{[]float64{3}, 3, 3, nan, 3},
+		{[]float64{4, 1, 3, 2}, 1, 4, 1.290994449, 2.5},
+		{[]float64{5, -1, 2}, -1, 5, 3, 2},
+	} {
+		x := append([]float64(nil), tc.x...)
+		min, max, sd, median := describe(x)
+		if !near(min, tc.min, 1e-9) || !near(max, tc.max, 1e-9) || !near(sd, tc.sd, 1e-9) ||
+			!near(median, tc.median, 1e-9) {
+			t.Errorf("describe(%v) is %v %v %v %v, expected %v %v %v %v", tc.x,
+				min, max, sd, median, tc.min, tc.max, tc.sd, tc.median)
+		}
+		if !reflect.DeepEqual(x, tc.x) {
+			t.Errorf("describe(%v) changed its argument to %v", tc.x, x)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+
+	// rec returns a record of station USW00094728 in which the first
+	// len(values) days have the given raw values, and the other days
+	// and the given days are missing.
+	rec := func(el string, year, month int, values []float64, missing ...int) *Record {
+		r := &Record{Id: "USW00094728", Year: year, Month: month, Element: el, NDays: MaxDays}
+		for j := range r.Values {
+			r.Values[j] = Missing
+			if j < len(values) {
+				r.Values[j] = values[j]
+				r.IsValid[j] = true
+			}
+		}
+		for _, j := range missing {
+			r.IsValid[j] = false
+		}
+		return r
+	}
+
+	// ramp returns n raw values starting at lo and increasing by step.
+	ramp := func(n int, lo, step float64) []float64 {
+		x := make([]float64, n)
+		for i := range x {
+			x[i] = lo + step*float64(i)
+		}
+		return x
+	}
+
+	for _, tc := range []struct {
+		name string
+		drop bool
+		rule Completeness
+		rec  *Record
+		csv  string // The expected summary, empty if nil is expected
+	}{
+		{
+			name: "all days",
+			rec:  rec("TMAX", 1990, 2, ramp(28, 200, 10)),
+			csv:  "USW00094728,TMAX,1990,2,28,33.500,20.000,47.000,8.226,33.500,22,,1",
+		},
+		{
+			// The slots past the end of February are not days.
+			name: "days past the end of the month",
+			rec:  rec("TMAX", 1991, 2, ramp(31, 200, 10)),
+			csv:  "USW00094728,TMAX,1991,2,28,33.500,20.000,47.000,8.226,33.500,22,,1",
+		},
+		{
+			name: "10 days missing",
+			rec:  rec("TMAX", 1990, 1, ramp(31, 100, 0), span(0, 20, 2)...),
+			csv:  "USW00094728,TMAX,1990,1,21,10.000,10.000,10.000,0.000,10.000,0,,1",
+		},
+		{
+			name: "11 days missing",
+			rec:  rec("TMAX", 1990, 1, ramp(31, 100, 0), span(0, 22, 2)...),
+			csv:  "USW00094728,TMAX,1990,1,20,10.000,10.000,10.000,0.000,10.000,0,,0",
+		},
+		{
+			name: "11 days missing, dropped",
+			drop: true,
+			rec:  rec("TMAX", 1990, 1, ramp(31, 100, 0), span(0, 22, 2)...),
+		},
+		{
+			name: "4 consecutive days missing",
+			rec:  rec("TMIN", 1990, 1, ramp(31, -50, 5), span(10, 14, 1)...),
+			csv:  "USW00094728,TMIN,1990,1,27,2.759,-5.000,10.000,4.823,3.500,,10,1",
+		},
+		{
+			name: "5 consecutive days missing",
+			rec:  rec("TMIN", 1990, 1, ramp(31, -50, 5), span(10, 15, 1)...),
+			csv:  "USW00094728,TMIN,1990,1,26,2.788,-5.000,10.000,4.916,3.750,,10,0",
+		},
+		{
+			name: "no valid days",
+			rec:  rec("TMIN", 1990, 1, nil),
+			csv:  "USW00094728,TMIN,1990,1,0,,,,,,,0,0",
+		},
+		{
+			name: "one day, total",
+			rule: MinDaysRule{MinDays: 1},
+			rec:  rec("PRCP", 1990, 4, []float64{55}),
+			csv:  "USW00094728,PRCP,1990,4,1,5.500,5.500,5.500,,5.500,,,1",
+		},
+		{
+			name: "unknown element",
+			rec:  rec("WT01", 1990, 4, ramp(30, 1, 0)),
+		},
+	} {
+		s := NewSummarizer()
+		s.Drop = tc.drop
+		if tc.rule != nil {
+			s.Rule = tc.rule
+		}
+
+		m := s.Summarize(tc.rec)
+		if m == nil {
+			if tc.csv != "" {
+				t.Errorf("%s: no summary", tc.name)
+			}
+			continue
+		}
+		if tc.csv == "" {
+			t.Errorf("%s: summary %s, expected none", tc.name, m.CSV())
+		} else if m.CSV() != tc.csv {
+			t.Errorf("%s: summary\n%s\nexpected\n%s", tc.name, m.CSV(), tc.csv)
+		}
+		if !math.IsNaN(m.Anomaly) {
+			t.Errorf("%s: anomaly %v", tc.name, m.Anomaly)
+		}
+	}
+}
+
+func TestMonthReader(t *testing.T) {
+
+	nan := math.NaN()
+	months := []*Month{
+		{Id: "USW00094728", Element: "TMAX", Year: 1990, Month: 1, Nvalid: 31, Value: 3.25,
+			Min: -1, Max: 8, SD: 2, Median: 3, Nabove: 0, Nbelow: -1, Complete: true, Anomaly: 0.5},
+		{Id: "USW00094728", Element: "TMAX", Year: 1990, Month: 2, Nvalid: 10, Value: 4,
+			Min: 1, Max: 7, SD: 1, Median: 4, Nabove: 0, Nbelow: -1, Complete: false, Anomaly: nan},
+		{Id: "CA006158355", Element: "PRCP", Year: 1991, Month: 12, Nvalid: 0, Value: nan,
+			Min: nan, Max: nan, SD: nan, Median: nan, Nabove: -1, Nbelow: -1, Anomaly: nan},
+	}
+
+	// The files written by the monthly scripts, with an anomaly
+	// column and the station metadata.
+	var b strings.Builder
+	b.WriteString(MonthHeader + ",Anomaly,Name\n")
+	for _, m := range months {
+		b.WriteString(m.CSV() + "," + FormatValue(m.Anomaly) + ",\"A, B\"\n")
+	}
+
+	mr, err := NewMonthReader(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mr.HasAnomaly {
+		t.Errorf("the anomaly column was not found")
+	}
+	for i := 0; ; i++ {
+		m, err := mr.Read()
+		if err == io.EOF {
+			if i != len(months) {
+				t.Errorf("%d summaries read, expected %d", i, len(months))
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		w := months[i]
+		if m.Id != w.Id || m.Element != w.Element || m.Year != w.Year || m.Month != w.Month ||
+			m.Nvalid != w.Nvalid || m.Complete != w.Complete || !near(m.Value, w.Value, 0) ||
+			!near(m.Anomaly, w.Anomaly, 0) {
+			t.Errorf("summary %d is %+v, expected %+v", i, m, w)
+		}
+		if !math.IsNaN(m.Min) || m.Nabove != -1 {
+			t.Errorf("summary %d has statistics that are not in the file: %+v", i, m)
+		}
+	}
+
+	// The annual files written by gcos_rollup.go have no month, and
+	// other files may have no completeness or anomaly column.
+	for _, tc := range []struct {
+		name  string
+		file  string
+		month int
+		value float64
+		valid bool
+	}{
+		{"annual", PeriodHeader + "\nUSW00094728,TMAX,1990,ANN,12,15.000,1\n", 0, 15, true},
+		{"incomplete", PeriodHeader + "\nUSW00094728,TMAX,1990,ANN,11,,0\n", 0, nan, false},
+		{"no Complete", "Id,Element,Year,Month,Value\nUSW00094728,TMAX,1990,3,2.5\n", 3, 2.5, true},
+		{"no Complete, blank", "Id,Element,Year,Month,Value\nUSW00094728,TMAX,1990,3,\n", 3, nan, false},
+	} {
+		mr, err := NewMonthReader(strings.NewReader(tc.file))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		m, err := mr.Read()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if mr.HasAnomaly || m.Month != tc.month || !near(m.Value, tc.value, 0) ||
+			m.Complete != tc.valid || !math.IsNaN(m.Anomaly) {
+			t.Errorf("%s: read %+v", tc.name, m)
+		}
+	}
+
+	if _, err := NewMonthReader(strings.NewReader("Id,Element,Value\n")); err == nil {
+		t.Errorf("no error for a file without a Year column")
+	}
+	mr, err = NewMonthReader(strings.NewReader("Id,Element,Year,Value\nUSW00094728,TMAX,1990,2.5\nUSW00094728,TMAX,x,2.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mr.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mr.Read(); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("the invalid year gives the error %v", err)
+	}
+
+	// Period selects one season of a seasonal file.
+	seasonal := PeriodHeader + "\nUSW00094728,TMAX,1990,DJF,3,1.000,1\nUSW00094728,TMAX,1990,MAM,3,2.000,1\n" +
+		"USW00094728,TMAX,1991,DJF,3,3.000,1\nUSW00094728,TMAX,1991,MAM,3,4.000,1\n"
+	mr, err = NewMonthReader(strings.NewReader(seasonal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mr.HasPeriod {
+		t.Errorf("the period column was not found")
+	}
+	mr.Period = "MAM"
+	var got []float64
+	for {
+		m, err := mr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m.Value)
+	}
+	if !reflect.DeepEqual(got, []float64{2, 4}) {
+		t.Errorf("the MAM values are %v", got)
+	}
+
+	mr, err = NewMonthReader(strings.NewReader("Id,Element,Year,Value\nUSW00094728,TMAX,1990,2.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Period = "MAM"
+	if _, err := mr.Read(); err == nil {
+		t.Errorf("no error for a period without a Period column")
+	}
+}
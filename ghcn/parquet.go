@@ -0,0 +1,1047 @@
+package ghcn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+)
+
+// This file contains a writer and a reader for Parquet files.  The
+// writer stores a Table (see arrow.go), or a sequence of tables, in
+// row groups of a given number of rows, with one column chunk per
+// column in each row group.  String columns are dictionary encoded,
+// with one dictionary page per column chunk, and the other columns
+// are plain encoded.  Each column chunk records the minimum and
+// maximum values and the number of missing values, so that query
+// engines can skip row groups.
+//
+// The reader only supports the features used by the writer, it is
+// intended for checking the files written here rather than for
+// reading Parquet files in general.
+//
+// See https://github.com/apache/parquet-format
+
+// Parquet metadata constants, from parquet.thrift.
+const (
+	pqInt32     = 1 // Type.INT32
+	pqDouble    = 5 // Type.DOUBLE
+	pqByteArray = 6 // Type.BYTE_ARRAY
+
+	pqRequired = 0 // FieldRepetitionType.REQUIRED
+	pqOptional = 1 // FieldRepetitionType.OPTIONAL
+
+	pqUTF8 = 0 // ConvertedType.UTF8
+	pqDATE = 6 // ConvertedType.DATE
+
+	pqPlain          = 0 // Encoding.PLAIN
+	pqPlainDict      = 2 // Encoding.PLAIN_DICTIONARY
+	pqRLE            = 3 // Encoding.RLE
+	pqRLEDict        = 8 // Encoding.RLE_DICTIONARY
+	pqUncompressed   = 0 // CompressionCodec.UNCOMPRESSED
+	pqGzip           = 2 // CompressionCodec.GZIP
+	pqDataPage       = 0 // PageType.DATA_PAGE
+	pqDictionaryPage = 2 // PageType.DICTIONARY_PAGE
+)
+
+var parquetMagic = []byte("PAR1")
+
+// ParquetOptions controls the layout of the Parquet files written by
+// WriteParquet.
+type ParquetOptions struct {
+
+	// The number of rows in each row group
+	RowGroupSize int
+
+	// The maximum number of values in each data page
+	PageSize int
+
+	// If true, the pages are compressed with gzip
+	Gzip bool
+}
+
+// DefaultParquetOptions returns the options used if none are given.
+func DefaultParquetOptions() *ParquetOptions {
+	return &ParquetOptions{RowGroupSize: 1 << 20, PageSize: 1 << 16, Gzip: true}
+}
+
+// pqChunk is a column chunk that has been encoded but not yet
+// written.
+type pqChunk struct {
+	data      []byte // The pages, with their headers
+	dictPage  int64  // The position of the dictionary page in data, or -1
+	dataPage  int64  // The position of the first data page in data
+	size      int64  // The uncompressed size of the pages and headers
+	encodings []int32
+	min, max  []byte
+	nulls     int64
+}
+
+// parquetType returns the physical type and converted type (-1 if
+// none) of a column.
+func parquetType(col interface{}) (int32, int32) {
+	switch col.(type) {
+	case []string:
+		return pqByteArray, pqUTF8
+	case []Date:
+		return pqInt32, pqDATE
+	case []int32:
+		return pqInt32, -1
+	default:
+		return pqDouble, -1
+	}
+}
+
+// appendPage appends a page, with its header, to the chunk.  hdr
+// writes the page type specific header, which is field id in the
+// PageHeader struct.
+func (c *pqChunk) appendPage(typ int32, id int16, body []byte, gz bool, hdr func(*thriftWriter)) error {
+
+	usize := len(body)
+	if gz {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(body)
+		err := w.Close()
+		if err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	w := new(thriftWriter)
+	w.begin()
+	w.i32(1, typ)
+	w.i32(2, int32(usize))
+	w.i32(3, int32(len(body)))
+	w.structField(id)
+	hdr(w)
+	w.end()
+	w.end()
+
+	c.data = append(c.data, w.buf...)
+	c.data = append(c.data, body...)
+	c.size += int64(len(w.buf) + usize)
+
+	return nil
+}
+
+// setStats records the minimum and maximum of the non-missing values
+// of rows lo to hi of column col.
+func (c *pqChunk) setStats(col interface{}, valid []bool, lo, hi int) {
+
+	ok := func(i int) bool {
+		return valid == nil || valid[i]
+	}
+
+	switch x := col.(type) {
+	case []string:
+		var mn, mx string
+		first := true
+		for i := lo; i < hi; i++ {
+			if !ok(i) {
+				continue
+			}
+			if first || x[i] < mn {
+				mn = x[i]
+			}
+			if first || x[i] > mx {
+				mx = x[i]
+			}
+			first = false
+		}
+		if !first {
+			c.min, c.max = []byte(mn), []byte(mx)
+		}
+	case []Date, []int32:
+		var v []int32
+		if d, isd := x.([]Date); isd {
+			v = make([]int32, hi-lo)
+			for i := range v {
+				v[i] = int32(d[lo+i])
+			}
+		} else {
+			v = x.([]int32)[lo:hi]
+		}
+		var mn, mx int32
+		first := true
+		for i, y := range v {
+			if !ok(lo + i) {
+				continue
+			}
+			if first || y < mn {
+				mn = y
+			}
+			if first || y > mx {
+				mx = y
+			}
+			first = false
+		}
+		if !first {
+			c.min = binary.LittleEndian.AppendUint32(nil, uint32(mn))
+			c.max = binary.LittleEndian.AppendUint32(nil, uint32(mx))
+		}
+	case []float64:
+		mn, mx := math.Inf(1), math.Inf(-1)
+		for i := lo; i < hi; i++ {
+			if ok(i) && !math.IsNaN(x[i]) {
+				mn = math.Min(mn, x[i])
+				mx = math.Max(mx, x[i])
+			}
+		}
+		if mn <= mx {
+			// A zero minimum must be written as -0, and a zero
+			// maximum as +0
+			if mn == 0 {
+				mn = math.Copysign(0, -1)
+			}
+			if mx == 0 {
+				mx = 0
+			}
+			c.min = binary.LittleEndian.AppendUint64(nil, math.Float64bits(mn))
+			c.max = binary.LittleEndian.AppendUint64(nil, math.Float64bits(mx))
+		}
+	}
+}
+
+// encodeChunk encodes rows lo to hi of column j of t.
+func encodeChunk(t *Table, j, lo, hi int, opt *ParquetOptions) (*pqChunk, error) {
+
+	col := t.Columns[j]
+	valid := t.Valid[j]
+	c := &pqChunk{dictPage: -1}
+	c.setStats(col, valid, lo, hi)
+
+	// Strings are replaced by their positions in a dictionary, which
+	// is stored in its own page.
+	var codes []int32
+	var width int
+	if x, ok := col.([]string); ok {
+		dict := make(map[string]int32)
+		var body []byte
+		for i := lo; i < hi; i++ {
+			if valid != nil && !valid[i] {
+				continue
+			}
+			if _, ok := dict[x[i]]; !ok {
+				dict[x[i]] = int32(len(dict))
+				body = binary.LittleEndian.AppendUint32(body, uint32(len(x[i])))
+				body = append(body, x[i]...)
+			}
+		}
+		codes = make([]int32, hi-lo)
+		for i := lo; i < hi; i++ {
+			codes[i-lo] = dict[x[i]]
+		}
+		width = 1
+		if len(dict) > 1 {
+			width = bits.Len(uint(len(dict) - 1))
+		}
+
+		c.dictPage = 0
+		n := int32(len(dict))
+		err := c.appendPage(pqDictionaryPage, 7, body, opt.Gzip, func(w *thriftWriter) {
+			w.i32(1, n)
+			w.i32(2, pqPlain)
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.encodings = []int32{pqPlain, pqRLE, pqRLEDict}
+	} else {
+		c.encodings = []int32{pqPlain, pqRLE}
+	}
+	c.dataPage = int64(len(c.data))
+
+	for p := lo; p < hi; p += opt.PageSize {
+		q := p + opt.PageSize
+		if q > hi {
+			q = hi
+		}
+
+		// The definition levels of optional columns are 0 for
+		// missing values and 1 otherwise.
+		var body []byte
+		if valid != nil {
+			lev := make([]int32, q-p)
+			for i := p; i < q; i++ {
+				if valid[i] {
+					lev[i-p] = 1
+				} else {
+					c.nulls++
+				}
+			}
+			enc := rleEncode(nil, lev, 1)
+			body = binary.LittleEndian.AppendUint32(body, uint32(len(enc)))
+			body = append(body, enc...)
+		}
+
+		var buf [8]byte
+		enc := int32(pqPlain)
+		switch x := col.(type) {
+		case []string:
+			enc = pqRLEDict
+			var pc []int32
+			for i := p; i < q; i++ {
+				if valid == nil || valid[i] {
+					pc = append(pc, codes[i-lo])
+				}
+			}
+			body = append(body, byte(width))
+			body = rleEncode(body, pc, width)
+		case []Date:
+			for i := p; i < q; i++ {
+				if valid == nil || valid[i] {
+					binary.LittleEndian.PutUint32(buf[0:4], uint32(x[i]))
+					body = append(body, buf[0:4]...)
+				}
+			}
+		case []int32:
+			for i := p; i < q; i++ {
+				if valid == nil || valid[i] {
+					binary.LittleEndian.PutUint32(buf[0:4], uint32(x[i]))
+					body = append(body, buf[0:4]...)
+				}
+			}
+		case []float64:
+			for i := p; i < q; i++ {
+				if valid == nil || valid[i] {
+					binary.LittleEndian.PutUint64(buf[:], math.Float64bits(x[i]))
+					body = append(body, buf[:]...)
+				}
+			}
+		}
+
+		n := int32(q - p)
+		err := c.appendPage(pqDataPage, 5, body, opt.Gzip, func(w *thriftWriter) {
+			w.i32(1, n)
+			w.i32(2, enc)
+			w.i32(3, pqRLE)
+			w.i32(4, pqRLE)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// writeStats writes the Statistics struct of a column chunk.
+func (c *pqChunk) writeStats(w *thriftWriter, id int16) {
+	w.structField(id)
+	w.i64(3, c.nulls)
+	if c.min != nil {
+		w.binary(5, c.max)
+		w.binary(6, c.min)
+	}
+	w.end()
+}
+
+// parquetSchema writes the list of SchemaElements describing t.
+func parquetSchema(w *thriftWriter, t *Table) {
+
+	w.list(2, tStruct, len(t.Columns)+1)
+
+	w.begin()
+	w.binary(4, []byte("schema"))
+	w.i32(5, int32(len(t.Columns)))
+	w.end()
+
+	for j, col := range t.Columns {
+		typ, conv := parquetType(col)
+		rep := int32(pqRequired)
+		if t.Valid[j] != nil {
+			rep = pqOptional
+		}
+		w.begin()
+		w.i32(1, typ)
+		w.i32(3, rep)
+		w.binary(4, []byte(t.Names[j]))
+		if conv >= 0 {
+			w.i32(6, conv)
+			// The LogicalType union, STRING is field 1 and
+			// DATE is field 6
+			w.structField(10)
+			if conv == pqUTF8 {
+				w.structField(1)
+			} else {
+				w.structField(6)
+			}
+			w.end()
+			w.end()
+		}
+		w.end()
+	}
+}
+
+// ParquetWriter writes a Parquet file in parts, so that tables that do
+// not fit in memory can be written.  The row groups are written as the
+// parts are passed to Write, and the metadata is written by Close.
+type ParquetWriter struct {
+	wtr    *bufio.Writer
+	schema *Table
+	opt    *ParquetOptions
+	pos    int64 // The position in the file
+	nrows  int64
+
+	// The RowGroup structs of the row groups written so far
+	groups  thriftWriter
+	ngroups int
+}
+
+// NewParquetWriter returns a writer that writes tables with the names
+// and column types of schema to w.  The columns of schema that have
+// validity slices are optional, the others are required.  The
+// metadata of schema is stored in the file, its rows are not written.
+// If opt is nil, the default options are used.
+func NewParquetWriter(w io.Writer, schema *Table, opt *ParquetOptions) (*ParquetWriter, error) {
+
+	err := schema.check()
+	if err != nil {
+		return nil, err
+	}
+	if opt == nil {
+		opt = DefaultParquetOptions()
+	}
+	if opt.RowGroupSize <= 0 || opt.PageSize <= 0 {
+		return nil, fmt.Errorf("invalid Parquet options %+v", *opt)
+	}
+
+	pw := &ParquetWriter{wtr: bufio.NewWriter(w), schema: schema, opt: opt}
+	_, err = pw.wtr.Write(parquetMagic)
+	pw.pos = int64(len(parquetMagic))
+
+	return pw, err
+}
+
+// Write writes the rows of t, which must have the same names, column
+// types and optional columns as the schema, in row groups of at most
+// RowGroupSize rows.  Each call starts a new row group.
+func (pw *ParquetWriter) Write(t *Table) error {
+
+	err := t.check()
+	if err != nil {
+		return err
+	}
+	err = t.conforms(pw.schema, true)
+	if err != nil {
+		return err
+	}
+
+	n := t.Len()
+	for lo := 0; lo < n; lo += pw.opt.RowGroupSize {
+		hi := lo + pw.opt.RowGroupSize
+		if hi > n {
+			hi = n
+		}
+		err = pw.writeGroup(t, lo, hi)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeGroup writes rows lo to hi of t as a row group.
+func (pw *ParquetWriter) writeGroup(t *Table, lo, hi int) error {
+
+	g := &pw.groups
+	start := pw.pos
+	var usize int64
+	g.begin()
+	g.list(1, tStruct, len(t.Columns))
+	for j, col := range t.Columns {
+		c, err := encodeChunk(t, j, lo, hi, pw.opt)
+		if err != nil {
+			return err
+		}
+		_, err = pw.wtr.Write(c.data)
+		if err != nil {
+			return err
+		}
+
+		typ, _ := parquetType(col)
+		g.begin()
+		g.i64(2, pw.pos)
+		g.structField(3)
+		g.i32(1, typ)
+		g.list(2, tI32, len(c.encodings))
+		for _, e := range c.encodings {
+			g.zigzag(int64(e))
+		}
+		g.list(3, tBinary, 1)
+		g.bytes([]byte(t.Names[j]))
+		if pw.opt.Gzip {
+			g.i32(4, pqGzip)
+		} else {
+			g.i32(4, pqUncompressed)
+		}
+		g.i64(5, int64(hi-lo))
+		g.i64(6, c.size)
+		g.i64(7, int64(len(c.data)))
+		g.i64(9, pw.pos+c.dataPage)
+		if c.dictPage >= 0 {
+			g.i64(11, pw.pos+c.dictPage)
+		}
+		c.writeStats(g, 12)
+		g.end()
+		g.end()
+
+		pw.pos += int64(len(c.data))
+		usize += c.size
+	}
+	g.i64(2, usize)
+	g.i64(3, int64(hi-lo))
+	g.i64(5, start)
+	g.i64(6, pw.pos-start)
+	g.end()
+
+	pw.ngroups++
+	pw.nrows += int64(hi - lo)
+
+	return nil
+}
+
+// Close writes the file metadata, and flushes the output.  It does not
+// close the underlying writer.
+func (pw *ParquetWriter) Close() error {
+
+	t := pw.schema
+	meta := new(thriftWriter)
+	meta.begin()
+	meta.i32(1, 1)
+	parquetSchema(meta, t)
+	meta.i64(3, pw.nrows)
+	meta.list(4, tStruct, pw.ngroups)
+	meta.buf = append(meta.buf, pw.groups.buf...)
+
+	// Store the metadata in sorted order so that the output is
+	// reproducible.
+	if len(t.Metadata) > 0 {
+		var keys []string
+		for k := range t.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		meta.list(5, tStruct, len(keys))
+		for _, k := range keys {
+			meta.begin()
+			meta.binary(1, []byte(k))
+			meta.binary(2, []byte(t.Metadata[k]))
+			meta.end()
+		}
+	}
+	meta.binary(6, []byte("github.com/DrGo/godata_workshop/ghcn"))
+
+	// Declare that the statistics use the natural ordering of each
+	// type (TypeDefinedOrder).
+	meta.list(7, tStruct, len(t.Columns))
+	for range t.Columns {
+		meta.begin()
+		meta.structField(1)
+		meta.end()
+		meta.end()
+	}
+	meta.end()
+
+	pw.wtr.Write(meta.buf)
+	var flen [4]byte
+	binary.LittleEndian.PutUint32(flen[:], uint32(len(meta.buf)))
+	pw.wtr.Write(flen[:])
+	pw.wtr.Write(parquetMagic)
+
+	return pw.wtr.Flush()
+}
+
+// WriteParquet writes t to w as a Parquet file.  If opt is nil, the
+// default options are used.
+func WriteParquet(w io.Writer, t *Table, opt *ParquetOptions) error {
+
+	pw, err := NewParquetWriter(w, t, opt)
+	if err != nil {
+		return err
+	}
+	err = pw.Write(t)
+	if err != nil {
+		return err
+	}
+
+	return pw.Close()
+}
+
+// WriteParquetFile writes t to the file fname in the Parquet format.
+func WriteParquetFile(fname string, t *Table, opt *ParquetOptions) error {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	err = WriteParquet(fid, t, opt)
+	if err != nil {
+		return err
+	}
+
+	return fid.Close()
+}
+
+// rleEncode appends the values in x to buf using the RLE/bit-packing
+// hybrid encoding, with the given bit width.  Runs of at least eight
+// equal values are run length encoded, and the other values are bit
+// packed in groups of eight.
+func rleEncode(buf []byte, x []int32, width int) []byte {
+
+	// runs reports whether a run of at least 8 values starts at i.
+	runs := func(i int) bool {
+		if i+8 > len(x) {
+			return false
+		}
+		for k := i + 1; k < i+8; k++ {
+			if x[k] != x[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	nb := (width + 7) / 8
+	for i := 0; i < len(x); {
+		if runs(i) {
+			j := i + 8
+			for j < len(x) && x[j] == x[i] {
+				j++
+			}
+			buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+			for k := 0; k < nb; k++ {
+				buf = append(buf, byte(x[i]>>(8*uint(k))))
+			}
+			i = j
+			continue
+		}
+
+		// Bit pack groups of eight values until the next run.
+		// Values past the end of x are padded with zeros.
+		var ngroups int
+		j := i
+		for j < len(x) && ngroups < 63 {
+			j += 8
+			ngroups++
+			if runs(j) {
+				break
+			}
+		}
+		buf = binary.AppendUvarint(buf, uint64(ngroups)<<1|1)
+		packed := make([]byte, ngroups*width)
+		for k := i; k < j && k < len(x); k++ {
+			for b := 0; b < width; b++ {
+				if x[k]>>uint(b)&1 == 1 {
+					p := (k-i)*width + b
+					packed[p/8] |= 1 << uint(p%8)
+				}
+			}
+		}
+		buf = append(buf, packed...)
+		i = j
+	}
+
+	return buf
+}
+
+// rleDecode decodes n values from b, which uses the RLE/bit-packing
+// hybrid encoding with the given bit width.
+func rleDecode(b []byte, width, n int) ([]int32, error) {
+
+	x := make([]int32, 0, n)
+	nb := (width + 7) / 8
+	for pos := 0; len(x) < n; {
+		h, k := binary.Uvarint(b[pos:])
+		if k <= 0 {
+			return nil, fmt.Errorf("truncated RLE data")
+		}
+		pos += k
+
+		if h&1 == 0 {
+			// A run of equal values
+			if pos+nb > len(b) {
+				return nil, fmt.Errorf("truncated RLE data")
+			}
+			var v int32
+			for k := 0; k < nb; k++ {
+				v |= int32(b[pos+k]) << (8 * uint(k))
+			}
+			pos += nb
+			for m := int(h >> 1); m > 0 && len(x) < n; m-- {
+				x = append(x, v)
+			}
+			continue
+		}
+
+		// Bit packed groups of eight values
+		ng := int(h >> 1)
+		if pos+ng*width > len(b) {
+			return nil, fmt.Errorf("truncated RLE data")
+		}
+		for k := 0; k < 8*ng && len(x) < n; k++ {
+			var v int32
+			for j := 0; j < width; j++ {
+				p := k*width + j
+				v |= int32(b[pos+p/8]>>uint(p%8)&1) << uint(j)
+			}
+			x = append(x, v)
+		}
+		pos += ng * width
+	}
+
+	return x, nil
+}
+
+// readPlain decodes n plain encoded values of the given physical
+// type.
+func readPlain(b []byte, typ int64, n int) (interface{}, error) {
+
+	short := fmt.Errorf("truncated page")
+	switch typ {
+	case pqByteArray:
+		x := make([]string, n)
+		for i := range x {
+			if len(b) < 4 {
+				return nil, short
+			}
+			m := int(binary.LittleEndian.Uint32(b))
+			if len(b) < 4+m {
+				return nil, short
+			}
+			x[i] = string(b[4 : 4+m])
+			b = b[4+m:]
+		}
+		return x, nil
+	case pqInt32:
+		if len(b) < 4*n {
+			return nil, short
+		}
+		x := make([]int32, n)
+		for i := range x {
+			x[i] = int32(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+		return x, nil
+	case pqDouble:
+		if len(b) < 8*n {
+			return nil, short
+		}
+		x := make([]float64, n)
+		for i := range x {
+			x[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("unsupported physical type %d", typ)
+}
+
+// pqColumn accumulates the values of one column as it is read.
+type pqColumn struct {
+	name     string
+	typ      int64
+	conv     int64
+	optional bool
+	strs     []string
+	ints     []int32
+	dbls     []float64
+	valid    []bool
+}
+
+// appendValues appends the non-missing values in vals (from
+// readPlain) to the column, along with missing values where def is
+// zero.
+func (c *pqColumn) appendValues(vals interface{}, def []int32) {
+	var k int
+	for i := range def {
+		ok := def[i] == 1
+		if c.optional {
+			c.valid = append(c.valid, ok)
+		}
+		switch x := vals.(type) {
+		case []string:
+			var v string
+			if ok {
+				v = x[k]
+			}
+			c.strs = append(c.strs, v)
+		case []int32:
+			var v int32
+			if ok {
+				v = x[k]
+			}
+			c.ints = append(c.ints, v)
+		case []float64:
+			v := math.NaN()
+			if ok {
+				v = x[k]
+			}
+			c.dbls = append(c.dbls, v)
+		}
+		if ok {
+			k++
+		}
+	}
+}
+
+// readChunk reads the pages of one column chunk, which contain n
+// values.
+func (c *pqColumn) readChunk(b []byte, codec int64, n int64) error {
+
+	var dict interface{}
+	for n > 0 {
+		r := &thriftReader{b: b}
+		hdr := r.readStruct()
+		if r.err != nil {
+			return r.err
+		}
+		size := int(hdr.int(3, -1))
+		if size < 0 || r.pos+size > len(b) {
+			return fmt.Errorf("truncated page")
+		}
+		body := b[r.pos : r.pos+size]
+		b = b[r.pos+size:]
+
+		switch codec {
+		case pqUncompressed:
+		case pqGzip:
+			g, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			body, err = ioutil.ReadAll(g)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported compression codec %d", codec)
+		}
+
+		switch hdr.int(1, -1) {
+		case pqDictionaryPage:
+			m := int(hdr.strct(7).int(1, 0))
+			var err error
+			dict, err = readPlain(body, c.typ, m)
+			if err != nil {
+				return err
+			}
+		case pqDataPage:
+			dp := hdr.strct(5)
+			m := int(dp.int(1, 0))
+			def := make([]int32, m)
+			nvalid := m
+			if c.optional {
+				if len(body) < 4 {
+					return fmt.Errorf("truncated page")
+				}
+				k := int(binary.LittleEndian.Uint32(body))
+				if 4+k > len(body) {
+					return fmt.Errorf("truncated page")
+				}
+				var err error
+				def, err = rleDecode(body[4:4+k], 1, m)
+				if err != nil {
+					return err
+				}
+				body = body[4+k:]
+				nvalid = 0
+				for _, d := range def {
+					nvalid += int(d)
+				}
+			} else {
+				for i := range def {
+					def[i] = 1
+				}
+			}
+
+			var vals interface{}
+			switch enc := dp.int(2, -1); enc {
+			case pqPlain:
+				var err error
+				vals, err = readPlain(body, c.typ, nvalid)
+				if err != nil {
+					return err
+				}
+			case pqPlainDict, pqRLEDict:
+				if dict == nil || len(body) < 1 {
+					return fmt.Errorf("dictionary page is missing")
+				}
+				codes, err := rleDecode(body[1:], int(body[0]), nvalid)
+				if err != nil {
+					return err
+				}
+				vals, err = lookupDict(dict, codes)
+				if err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unsupported encoding %d", enc)
+			}
+			c.appendValues(vals, def)
+			n -= int64(m)
+		default:
+			return fmt.Errorf("unsupported page type %d", hdr.int(1, -1))
+		}
+	}
+
+	return nil
+}
+
+// lookupDict returns the dictionary values for the given codes.
+func lookupDict(dict interface{}, codes []int32) (interface{}, error) {
+	bad := fmt.Errorf("invalid dictionary code")
+	switch d := dict.(type) {
+	case []string:
+		x := make([]string, len(codes))
+		for i, c := range codes {
+			if int(c) >= len(d) {
+				return nil, bad
+			}
+			x[i] = d[c]
+		}
+		return x, nil
+	case []int32:
+		x := make([]int32, len(codes))
+		for i, c := range codes {
+			if int(c) >= len(d) {
+				return nil, bad
+			}
+			x[i] = d[c]
+		}
+		return x, nil
+	case []float64:
+		x := make([]float64, len(codes))
+		for i, c := range codes {
+			if int(c) >= len(d) {
+				return nil, bad
+			}
+			x[i] = d[c]
+		}
+		return x, nil
+	}
+	return nil, bad
+}
+
+// ReadParquetFile reads a Parquet file written by WriteParquet.
+// Missing values of float64 columns are set to NaN, and missing
+// values of the other columns are set to zero values.
+func ReadParquetFile(fname string) (*Table, error) {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(b)
+	if n < 12 || !bytes.Equal(b[0:4], parquetMagic) || !bytes.Equal(b[n-4:], parquetMagic) {
+		return nil, fmt.Errorf("%s: not a Parquet file", fname)
+	}
+	flen := int(binary.LittleEndian.Uint32(b[n-8:]))
+	if flen > n-12 {
+		return nil, fmt.Errorf("%s: invalid footer length", fname)
+	}
+	r := &thriftReader{b: b[n-8-flen : n-8]}
+	meta := r.readStruct()
+	if r.err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, r.err)
+	}
+
+	// The first schema element is the root, the others are the
+	// columns.
+	var cols []*pqColumn
+	for i, s := range meta.list(2) {
+		se, _ := s.(tstruct)
+		if i == 0 || se == nil {
+			continue
+		}
+		cols = append(cols, &pqColumn{
+			name:     string(se.bytes(4)),
+			typ:      se.int(1, -1),
+			conv:     se.int(6, -1),
+			optional: se.int(3, pqRequired) == pqOptional,
+		})
+	}
+
+	for _, g := range meta.list(4) {
+		rg, _ := g.(tstruct)
+		chunks := rg.list(1)
+		if len(chunks) != len(cols) {
+			return nil, fmt.Errorf("%s: row group has %d columns, expected %d",
+				fname, len(chunks), len(cols))
+		}
+		for j, ch := range chunks {
+			cm := ch.(tstruct).strct(3)
+			start := cm.int(9, -1)
+			if d := cm.int(11, -1); d >= 0 {
+				start = d
+			}
+			end := start + cm.int(7, 0)
+			if start < 0 || end > int64(n) {
+				return nil, fmt.Errorf("%s: invalid column chunk location", fname)
+			}
+			err = cols[j].readChunk(b[start:end], cm.int(4, pqUncompressed), cm.int(5, 0))
+			if err != nil {
+				return nil, fmt.Errorf("%s: column %s: %v", fname, cols[j].name, err)
+			}
+		}
+	}
+
+	t := new(Table)
+	for _, c := range cols {
+		var col interface{}
+		switch {
+		case c.typ == pqByteArray:
+			col = c.strs
+			if c.strs == nil {
+				col = []string{}
+			}
+		case c.typ == pqInt32 && c.conv == pqDATE:
+			d := make([]Date, len(c.ints))
+			for i, v := range c.ints {
+				d[i] = Date(v)
+			}
+			col = d
+		case c.typ == pqInt32:
+			col = c.ints
+			if c.ints == nil {
+				col = []int32{}
+			}
+		case c.typ == pqDouble:
+			col = c.dbls
+			if c.dbls == nil {
+				col = []float64{}
+			}
+		default:
+			return nil, fmt.Errorf("%s: column %s has unsupported type %d", fname, c.name, c.typ)
+		}
+		var valid []bool
+		if c.optional {
+			valid = c.valid
+			if valid == nil {
+				valid = []bool{}
+			}
+		}
+		t.Add(c.name, col, valid)
+	}
+
+	for _, kv := range meta.list(5) {
+		s, _ := kv.(tstruct)
+		if t.Metadata == nil {
+			t.Metadata = make(map[string]string)
+		}
+		t.Metadata[string(s.bytes(1))] = string(s.bytes(2))
+	}
+
+	return t, nil
+}
@@ -0,0 +1,312 @@
+package ghcn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testTable returns a table of n rows in the layout of the
+// partition tables, with a few station ids (which are dictionary
+// encoded), and missing values and flags.
+func testTable(n int) *Table {
+
+	rng := rand.New(rand.NewSource(1))
+	ids := []string{"USW00094728", "CA006158355", "ASN00086071", "GME00127786"}
+	flags := []string{"", "I", "S", "D"}
+
+	id := make([]string, n)
+	date := make([]Date, n)
+	value := make([]float64, n)
+	vvalid := make([]bool, n)
+	qflag := make([]string, n)
+	qvalid := make([]bool, n)
+	count := make([]int32, n)
+	for i := 0; i < n; i++ {
+		id[i] = ids[(i/50)%len(ids)]
+		date[i] = NewDate(1950+i/366, 1, 1) + Date(i%366)
+		vvalid[i] = rng.Intn(10) != 0
+		if vvalid[i] {
+			value[i] = float64(rng.Intn(700)-200) / 10
+		}
+		if f := flags[rng.Intn(len(flags))]; f != "" {
+			qflag[i] = f
+			qvalid[i] = true
+		}
+		count[i] = int32(rng.Intn(31))
+	}
+
+	t := new(Table)
+	t.Add("Id", id, nil)
+	t.Add("Date", date, nil)
+	t.Add("Value", value, vvalid)
+	t.Add("QFlag", qflag, qvalid)
+	t.Add("Count", count, nil)
+	t.Metadata = map[string]string{"Element": "TMAX"}
+
+	return t
+}
+
+// pqStats holds the statistics of one column chunk, decoded from the
+// footer of a Parquet file, and whether the chunk has a dictionary
+// page.
+type pqStats struct {
+	min, max interface{}
+	nulls    int64
+	dict     bool
+}
+
+// readParquetStats returns the statistics of the column chunks of a
+// Parquet file, by row group and column.
+func readParquetStats(fname string) ([][]pqStats, error) {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	n := len(b)
+	flen := int(binary.LittleEndian.Uint32(b[n-8:]))
+	r := &thriftReader{b: b[n-8-flen : n-8]}
+	meta := r.readStruct()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var stats [][]pqStats
+	for _, g := range meta.list(4) {
+		var row []pqStats
+		for _, ch := range g.(tstruct).list(1) {
+			cm := ch.(tstruct).strct(3)
+			st := cm.strct(12)
+			s := pqStats{nulls: st.int(3, -1), dict: cm.int(11, -1) >= 0}
+			s.min = decodeStat(cm.int(1, -1), st.bytes(6))
+			s.max = decodeStat(cm.int(1, -1), st.bytes(5))
+			row = append(row, s)
+		}
+		stats = append(stats, row)
+	}
+
+	return stats, nil
+}
+
+// decodeStat decodes a minimum or maximum of the given physical type.
+func decodeStat(typ int64, b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	switch typ {
+	case pqByteArray:
+		return string(b)
+	case pqInt32:
+		return int32(binary.LittleEndian.Uint32(b))
+	case pqDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return nil
+}
+
+// wantStats returns the statistics of rows lo to hi of column j.
+// String columns are dictionary encoded.
+func wantStats(t *Table, j, lo, hi int) pqStats {
+
+	var s pqStats
+	_, s.dict = t.Columns[j].([]string)
+	valid := t.Valid[j]
+	for i := lo; i < hi; i++ {
+		if valid != nil && !valid[i] {
+			s.nulls++
+			continue
+		}
+		var v interface{}
+		less := func(a, b interface{}) bool { return false }
+		switch x := t.Columns[j].(type) {
+		case []string:
+			v = x[i]
+			less = func(a, b interface{}) bool { return a.(string) < b.(string) }
+		case []Date:
+			v = int32(x[i])
+			less = func(a, b interface{}) bool { return a.(int32) < b.(int32) }
+		case []int32:
+			v = x[i]
+			less = func(a, b interface{}) bool { return a.(int32) < b.(int32) }
+		case []float64:
+			v = x[i]
+			less = func(a, b interface{}) bool { return a.(float64) < b.(float64) }
+		}
+		if s.min == nil || less(v, s.min) {
+			s.min = v
+		}
+		if s.max == nil || less(s.max, v) {
+			s.max = v
+		}
+	}
+
+	return s
+}
+
+// writeParts writes t to fname in parts of the given number of rows.
+func writeParts(fname string, t *Table, parts int, opt *ParquetOptions) error {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	pw, err := NewParquetWriter(fid, t, opt)
+	if err != nil {
+		return err
+	}
+	for lo := 0; lo < t.Len(); lo += parts {
+		hi := lo + parts
+		if hi > t.Len() {
+			hi = t.Len()
+		}
+		part := &Table{Metadata: t.Metadata}
+		for j, col := range t.Columns {
+			var valid []bool
+			if t.Valid[j] != nil {
+				valid = t.Valid[j][lo:hi]
+			}
+			part.Add(t.Names[j], sliceColumn(col, lo, hi), valid)
+		}
+		err = pw.Write(part)
+		if err != nil {
+			return err
+		}
+	}
+	err = pw.Close()
+	if err != nil {
+		return err
+	}
+
+	return fid.Close()
+}
+
+// sliceColumn returns rows lo to hi of a column.
+func sliceColumn(col interface{}, lo, hi int) interface{} {
+	switch x := col.(type) {
+	case []string:
+		return x[lo:hi]
+	case []Date:
+		return x[lo:hi]
+	case []int32:
+		return x[lo:hi]
+	case []float64:
+		return x[lo:hi]
+	}
+	return nil
+}
+
+// rowGroups returns the first row of each row group of a table of n
+// rows, written in parts of the given number of rows (or all at once
+// if parts is zero), in row groups of at most size rows.
+func rowGroups(n, parts, size int) []int {
+	if parts == 0 {
+		parts = n
+	}
+	var groups []int
+	for p := 0; p < n; p += parts {
+		for g := p; g < p+parts && g < n; g += size {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// If parts is not zero, the table is written in parts of that
+	// many rows with a ParquetWriter.
+	for k, tc := range []struct {
+		rows  int
+		parts int
+		opt   ParquetOptions
+	}{
+		{rows: 1000, opt: ParquetOptions{RowGroupSize: 1 << 20, PageSize: 1 << 16, Gzip: true}},
+		{rows: 1000, opt: ParquetOptions{RowGroupSize: 300, PageSize: 64, Gzip: true}},
+		{rows: 1000, opt: ParquetOptions{RowGroupSize: 250, PageSize: 100}},
+		{rows: 7, opt: ParquetOptions{RowGroupSize: 3, PageSize: 2}},
+		{rows: 0, opt: ParquetOptions{RowGroupSize: 10, PageSize: 10}},
+		{rows: 1000, parts: 300, opt: ParquetOptions{RowGroupSize: 300, PageSize: 64, Gzip: true}},
+		{rows: 1000, parts: 400, opt: ParquetOptions{RowGroupSize: 150, PageSize: 100}},
+	} {
+		name := fmt.Sprintf("case %d (%d rows, %d parts, %+v)", k, tc.rows, tc.parts, tc.opt)
+		want := testTable(tc.rows)
+		fname := filepath.Join(dir, fmt.Sprintf("t%d.parquet", k))
+		var err error
+		if tc.parts == 0 {
+			err = WriteParquetFile(fname, want, &tc.opt)
+		} else {
+			err = writeParts(fname, want, tc.parts, &tc.opt)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		got, err := ReadParquetFile(fname)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got.Names, want.Names) {
+			t.Fatalf("%s: names %v, expected %v", name, got.Names, want.Names)
+		}
+		if !reflect.DeepEqual(got.Metadata, want.Metadata) {
+			t.Errorf("%s: metadata %v, expected %v", name, got.Metadata, want.Metadata)
+		}
+		if !reflect.DeepEqual(got.Valid, want.Valid) {
+			t.Errorf("%s: validity differs", name)
+		}
+
+		// Missing floats are read as NaN.
+		for j := range want.Columns {
+			col := got.Columns[j]
+			if x, ok := col.([]float64); ok {
+				for i, v := range want.Valid[j] {
+					if !v {
+						if !math.IsNaN(x[i]) {
+							t.Errorf("%s: %s[%d] is %v, expected NaN", name, want.Names[j], i, x[i])
+						}
+						x[i] = 0
+					}
+				}
+			}
+			if !reflect.DeepEqual(col, want.Columns[j]) {
+				t.Errorf("%s: column %s differs", name, want.Names[j])
+			}
+		}
+
+		stats, err := readParquetStats(fname)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		groups := rowGroups(tc.rows, tc.parts, tc.opt.RowGroupSize)
+		if len(stats) != len(groups) {
+			t.Fatalf("%s: %d row groups, expected %d", name, len(stats), len(groups))
+		}
+		for g, lo := range groups {
+			hi := tc.rows
+			if g+1 < len(groups) {
+				hi = groups[g+1]
+			}
+			for j := range want.Columns {
+				if s := wantStats(want, j, lo, hi); stats[g][j] != s {
+					t.Errorf("%s: row group %d column %s: statistics %+v, expected %+v",
+						name, g, want.Names[j], stats[g][j], s)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ghcn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Partitioning describes how the observations in a columnized store
+// are divided into partitions, each of which is stored in its own
+// directory.
+type Partitioning interface {
+
+	// String returns the name of the partitioning, which can be
+	// parsed by ParsePartitioning.
+	String() string
+
+	// Key returns the directory name of the partition that holds
+	// the observations for station id in the given year.
+	Key(id string, year int) string
+
+	// Keep reports whether the partition with the given key may
+	// contain observations for the stations in ids (all stations if
+	// ids is nil) whose ids start with prefix, in the years
+	// first..last.
+	Keep(key string, ids map[string]bool, prefix string, first, last int) bool
+}
+
+// ByYear places the data for each year in a partition named after
+// the year, e.g. 1909.
+type ByYear struct{}
+
+// ByDecade places the data for each decade in a partition named after
+// the decade, e.g. 1900s.
+type ByDecade struct{}
+
+// ByStation places the data for each station in a partition named
+// after the station id.
+type ByStation struct{}
+
+// ByPrefix places the data for all stations whose ids share the first
+// N characters in one partition, named after the prefix.  The first
+// two characters of a GHCN station id are the country code.
+type ByPrefix struct {
+	N int
+}
+
+func (ByYear) String() string {
+	return "year"
+}
+
+func (ByYear) Key(id string, year int) string {
+	return strconv.Itoa(year)
+}
+
+func (ByYear) Keep(key string, ids map[string]bool, prefix string, first, last int) bool {
+	year, err := strconv.Atoi(key)
+	return err == nil && year >= first && year <= last
+}
+
+func (ByDecade) String() string {
+	return "decade"
+}
+
+func (ByDecade) Key(id string, year int) string {
+	return fmt.Sprintf("%ds", year-year%10)
+}
+
+func (ByDecade) Keep(key string, ids map[string]bool, prefix string, first, last int) bool {
+	if !strings.HasSuffix(key, "s") {
+		return false
+	}
+	decade, err := strconv.Atoi(strings.TrimSuffix(key, "s"))
+	return err == nil && decade+9 >= first && decade <= last
+}
+
+func (ByStation) String() string {
+	return "station"
+}
+
+func (ByStation) Key(id string, year int) string {
+	return id
+}
+
+func (ByStation) Keep(key string, ids map[string]bool, prefix string, first, last int) bool {
+	return (ids == nil || ids[key]) && strings.HasPrefix(key, prefix)
+}
+
+func (p ByPrefix) String() string {
+	return fmt.Sprintf("prefix:%d", p.N)
+}
+
+func (p ByPrefix) Key(id string, year int) string {
+	if len(id) < p.N {
+		return id
+	}
+	return id[0:p.N]
+}
+
+func (p ByPrefix) Keep(key string, ids map[string]bool, prefix string, first, last int) bool {
+
+	// The ids in the partition start with key, so the key must agree
+	// with the prefix in their first N characters.  A key shorter
+	// than N is a whole station id.
+	n := len(prefix)
+	if n > p.N {
+		n = p.N
+	}
+	if len(key) < n || key[0:n] != prefix[0:n] {
+		return false
+	}
+
+	if ids == nil {
+		return true
+	}
+	for id := range ids {
+		if p.Key(id, 0) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePartitioning returns the partitioning with the given name,
+// which is one of "year", "decade", "station", or "prefix:N".  The
+// name "prefix" alone uses the two character country code.
+func ParsePartitioning(name string) (Partitioning, error) {
+
+	switch name {
+	case "year":
+		return ByYear{}, nil
+	case "decade":
+		return ByDecade{}, nil
+	case "station":
+		return ByStation{}, nil
+	case "prefix":
+		return ByPrefix{N: 2}, nil
+	}
+
+	if strings.HasPrefix(name, "prefix:") {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "prefix:"))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid prefix length in %q", name)
+		}
+		return ByPrefix{N: n}, nil
+	}
+
+	return nil, fmt.Errorf("unknown partitioning %q, expected year, decade, station or prefix:N", name)
+}
+
+// LayoutFile is the name of the file in the top level directory of a
+// columnized store that describes how the store is partitioned.
+const LayoutFile = "layout.json"
+
+// Layout describes the partitioning of a columnized store.
+type Layout struct {
+	Partitioning string   // The name of the partitioning, see ParsePartitioning
+	Years        []int    // The years that have data, in increasing order
+	Elements     []string `json:",omitempty"` // The elements of a store of several elements
+}
+
+// ReadLayout reads the layout file of the store in directory dir.
+// Stores without a layout file are partitioned by year.
+func ReadLayout(dir string) (*Layout, error) {
+
+	b, err := ioutil.ReadFile(path.Join(dir, LayoutFile))
+	if os.IsNotExist(err) {
+		return &Layout{Partitioning: "year"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	l := new(Layout)
+	err = json.Unmarshal(b, l)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", LayoutFile, err)
+	}
+
+	return l, nil
+}
+
+// WriteLayout writes the layout file of the store in directory dir.
+func WriteLayout(dir string, l *Layout) error {
+
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, LayoutFile), append(b, '\n'), 0600)
+}
@@ -0,0 +1,98 @@
+package ghcn
+
+import (
+	"testing"
+)
+
+func TestPartitionKey(t *testing.T) {
+
+	for _, tc := range []struct {
+		name string
+		id   string
+		year int
+		key  string
+	}{
+		{"year", "USW00094728", 1909, "1909"},
+		{"decade", "USW00094728", 1909, "1900s"},
+		{"decade", "USW00094728", 1910, "1910s"},
+		{"station", "USW00094728", 1909, "USW00094728"},
+		{"prefix", "USW00094728", 1909, "US"},
+		{"prefix:3", "USW00094728", 1909, "USW"},
+		{"prefix:20", "USW00094728", 1909, "USW00094728"},
+	} {
+		p, err := ParsePartitioning(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := p.Key(tc.id, tc.year); key != tc.key {
+			t.Errorf("%s: key of %s in %d is %q, expected %q", tc.name, tc.id, tc.year, key, tc.key)
+		}
+	}
+}
+
+func TestPartitionKeep(t *testing.T) {
+
+	ids := map[string]bool{"USW00094728": true, "CA006158355": true}
+
+	for _, tc := range []struct {
+		name        string
+		key         string
+		ids         map[string]bool
+		prefix      string
+		first, last int
+		keep        bool
+	}{
+		{"year", "1909", nil, "", 1900, 1910, true},
+		{"year", "1911", nil, "", 1900, 1910, false},
+		{"year", "1909", ids, "ZZ", 1909, 1909, true},
+		{"decade", "1900s", nil, "", 1909, 1920, true},
+		{"decade", "1900s", nil, "", 1910, 1920, false},
+		{"decade", "1920s", nil, "", 1900, 1919, false},
+		{"decade", "1909", nil, "", 1900, 1920, false},
+		{"station", "USW00094728", nil, "", 1900, 1910, true},
+		{"station", "USW00094728", ids, "", 1900, 1910, true},
+		{"station", "ASN00086071", ids, "", 1900, 1910, false},
+		{"station", "USW00094728", nil, "US", 1900, 1910, true},
+		{"station", "USW00094728", nil, "CA", 1900, 1910, false},
+		{"station", "USW00094728", ids, "CA", 1900, 1910, false},
+		{"prefix", "US", nil, "", 1900, 1910, true},
+		{"prefix", "US", ids, "", 1900, 1910, true},
+		{"prefix", "AS", ids, "", 1900, 1910, false},
+		{"prefix", "US", nil, "U", 1900, 1910, true},
+		{"prefix", "US", nil, "USW", 1900, 1910, true},
+		{"prefix", "US", nil, "CA", 1900, 1910, false},
+		{"prefix", "CA", ids, "US", 1900, 1910, false},
+		{"prefix:4", "USW0", nil, "US", 1900, 1910, true},
+		{"prefix:4", "USC0", nil, "USW", 1900, 1910, false},
+		{"prefix:4", "USW0", nil, "USW00094728", 1900, 1910, true},
+		{"prefix:4", "US", nil, "USW", 1900, 1910, false},
+		{"prefix:4", "US", nil, "U", 1900, 1910, true},
+	} {
+		p, err := ParsePartitioning(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keep := p.Keep(tc.key, tc.ids, tc.prefix, tc.first, tc.last); keep != tc.keep {
+			t.Errorf("%s: Keep(%q, %v, %q, %d, %d) is %v, expected %v", tc.name, tc.key,
+				tc.ids, tc.prefix, tc.first, tc.last, keep, tc.keep)
+		}
+	}
+}
+
+func TestParsePartitioning(t *testing.T) {
+
+	for _, name := range []string{"year", "decade", "station", "prefix:2", "prefix:5"} {
+		p, err := ParsePartitioning(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if p.String() != name {
+			t.Errorf("%s: parsed as %s", name, p)
+		}
+	}
+
+	for _, name := range []string{"", "month", "prefix:", "prefix:0", "prefix:x"} {
+		if _, err := ParsePartitioning(name); err == nil {
+			t.Errorf("no error for %q", name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ghcn
+
+import (
+	"flag"
+	"strings"
+)
+
+// AllQFlags contains every QFLAG code defined in the data format
+// readme.  A blank QFLAG means that the value did not fail any of the
+// quality assurance checks.
+const AllQFlags = "DGIKLMNORSTWXZ"
+
+// Missing is the raw value used in the data files to represent a
+// missing value.
+const Missing = -9999
+
+// Policy determines which daily values are treated as valid, based on
+// the quality (QFLAG) and source (SFLAG) flags attached to each value.
+// All the GHCN scripts use a Policy so that they agree about what
+// counts as a valid value.
+type Policy struct {
+
+	// QFLAG codes that cause a value to be rejected
+	RejectQFlags string
+
+	// QFLAG codes that are accepted even if they also appear in
+	// RejectQFlags, e.g. RejectQFlags = AllQFlags and KeepQFlags =
+	// "K" rejects all flagged values except those flagged for
+	// streak/frequent-value checks.
+	KeepQFlags string
+
+	// SFLAG codes of the sources that we trust.  If empty, values
+	// from all sources are accepted.
+	Sources string
+}
+
+// DefaultPolicy rejects every value that failed a quality assurance
+// check, and accepts values from all sources.
+func DefaultPolicy() *Policy {
+	return &Policy{RejectQFlags: AllQFlags}
+}
+
+// Valid returns true if a raw value with the given quality and source
+// flags should be used.
+func (p *Policy) Valid(value float64, qflag, sflag byte) bool {
+
+	if value == Missing {
+		return false
+	}
+
+	if qflag != ' ' && strings.IndexByte(p.RejectQFlags, qflag) != -1 &&
+		strings.IndexByte(p.KeepQFlags, qflag) == -1 {
+		return false
+	}
+
+	if p.Sources != "" && strings.IndexByte(p.Sources, sflag) == -1 {
+		return false
+	}
+
+	return true
+}
+
+// RegisterFlags defines command line flags that can be used to
+// configure the policy.  The current field values are used as the
+// defaults.
+func (p *Policy) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.RejectQFlags, "qflag-reject", p.RejectQFlags,
+		"QFLAG codes for which values are rejected")
+	fs.StringVar(&p.KeepQFlags, "qflag-keep", p.KeepQFlags,
+		"QFLAG codes for which values are kept, overrides -qflag-reject")
+	fs.StringVar(&p.Sources, "sources", p.Sources,
+		"SFLAG codes of trusted sources, all sources are trusted if empty")
+}
@@ -0,0 +1,180 @@
+package ghcn
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Progress reports the progress of a pipeline that reads data files.
+// The counts are updated by the goroutines that read the files, and a
+// line describing the progress is printed periodically.  A Progress
+// can be used by several goroutines at the same time.
+type Progress struct {
+
+	// How often the progress is printed, no progress is printed if
+	// zero
+	Interval time.Duration
+
+	// Where the progress is printed
+	Out io.Writer
+
+	// If not nil, returns the memory in use and the memory budget
+	// of the pipeline, in bytes.  Otherwise the size of the Go heap
+	// is shown.
+	Memory func() (used, budget int64)
+
+	// The counts, which are updated atomically
+	nfiles   int64
+	nbytes   int64
+	files    int64
+	lines    int64
+	records  int64
+	bytes    int64
+	start    time.Time
+	stop     chan bool
+	finished chan bool
+}
+
+// NewProgress returns a Progress that prints to stdout every ten
+// seconds.
+func NewProgress() *Progress {
+	return &Progress{Interval: 10 * time.Second, Out: os.Stdout}
+}
+
+// RegisterFlags defines the -progress command line flag that sets how
+// often the progress is printed.
+func (p *Progress) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&p.Interval, "progress", p.Interval,
+		"How often to print the progress (e.g. 30s), 0 for never")
+}
+
+// Start starts the timer, and starts printing the progress.
+func (p *Progress) Start() {
+
+	p.start = time.Now()
+	if p.Interval <= 0 {
+		return
+	}
+
+	p.stop = make(chan bool)
+	p.finished = make(chan bool)
+	go func() {
+		defer close(p.finished)
+		tick := time.NewTicker(p.Interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				fmt.Fprintln(p.Out, p)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops printing the progress, and prints the final progress.
+func (p *Progress) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.finished
+	p.stop = nil
+	fmt.Fprintln(p.Out, p)
+}
+
+// AddFiles adds the given files to the files that are to be read.
+func (p *Progress) AddFiles(files []os.FileInfo) {
+	var n int64
+	for _, fi := range files {
+		n += fi.Size()
+	}
+	atomic.AddInt64(&p.nfiles, int64(len(files)))
+	atomic.AddInt64(&p.nbytes, n)
+}
+
+// FileDone records that a file has been read.
+func (p *Progress) FileDone() {
+	atomic.AddInt64(&p.files, 1)
+}
+
+// AddLines records that n lines have been read.
+func (p *Progress) AddLines(n int) {
+	atomic.AddInt64(&p.lines, int64(n))
+}
+
+// AddRecords records that n records have been produced.
+func (p *Progress) AddRecords(n int) {
+	atomic.AddInt64(&p.records, int64(n))
+}
+
+// countReader counts the bytes read from a reader.
+type countReader struct {
+	rdr io.Reader
+	n   *int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.rdr.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// Reader returns a reader that reads from r and counts the bytes that
+// are read.  It should wrap the file, so that the bytes are counted
+// before decompression.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return &countReader{rdr: r, n: &p.bytes}
+}
+
+// Counts returns the number of files, lines, records and bytes that
+// have been read.
+func (p *Progress) Counts() (files, lines, records, bytes int64) {
+	return atomic.LoadInt64(&p.files), atomic.LoadInt64(&p.lines),
+		atomic.LoadInt64(&p.records), atomic.LoadInt64(&p.bytes)
+}
+
+// Elapsed returns the time since Start was called.
+func (p *Progress) Elapsed() time.Duration {
+	return time.Since(p.start)
+}
+
+// String describes the progress, the rates are averages since Start
+// was called, and the remaining time is estimated from the number of
+// bytes left to read.
+func (p *Progress) String() string {
+
+	files, lines, records, bytes := p.Counts()
+	nfiles := atomic.LoadInt64(&p.nfiles)
+	nbytes := atomic.LoadInt64(&p.nbytes)
+	secs := p.Elapsed().Seconds()
+	mb := func(n int64) float64 { return float64(n) / (1 << 20) }
+
+	var mem string
+	if p.Memory != nil {
+		used, budget := p.Memory()
+		mem = fmt.Sprintf("memory %.1f/%.1f MB", mb(used), mb(budget))
+	} else {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		mem = fmt.Sprintf("heap %.1f MB", mb(int64(ms.HeapAlloc)))
+	}
+
+	eta := "?"
+	if bytes >= nbytes {
+		eta = "0s"
+	} else if bytes > 0 {
+		left := secs * float64(nbytes-bytes) / float64(bytes)
+		eta = (time.Duration(left) * time.Second).String()
+	}
+
+	return fmt.Sprintf("Files %d/%d, %d lines (%.0f/s), %d records (%.0f/s), %.1f/%.1f MB read, %s, ETA %s",
+		files, nfiles, lines, float64(lines)/secs, records, float64(records)/secs, mb(bytes), mb(nbytes),
+		mem, eta)
+}
@@ -0,0 +1,215 @@
+package ghcn
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxDays is the number of day slots in each line of a data file.
+const MaxDays = 31
+
+// Record contains the data in one line of a GHCN-Daily data file,
+// i.e. the values of one element for all days in one station month.
+// Each daily value has three single character flags attached to it,
+// see the data format readme for the codes.  The day slots past NDays
+// (only present if the line was truncated) are missing.
+type Record struct {
+	Id      string           // The station id
+	Year    int              // The year of the data point
+	Month   int              // The month of the data point (1..12)
+	Element string           // The data value type (e.g. TMAX or PRCP)
+	NDays   int              // The number of day slots in the line
+	Values  [MaxDays]float64 // The daily values, in raw units
+	MFlag   [MaxDays]byte    // The measurement flag for each day
+	QFlag   [MaxDays]byte    // The quality flag for each day
+	SFlag   [MaxDays]byte    // The source flag for each day
+	IsValid [MaxDays]bool    // Validity of each day according to the policy
+}
+
+// clearDays marks the day slots from NDays on as missing.
+func (rec *Record) clearDays() {
+	for j := rec.NDays; j < MaxDays; j++ {
+		rec.Values[j] = Missing
+		rec.MFlag[j] = ' '
+		rec.QFlag[j] = ' '
+		rec.SFlag[j] = ' '
+		rec.IsValid[j] = false
+	}
+}
+
+// flagAt returns the byte at position pos of line, or a blank if the
+// line is too short.  Some files have the trailing blanks of the line
+// stripped.
+func flagAt(line string, pos int) byte {
+	if pos < len(line) {
+		return line[pos]
+	}
+	return ' '
+}
+
+// Header returns the station id and element type of a line, without
+// parsing the daily values.  This can be used to skip lines that are
+// not needed.
+func Header(line string) (id, element string, err error) {
+	if len(line) < 21 {
+		return "", "", fmt.Errorf("line too short (%d characters)", len(line))
+	}
+	return line[0:11], line[17:21], nil
+}
+
+// Parse parses one line of a raw data file.  The validity of each
+// daily value is determined using pol.  An error is returned if the
+// line is malformed.
+//
+// ParseBytes does the same thing much faster and without allocating
+// memory, Parse is kept as the simplest statement of the file format.
+func Parse(line string, pol *Policy) (*Record, error) {
+
+	var rec Record
+	var err error
+
+	rec.Id, rec.Element, err = Header(line)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Year, err = strconv.Atoi(line[11:15])
+	if err != nil {
+		return nil, fmt.Errorf("invalid year %q", line[11:15])
+	}
+
+	rec.Month, err = strconv.Atoi(line[15:17])
+	if err != nil || rec.Month < 1 || rec.Month > 12 {
+		return nil, fmt.Errorf("invalid month %q", line[15:17])
+	}
+
+	// Each day occupies 8 characters: a 5 character value
+	// followed by the MFLAG, QFLAG and SFLAG characters.
+	for pos := 21; pos+5 <= len(line) && rec.NDays < MaxDays; pos += 8 {
+
+		j := rec.NDays
+		sval := strings.TrimLeft(line[pos:pos+5], " ")
+		v, err := strconv.ParseFloat(sval, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for day %d", line[pos:pos+5], j+1)
+		}
+
+		rec.Values[j] = v
+		rec.MFlag[j] = flagAt(line, pos+5)
+		rec.QFlag[j] = flagAt(line, pos+6)
+		rec.SFlag[j] = flagAt(line, pos+7)
+		rec.IsValid[j] = pol.Valid(v, rec.QFlag[j], rec.SFlag[j])
+		rec.NDays++
+	}
+	rec.clearDays()
+
+	return &rec, nil
+}
+
+// errNumber is returned by atoi for fields that are not integers.
+var errNumber = errors.New("not an integer")
+
+// atoi decodes a fixed width integer field, which may have leading
+// blanks and a minus sign.
+func atoi(b []byte) (int, error) {
+
+	i := 0
+	for i < len(b) && b[i] == ' ' {
+		i++
+	}
+
+	neg := false
+	if i < len(b) && b[i] == '-' {
+		neg = true
+		i++
+	}
+
+	if i == len(b) {
+		return 0, errNumber
+	}
+
+	n := 0
+	for ; i < len(b); i++ {
+		c := b[i]
+		if c < '0' || c > '9' {
+			return 0, errNumber
+		}
+		n = 10*n + int(c-'0')
+	}
+
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// flagAtBytes returns the byte at position pos of line, or a blank if
+// the line is too short.
+func flagAtBytes(line []byte, pos int) byte {
+	if pos < len(line) {
+		return line[pos]
+	}
+	return ' '
+}
+
+// ParseBytes parses one line of a raw data file into rec, which can be
+// reused from one line to the next.  The line is typically obtained
+// from bufio.Scanner.Bytes, it is not retained.  The validity of each
+// daily value is determined using pol.  An error is returned if the
+// line is malformed, in which case the contents of rec are undefined.
+//
+// Memory is only allocated when the station id changes, or for element
+// types that are not in Elements.
+func ParseBytes(line []byte, pol *Policy, rec *Record) error {
+
+	if len(line) < 21 {
+		return fmt.Errorf("line too short (%d characters)", len(line))
+	}
+
+	// The string conversions in the comparison and the map lookup
+	// do not allocate.
+	if rec.Id != string(line[0:11]) {
+		rec.Id = string(line[0:11])
+	}
+	if el, ok := Elements[string(line[17:21])]; ok {
+		rec.Element = el.Name
+	} else if rec.Element != string(line[17:21]) {
+		rec.Element = string(line[17:21])
+	}
+
+	var err error
+	rec.Year, err = atoi(line[11:15])
+	if err != nil {
+		return fmt.Errorf("invalid year %q", line[11:15])
+	}
+
+	rec.Month, err = atoi(line[15:17])
+	if err != nil || rec.Month < 1 || rec.Month > 12 {
+		return fmt.Errorf("invalid month %q", line[15:17])
+	}
+
+	// Each day occupies 8 characters: a 5 character value
+	// followed by the MFLAG, QFLAG and SFLAG characters.
+	rec.NDays = 0
+	for pos := 21; pos+5 <= len(line) && rec.NDays < MaxDays; pos += 8 {
+
+		j := rec.NDays
+		n, err := atoi(line[pos : pos+5])
+		if err != nil {
+			return fmt.Errorf("invalid value %q for day %d", line[pos:pos+5], j+1)
+		}
+
+		v := float64(n)
+		rec.Values[j] = v
+		rec.MFlag[j] = flagAtBytes(line, pos+5)
+		rec.QFlag[j] = flagAtBytes(line, pos+6)
+		rec.SFlag[j] = flagAtBytes(line, pos+7)
+		rec.IsValid[j] = pol.Valid(v, rec.QFlag[j], rec.SFlag[j])
+		rec.NDays++
+	}
+	rec.clearDays()
+
+	return nil
+}
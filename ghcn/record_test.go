@@ -0,0 +1,175 @@
+package ghcn
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testLines returns n lines in the format of the GHCN-Daily data
+// files, for one station and the elements TMAX, TMIN and PRCP, with a
+// mix of valid values, missing values and quality flags.
+func testLines(n int) [][]byte {
+
+	rng := rand.New(rand.NewSource(1))
+	elements := []string{"TMAX", "TMIN", "PRCP"}
+
+	var lines [][]byte
+	for i := 0; i < n; i++ {
+		m := i / len(elements)
+		var b strings.Builder
+		fmt.Fprintf(&b, "USW00094728%04d%02d%s", 1950+m/12, m%12+1, elements[i%len(elements)])
+		for j := 0; j < MaxDays; j++ {
+			v := rng.Intn(700) - 200
+			qflag := byte(' ')
+			switch r := rng.Intn(20); {
+			case r == 0:
+				v = Missing
+			case r == 1:
+				qflag = 'I'
+			}
+			fmt.Fprintf(&b, "%5d%c%c%c", v, ' ', qflag, '0')
+		}
+		lines = append(lines, []byte(b.String()))
+	}
+
+	return lines
+}
+
+func TestParseBytes(t *testing.T) {
+
+	pol := DefaultPolicy()
+	var rec Record
+	for i, line := range testLines(300) {
+		want, err := Parse(string(line), pol)
+		if err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		err = ParseBytes(line, pol, &rec)
+		if err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if rec != *want {
+			t.Fatalf("line %d: ParseBytes gives %+v, Parse gives %+v", i, rec, *want)
+		}
+	}
+}
+
+func TestParseBytesErrors(t *testing.T) {
+
+	pol := DefaultPolicy()
+	good := string(testLines(1)[0])
+
+	for _, line := range []string{
+		good[0:20],
+		good[0:11] + "19x0" + good[15:],
+		good[0:15] + "13" + good[17:],
+		good[0:21] + "  1a0" + good[26:],
+	} {
+		var rec Record
+		if ParseBytes([]byte(line), pol, &rec) == nil {
+			t.Errorf("no error for %q", line)
+		}
+		if _, err := Parse(line, pol); err == nil {
+			t.Errorf("Parse: no error for %q", line)
+		}
+	}
+}
+
+// The record and parser that the scripts used before Parse and
+// ParseBytes were written (gcos_monthly.go in the baseline), kept
+// verbatim as the baseline for the benchmarks.
+
+type lrec_t struct {
+	Id      string    // The station id
+	Year    int       // The year of the data point
+	Month   int       // The month of the data point (1..12)
+	Element string    // The data value type (TMAX or TMIN)
+	Values  []float64 // The daily values
+	IsValid []bool    // Validity flags for the data
+}
+
+func parse(line string) *lrec_t {
+
+	var rec lrec_t
+	var err error
+
+	rec.Id = line[0:11]
+
+	rec.Year, err = strconv.Atoi(line[11:15])
+	if err != nil {
+		panic(err)
+	}
+
+	rec.Month, err = strconv.Atoi(line[15:17])
+	if err != nil {
+		panic(err)
+	}
+
+	// Read all the daily temperature values.  See data format
+	// document for parsing details
+	for pos := 21; pos < len(line); pos += 8 {
+
+		// First check the quality flag
+		if line[pos+6] != ' ' {
+			rec.Values = append(rec.Values, 0)
+			rec.IsValid = append(rec.IsValid, false)
+			continue
+		}
+
+		sval := strings.TrimLeft(line[pos:pos+5], " ")
+		v, err := strconv.ParseFloat(sval, 64)
+		if err != nil {
+			panic(err)
+		}
+		rec.Values = append(rec.Values, v)
+		rec.IsValid = append(rec.IsValid, true)
+	}
+
+	return &rec
+}
+
+// BenchmarkParseBaseline times the original parser.  The conversion of
+// each line to a string is included, since bufio.Scanner.Text does
+// this.
+func BenchmarkParseBaseline(b *testing.B) {
+	lines := testLines(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parse(string(lines[i%len(lines)]))
+	}
+}
+
+// BenchmarkParse times Parse, which works on strings and uses strconv
+// to decode the values.
+func BenchmarkParse(b *testing.B) {
+	lines := testLines(1000)
+	pol := DefaultPolicy()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Parse(string(lines[i%len(lines)]), pol)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseBytes times the fixed width byte slice parser, which
+// reuses a single record.
+func BenchmarkParseBytes(b *testing.B) {
+	lines := testLines(1000)
+	pol := DefaultPolicy()
+	var rec Record
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := ParseBytes(lines[i%len(lines)], pol, &rec)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ghcn
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// LineError describes a malformed line in a data file.
+type LineError struct {
+	File string // The name of the data file
+	Line int    // The line number within the file (starting at 1)
+	Text string // The text of the line
+	Err  error  // The problem with the line
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// Report keeps track of the problems encountered while reading the
+// data files.  Malformed lines are skipped and counted, and optionally
+// written to a rejects file.  Files that cannot be read (e.g. because
+// of a gzip error) are recorded, and values that cannot be stored are
+// counted.  A Report can be used by several
+// goroutines at the same time.
+type Report struct {
+
+	// The largest acceptable fraction of rejected lines, or of
+	// files that could not be read
+	MaxErrorRate float64
+
+	// If not empty, rejected lines are written to this file
+	RejectsFile string
+
+	mu       sync.Mutex
+	nfiles   int
+	nlines   int
+	nreject  int
+	ndropped int
+	badFiles map[string]error
+	rejects  *bufio.Writer
+	rfid     *os.File
+}
+
+// DefaultMaxErrorRate is the MaxErrorRate of a new Report, which
+// accepts one malformed line in a thousand.
+const DefaultMaxErrorRate = 0.001
+
+// NewReport returns a Report that accepts DefaultMaxErrorRate.
+func NewReport() *Report {
+	return &Report{MaxErrorRate: DefaultMaxErrorRate, badFiles: make(map[string]error)}
+}
+
+// RegisterFlags defines the -max-error-rate and -rejects command line
+// flags that can be used to configure the report.
+func (r *Report) RegisterFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&r.MaxErrorRate, "max-error-rate", r.MaxErrorRate,
+		"Largest acceptable fraction of malformed lines or unreadable files")
+	fs.StringVar(&r.RejectsFile, "rejects", r.RejectsFile,
+		"Write the malformed lines to this file")
+}
+
+// Open creates the rejects file, if one has been requested.
+func (r *Report) Open() error {
+
+	if r.RejectsFile == "" {
+		return nil
+	}
+
+	var err error
+	r.rfid, err = os.Create(r.RejectsFile)
+	if err != nil {
+		return err
+	}
+	r.rejects = bufio.NewWriter(r.rfid)
+	fmt.Fprintf(r.rejects, "File\tLine\tError\tText\n")
+
+	return nil
+}
+
+// Close closes the rejects file, if one has been opened.
+func (r *Report) Close() error {
+
+	if r.rfid == nil {
+		return nil
+	}
+
+	if err := r.rejects.Flush(); err != nil {
+		r.rfid.Close()
+		return err
+	}
+
+	return r.rfid.Close()
+}
+
+// File records the result of reading one data file, which contained
+// nlines lines.  err is the error (if any) that prevented the file
+// from being read completely.
+func (r *Report) File(fname string, nlines int, err error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nfiles++
+	r.nlines += nlines
+	if err != nil {
+		r.badFiles[fname] = err
+	}
+}
+
+// Add adds nfiles files, with nlines lines of which nreject were
+// malformed, that were read in full by an earlier run, e.g. the run
+// that a resumed run continues.
+func (r *Report) Add(nfiles, nlines, nreject int) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nfiles += nfiles
+	r.nlines += nlines
+	r.nreject += nreject
+}
+
+// Reject records a malformed line.
+func (r *Report) Reject(e *LineError) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nreject++
+	if r.rejects != nil {
+		fmt.Fprintf(r.rejects, "%s\t%d\t%v\t%s\n", e.File, e.Line, e.Err, e.Text)
+	}
+}
+
+// Drop records n values that were read but could not be stored, e.g.
+// because they do not fit in the int16 values of a store, and were
+// stored as missing instead.
+func (r *Report) Drop(n int) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ndropped += n
+}
+
+// rates returns the fractions of rejected lines and of files that
+// could not be read.
+func (r *Report) rates() (float64, float64) {
+
+	var lrate, frate float64
+	if r.nlines > 0 {
+		lrate = float64(r.nreject) / float64(r.nlines)
+	}
+	if r.nfiles > 0 {
+		frate = float64(len(r.badFiles)) / float64(r.nfiles)
+	}
+
+	return lrate, frate
+}
+
+// Totals returns the number of lines read, the number of malformed
+// lines and the number of files that could not be read.
+func (r *Report) Totals() (nlines, nreject, nbad int) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.nlines, r.nreject, len(r.badFiles)
+}
+
+// Failed returns true if the fraction of rejected lines, or the
+// fraction of files that could not be read, exceeds MaxErrorRate.
+func (r *Report) Failed() bool {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lrate, frate := r.rates()
+	return lrate > r.MaxErrorRate || frate > r.MaxErrorRate
+}
+
+// Summary writes a summary of the problems to w.
+func (r *Report) Summary(w io.Writer) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lrate, frate := r.rates()
+	fmt.Fprintf(w, "Read %d lines from %d files\n", r.nlines, r.nfiles)
+	fmt.Fprintf(w, "Rejected %d malformed lines (%.4f%%)\n", r.nreject, 100*lrate)
+	fmt.Fprintf(w, "Could not read %d files (%.4f%%)\n", len(r.badFiles), 100*frate)
+	if r.ndropped > 0 {
+		fmt.Fprintf(w, "%d values did not fit the value type and were stored as missing\n", r.ndropped)
+	}
+
+	var names []string
+	for f := range r.badFiles {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	for _, f := range names {
+		fmt.Fprintf(w, "    %v\n", r.badFiles[f])
+	}
+
+	if r.RejectsFile != "" && r.nreject > 0 {
+		fmt.Fprintf(w, "The rejected lines are in %s\n", r.RejectsFile)
+	}
+}
@@ -0,0 +1,264 @@
+package ghcn
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Seasons are the names of the meteorological seasons, indexed by
+// Season.
+var Seasons = []string{"DJF", "MAM", "JJA", "SON"}
+
+// Season returns the season (an index into Seasons) of a calendar
+// month, and the year that the season is assigned to.  December is
+// assigned to the winter (DJF) of the following year.
+func Season(year, month int) (int, int) {
+	if month == 12 {
+		return 0, year + 1
+	}
+	return month / 3, year
+}
+
+// Period is the summary of the monthly values of one element for one
+// station over a season or a year.
+type Period struct {
+	Id       string  // The station id
+	Element  string  // The data value type (e.g. TMAX or PRCP)
+	Year     int     // The year that the period is assigned to
+	Period   string  // The season name (e.g. "DJF"), or "ANN" for annual values
+	Nmonths  int     // The number of complete months used
+	Value    float64 // The value for the period (mean, total or max)
+	Complete bool    // True if enough complete months are present
+	Anomaly  float64 // Summary of the monthly anomalies, if available
+}
+
+// PeriodHeader is the CSV header for the fields written by Period.CSV.
+const PeriodHeader = "Id,Element,Year,Period,Nmonths,Value,Complete"
+
+// CSV returns the fields of the summary in the order given by
+// PeriodHeader, formatted as comma separated values.  The Anomaly
+// field is not included.
+func (p *Period) CSV() string {
+
+	complete := 0
+	if p.Complete {
+		complete = 1
+	}
+
+	return fmt.Sprintf("%s,%s,%d,%s,%d,%s,%d", p.Id, p.Element, p.Year,
+		p.Period, p.Nmonths, FormatValue(p.Value), complete)
+}
+
+// periodKey identifies one seasonal or annual summary.
+type periodKey struct {
+	Id      string
+	Element string
+	Year    int
+	Period  string
+}
+
+// periodAcc accumulates the monthly values for one period.
+type periodAcc struct {
+	values    []float64
+	anomalies []float64
+}
+
+// Rollup combines monthly summaries into seasonal and annual
+// summaries.  The monthly values are combined using the aggregation
+// rule of the element, e.g. the seasonal value for PRCP is the total
+// of the monthly totals.  Anomalies are summed for elements that are
+// totals, and averaged otherwise, and the anomaly of a period is
+// missing unless all of its months have one.  Only complete months
+// are used.  The value and anomaly of a period that does not have
+// enough complete months are left missing, since e.g. the total of
+// some of the months of a season is not a seasonal total.
+type Rollup struct {
+
+	// The minimum number of complete months for a season to be
+	// complete
+	SeasonMin int
+
+	// The minimum number of complete months for a year to be
+	// complete
+	AnnualMin int
+
+	// If true, annual values are computed for water years
+	// (October through September, labeled by the year in which
+	// they end) rather than calendar years
+	WaterYear bool
+
+	// If true, periods that are not complete are not returned
+	Drop bool
+
+	seasons map[periodKey]*periodAcc
+	annual  map[periodKey]*periodAcc
+}
+
+// NewRollup returns a Rollup that requires all months to be complete
+// for a season or year to be complete.
+func NewRollup() *Rollup {
+	return &Rollup{
+		SeasonMin: 3,
+		AnnualMin: 12,
+		seasons:   make(map[periodKey]*periodAcc),
+		annual:    make(map[periodKey]*periodAcc),
+	}
+}
+
+// RegisterFlags defines command line flags that can be used to
+// configure the rollup.
+func (r *Rollup) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&r.SeasonMin, "season-min-months", r.SeasonMin,
+		"Minimum number of complete months for a complete season")
+	fs.IntVar(&r.AnnualMin, "annual-min-months", r.AnnualMin,
+		"Minimum number of complete months for a complete year")
+	fs.BoolVar(&r.WaterYear, "water-year", r.WaterYear,
+		"Use water years (October-September) instead of calendar years")
+	fs.BoolVar(&r.Drop, "drop-incomplete", r.Drop,
+		"Drop periods that are not complete instead of flagging them")
+}
+
+// add includes a monthly value in the accumulator for key k.
+func add(acc map[periodKey]*periodAcc, k periodKey, m *Month) {
+
+	a, ok := acc[k]
+	if !ok {
+		a = new(periodAcc)
+		acc[k] = a
+	}
+
+	if !m.Complete || math.IsNaN(m.Value) {
+		return
+	}
+
+	a.values = append(a.values, m.Value)
+	if !math.IsNaN(m.Anomaly) {
+		a.anomalies = append(a.anomalies, m.Anomaly)
+	}
+}
+
+// Add includes one monthly summary in the seasonal and annual
+// summaries.  Incomplete months are recorded, so that the
+// corresponding periods are reported, but their values are not used.
+func (r *Rollup) Add(m *Month) {
+
+	if m.Month < 1 || m.Month > 12 {
+		return
+	}
+
+	s, sy := Season(m.Year, m.Month)
+	add(r.seasons, periodKey{m.Id, m.Element, sy, Seasons[s]}, m)
+
+	ay := m.Year
+	if r.WaterYear && m.Month >= 10 {
+		ay++
+	}
+	add(r.annual, periodKey{m.Id, m.Element, ay, "ANN"}, m)
+}
+
+// combine aggregates the monthly values in x using the rule agg.
+func combine(x []float64, agg Agg) float64 {
+
+	if len(x) == 0 {
+		return math.NaN()
+	}
+
+	var v float64
+	switch agg {
+	case Mean, Total:
+		for _, y := range x {
+			v += y
+		}
+		if agg == Mean {
+			v /= float64(len(x))
+		}
+	case Max:
+		v = math.Inf(-1)
+		for _, y := range x {
+			v = math.Max(v, y)
+		}
+	}
+
+	return v
+}
+
+// results converts the accumulated values into sorted summaries.
+func (r *Rollup) results(acc map[periodKey]*periodAcc, nmin int, order func(string) int) []*Period {
+
+	var per []*Period
+	for k, a := range acc {
+
+		p := &Period{
+			Id:       k.Id,
+			Element:  k.Element,
+			Year:     k.Year,
+			Period:   k.Period,
+			Nmonths:  len(a.values),
+			Complete: len(a.values) >= nmin && len(a.values) > 0,
+			Value:    math.NaN(),
+			Anomaly:  math.NaN(),
+		}
+
+		if !p.Complete {
+			if !r.Drop {
+				per = append(per, p)
+			}
+			continue
+		}
+
+		agg := Mean
+		if el, ok := Elements[k.Element]; ok {
+			agg = el.Agg
+		}
+		p.Value = combine(a.values, agg)
+
+		// The anomaly of a period is only known if every month
+		// used has one, e.g. a total of some of the monthly
+		// anomalies is not a seasonal anomaly.
+		if len(a.anomalies) == len(a.values) {
+			if agg != Total {
+				agg = Mean
+			}
+			p.Anomaly = combine(a.anomalies, agg)
+		}
+
+		per = append(per, p)
+	}
+
+	sort.Slice(per, func(i, j int) bool {
+		a, b := per[i], per[j]
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		if a.Element != b.Element {
+			return a.Element < b.Element
+		}
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		return order(a.Period) < order(b.Period)
+	})
+
+	return per
+}
+
+// SeasonResults returns the seasonal summaries, sorted by station,
+// element, year and season.
+func (r *Rollup) SeasonResults() []*Period {
+	return r.results(r.seasons, r.SeasonMin, func(s string) int {
+		for i, t := range Seasons {
+			if s == t {
+				return i
+			}
+		}
+		return -1
+	})
+}
+
+// AnnualResults returns the annual summaries, sorted by station,
+// element and year.
+func (r *Rollup) AnnualResults() []*Period {
+	return r.results(r.annual, r.AnnualMin, func(string) int { return 0 })
+}
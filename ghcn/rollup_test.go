@@ -0,0 +1,181 @@
+package ghcn
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSeason(t *testing.T) {
+
+	for _, tc := range []struct {
+		year, month   int
+		season, syear int
+	}{
+		{1990, 12, 0, 1991},
+		{1991, 1, 0, 1991},
+		{1991, 2, 0, 1991},
+		{1991, 3, 1, 1991},
+		{1991, 5, 1, 1991},
+		{1991, 6, 2, 1991},
+		{1991, 8, 2, 1991},
+		{1991, 9, 3, 1991},
+		{1991, 11, 3, 1991},
+	} {
+		s, y := Season(tc.year, tc.month)
+		if s != tc.season || y != tc.syear {
+			t.Errorf("Season(%d, %d) is %s %d, expected %s %d", tc.year, tc.month,
+				Seasons[s], y, Seasons[tc.season], tc.syear)
+		}
+	}
+}
+
+// periodString formats the fields of a summary that are compared by
+// the tests, with missing values as empty strings.
+func periodString(p *Period) string {
+	return fmt.Sprintf("%s %d %s %d %s %v %s", p.Element, p.Year, p.Period, p.Nmonths,
+		FormatValue(p.Value), p.Complete, FormatValue(p.Anomaly))
+}
+
+func TestRollup(t *testing.T) {
+
+	nan := math.NaN()
+
+	// month returns a monthly summary of station USW00094728.
+	month := func(el string, year, mo int, value float64, complete bool, anomaly float64) *Month {
+		return &Month{Id: "USW00094728", Element: el, Year: year, Month: mo, Value: value,
+			Complete: complete, Anomaly: anomaly}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		setup   func(r *Rollup)
+		months  []*Month
+		seasons []string
+		annual  []string
+	}{
+		{
+			// December is in the winter of the next year.
+			name: "winter",
+			months: []*Month{
+				month("TMAX", 1990, 12, 1, true, 1),
+				month("TMAX", 1991, 1, 2, true, 2),
+				month("TMAX", 1991, 2, 6, true, 3),
+			},
+			seasons: []string{"TMAX 1991 DJF 3 3.000 true 2.000"},
+			annual: []string{
+				"TMAX 1990 ANN 1  false ",
+				"TMAX 1991 ANN 2  false ",
+			},
+		},
+		{
+			// Totals are summed, the anomaly is missing if a
+			// month has none.
+			name: "totals",
+			months: []*Month{
+				month("PRCP", 1990, 3, 10, true, 1),
+				month("PRCP", 1990, 4, 20, true, nan),
+				month("PRCP", 1990, 5, 30, true, 2),
+				month("PRCP", 1990, 6, 1, true, 1),
+				month("PRCP", 1990, 7, 2, true, 1),
+				month("PRCP", 1990, 8, 3, true, -1),
+			},
+			seasons: []string{
+				"PRCP 1990 MAM 3 60.000 true ",
+				"PRCP 1990 JJA 3 6.000 true 1.000",
+			},
+			annual: []string{"PRCP 1990 ANN 6  false "},
+		},
+		{
+			// A mean of the anomalies of some of the months is
+			// not the anomaly of the season either.
+			name: "partial anomalies",
+			months: []*Month{
+				month("TMIN", 1990, 3, 1, true, nan),
+				month("TMIN", 1990, 4, 2, true, 1),
+				month("TMIN", 1990, 5, 3, true, 2),
+			},
+			seasons: []string{"TMIN 1990 MAM 3 2.000 true "},
+			annual:  []string{"TMIN 1990 ANN 3  false "},
+		},
+		{
+			// Incomplete months and months without a value are
+			// not used.
+			name:  "minimum months",
+			setup: func(r *Rollup) { r.SeasonMin = 2 },
+			months: []*Month{
+				month("TMAX", 1990, 9, 10, true, nan),
+				month("TMAX", 1990, 10, 100, false, nan),
+				month("TMAX", 1990, 11, 20, true, nan),
+				month("TMAX", 1990, 12, 0, true, nan),
+				month("TMAX", 1991, 1, nan, true, nan),
+				month("TMAX", 1991, 2, 0, false, nan),
+			},
+			seasons: []string{
+				"TMAX 1990 SON 2 15.000 true ",
+				"TMAX 1991 DJF 1  false ",
+			},
+			annual: []string{
+				"TMAX 1990 ANN 3  false ",
+				"TMAX 1991 ANN 0  false ",
+			},
+		},
+		{
+			// Water years end in September.
+			name: "water year",
+			setup: func(r *Rollup) {
+				r.WaterYear = true
+				r.AnnualMin = 2
+			},
+			months: []*Month{
+				month("SNWD", 1990, 9, 5, true, nan),
+				month("SNWD", 1990, 10, 9, true, nan),
+				month("SNWD", 1990, 11, 7, true, nan),
+			},
+			seasons: []string{
+				"SNWD 1990 SON 3 9.000 true ",
+			},
+			annual: []string{
+				"SNWD 1990 ANN 1  false ",
+				"SNWD 1991 ANN 2 9.000 true ",
+			},
+		},
+		{
+			name:  "drop",
+			setup: func(r *Rollup) { r.Drop = true },
+			months: []*Month{
+				month("TMAX", 1990, 3, 1, true, nan),
+				month("TMAX", 1990, 4, 2, true, nan),
+				month("TMAX", 1990, 5, 3, true, nan),
+				month("TMAX", 1990, 6, 3, true, nan),
+			},
+			seasons: []string{"TMAX 1990 MAM 3 2.000 true "},
+		},
+	} {
+		r := NewRollup()
+		if tc.setup != nil {
+			tc.setup(r)
+		}
+		for _, m := range tc.months {
+			r.Add(m)
+		}
+
+		for _, res := range []struct {
+			name string
+			per  []*Period
+			want []string
+		}{
+			{"seasons", r.SeasonResults(), tc.seasons},
+			{"annual", r.AnnualResults(), tc.annual},
+		} {
+			var got []string
+			for _, p := range res.per {
+				got = append(got, periodString(p))
+			}
+			if !reflect.DeepEqual(got, res.want) {
+				t.Errorf("%s: %s are\n%q\nexpected\n%q", tc.name, res.name, got, res.want)
+			}
+		}
+	}
+}
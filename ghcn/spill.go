@@ -0,0 +1,234 @@
+package ghcn
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// This file contains a spill manager, which holds in-memory buffers
+// for many keys (e.g. the partitions of a columnized store) under one
+// memory budget.  When the budget is reached, buffers are written out
+// (spilled) until the buffers use at most half of the budget, either
+// largest first or oldest first.
+
+// The orders in which the Spiller chooses the buffers to spill.
+const (
+	SpillLargest = "largest" // The buffers holding the most data
+	SpillOldest  = "oldest"  // The buffers whose data were added first
+)
+
+// Spiller holds buffered data for a set of keys, and writes the data
+// for a key with its write function when the memory used by all the
+// buffers exceeds the budget, or when asked to.  A Spiller is safe for
+// concurrent use, the write function is called by one goroutine at a
+// time.
+type Spiller struct {
+	mu sync.Mutex
+
+	budget int
+	order  string
+	write  func(key string, data []byte) error
+
+	bufs map[string]*spillBuf
+	used int
+	seq  int64
+
+	// The number of buffers that were spilled because the budget was
+	// reached, and the number of bytes that they held
+	Spills     int
+	SpillBytes int64
+
+	// The number of buffers that were written by Flush or FlushAll,
+	// and the number of bytes that they held
+	Flushes    int
+	FlushBytes int64
+
+	// The largest amount of memory used by the buffers, in bytes
+	Peak int
+}
+
+// spillBuf is the buffer for one key.
+type spillBuf struct {
+	key  string
+	data []byte
+
+	// Orders the buffers by the time at which their oldest data were
+	// added
+	seq int64
+}
+
+// NewSpiller returns a Spiller that holds at most budget bytes in its
+// buffers, and chooses the buffers to spill in the given order
+// (SpillLargest or SpillOldest).  The data for a key are passed to
+// write, which typically appends them to a file for the key.
+func NewSpiller(budget int, order string, write func(key string, data []byte) error) (*Spiller, error) {
+
+	if order != SpillLargest && order != SpillOldest {
+		return nil, fmt.Errorf("unknown spill order %q", order)
+	}
+	if budget < 1 {
+		return nil, fmt.Errorf("invalid memory budget %d", budget)
+	}
+
+	return &Spiller{budget: budget, order: order, write: write, bufs: make(map[string]*spillBuf)}, nil
+}
+
+// Add appends a copy of data to the buffer for key, and spills
+// buffers if the budget is exceeded.
+func (s *Spiller) Add(key string, data []byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.bufs[key]
+	if b == nil {
+		b = &spillBuf{key: key}
+		s.bufs[key] = b
+	}
+	if len(b.data) == 0 {
+		s.seq++
+		b.seq = s.seq
+	}
+
+	// The memory in use is the capacity of the buffers, which grows
+	// ahead of their contents.
+	c := cap(b.data)
+	b.data = append(b.data, data...)
+	s.used += cap(b.data) - c
+	if s.used > s.Peak {
+		s.Peak = s.used
+	}
+
+	if s.used > s.budget {
+		return s.spill()
+	}
+
+	return nil
+}
+
+// spill writes out buffers, in the order of the Spiller, until at most
+// half of the budget is used.
+func (s *Spiller) spill() error {
+
+	var bufs []*spillBuf
+	for _, b := range s.bufs {
+		if cap(b.data) > 0 {
+			bufs = append(bufs, b)
+		}
+	}
+
+	if s.order == SpillLargest {
+		sort.Slice(bufs, func(i, j int) bool {
+			if len(bufs[i].data) != len(bufs[j].data) {
+				return len(bufs[i].data) > len(bufs[j].data)
+			}
+			return bufs[i].seq < bufs[j].seq
+		})
+	} else {
+		sort.Slice(bufs, func(i, j int) bool {
+			return bufs[i].seq < bufs[j].seq
+		})
+	}
+
+	for _, b := range bufs {
+		if s.used <= s.budget/2 {
+			break
+		}
+		n := len(b.data)
+		err := s.release(b)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			s.Spills++
+			s.SpillBytes += int64(n)
+		}
+	}
+
+	return nil
+}
+
+// release writes out the data in a buffer, and frees its memory.
+func (s *Spiller) release(b *spillBuf) error {
+
+	if len(b.data) > 0 {
+		err := s.write(b.key, b.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.used -= cap(b.data)
+	b.data = nil
+
+	return nil
+}
+
+// Flush writes out the data buffered for key.
+func (s *Spiller) Flush(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(key)
+}
+
+func (s *Spiller) flush(key string) error {
+
+	b := s.bufs[key]
+	if b == nil {
+		return nil
+	}
+
+	n := len(b.data)
+	err := s.release(b)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.Flushes++
+		s.FlushBytes += int64(n)
+	}
+
+	return nil
+}
+
+// FlushAll writes out the data buffered for all keys.
+func (s *Spiller) FlushAll() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.bufs))
+	for key := range s.bufs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err := s.flush(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Used returns the memory used by the buffers, in bytes.
+func (s *Spiller) Used() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Summary writes a summary of the spills and flushes to w.
+func (s *Spiller) Summary(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mb := func(n int64) float64 { return float64(n) / (1 << 20) }
+	fmt.Fprintf(w, "Spilled %d buffers (%.1f MB) when the memory budget of %.1f MB was reached\n",
+		s.Spills, mb(s.SpillBytes), mb(int64(s.budget)))
+	fmt.Fprintf(w, "Flushed %d buffers (%.1f MB)\n", s.Flushes, mb(s.FlushBytes))
+	fmt.Fprintf(w, "The buffers used at most %.1f MB\n", mb(int64(s.Peak)))
+}
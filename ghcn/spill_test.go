@@ -0,0 +1,137 @@
+package ghcn
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// spillLog records the writes of a Spiller.
+type spillLog struct {
+	keys []string
+	data map[string][]byte
+}
+
+func (l *spillLog) write(key string, data []byte) error {
+	l.keys = append(l.keys, key)
+	l.data[key] = append(l.data[key], data...)
+	return nil
+}
+
+func TestSpiller(t *testing.T) {
+
+	// Each add appends n bytes to the buffer of a key.  The sizes are
+	// those of allocation size classes, so that the capacity of the
+	// buffers is the same as their length.
+	type add struct {
+		key string
+		n   int
+	}
+
+	for _, tc := range []struct {
+		name   string
+		budget int
+		order  string
+		adds   []add
+		spills []string // The keys that are spilled, in order
+	}{
+		{
+			name:   "under budget",
+			budget: 100,
+			order:  SpillLargest,
+			adds:   []add{{"a", 16}, {"b", 32}, {"a", 16}},
+		},
+		{
+			name:   "largest",
+			budget: 100,
+			order:  SpillLargest,
+			adds:   []add{{"a", 16}, {"b", 48}, {"c", 32}, {"d", 32}},
+			spills: []string{"b", "c"},
+		},
+		{
+			name:   "largest, ties by age",
+			budget: 100,
+			order:  SpillLargest,
+			adds:   []add{{"a", 32}, {"b", 32}, {"c", 32}, {"d", 32}},
+			spills: []string{"a", "b", "c"},
+		},
+		{
+			name:   "oldest",
+			budget: 100,
+			order:  SpillOldest,
+			adds:   []add{{"a", 16}, {"b", 48}, {"c", 32}, {"d", 32}},
+			spills: []string{"a", "b", "c"},
+		},
+		{
+			// The age of a buffer is the time at which its
+			// oldest data were added, so a spilled buffer is new
+			// again.
+			name:   "oldest after spill",
+			budget: 100,
+			order:  SpillOldest,
+			adds:   []add{{"a", 64}, {"b", 32}, {"a", 8}, {"a", 16}, {"c", 16}, {"d", 48}},
+			spills: []string{"a", "b", "a", "c"},
+		},
+	} {
+		log := &spillLog{data: make(map[string][]byte)}
+		s, err := NewSpiller(tc.budget, tc.order, log.write)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make(map[string][]byte)
+		for i, a := range tc.adds {
+			data := bytes.Repeat([]byte{byte(i)}, a.n)
+			want[a.key] = append(want[a.key], data...)
+
+			// The memory in use is the capacity of the buffers,
+			// which must not stay over the budget.
+			err = s.Add(a.key, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Used() > tc.budget {
+				t.Errorf("%s: %d bytes used after add %d", tc.name, s.Used(), i)
+			}
+		}
+		if !reflect.DeepEqual(log.keys, tc.spills) {
+			t.Errorf("%s: spilled %v, expected %v", tc.name, log.keys, tc.spills)
+		}
+		if s.Spills != len(tc.spills) {
+			t.Errorf("%s: Spills is %d, expected %d", tc.name, s.Spills, len(tc.spills))
+		}
+		if s.Peak <= tc.budget && len(tc.spills) > 0 {
+			t.Errorf("%s: Peak is %d", tc.name, s.Peak)
+		}
+
+		err = s.FlushAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Used() != 0 {
+			t.Errorf("%s: %d bytes used after FlushAll", tc.name, s.Used())
+		}
+		if !reflect.DeepEqual(log.data, want) {
+			t.Errorf("%s: the data written differ from the data added", tc.name)
+		}
+		var n int64
+		for _, a := range tc.adds {
+			n += int64(a.n)
+		}
+		if s.SpillBytes+s.FlushBytes != n {
+			t.Errorf("%s: %d bytes spilled and %d flushed, expected %d in all",
+				tc.name, s.SpillBytes, s.FlushBytes, n)
+		}
+	}
+}
+
+func TestSpillerErrors(t *testing.T) {
+
+	write := func(key string, data []byte) error { return nil }
+	if _, err := NewSpiller(100, "newest", write); err == nil {
+		t.Errorf("no error for an unknown order")
+	}
+	if _, err := NewSpiller(0, SpillLargest, write); err == nil {
+		t.Errorf("no error for a zero budget")
+	}
+}
@@ -0,0 +1,198 @@
+package ghcn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Station contains the metadata for one station, obtained from the
+// ghcnd-stations.txt and ghcnd-inventory.txt files.  These files are
+// available in the same location as the data files, the formats are
+// described in the data format readme.
+type Station struct {
+	Id        string  // The station id
+	Country   string  // The FIPS country code (first two characters of Id)
+	State     string  // The U.S. postal code for the state (U.S. and Canadian stations only)
+	Name      string  // The name of the station
+	Latitude  float64 // Latitude of the station, in decimal degrees
+	Longitude float64 // Longitude of the station, in decimal degrees
+	Elevation float64 // Elevation of the station, in meters (-999.9 if missing)
+	GSN       bool    // True if the station is part of the GCOS Surface Network
+	HCN       string  // "HCN" or "CRN" if the station is part of these networks
+	WMO       string  // The WMO number of the station, if any
+
+	// The first and last years with data for each element type,
+	// from the inventory file
+	Inventory map[string][2]int
+}
+
+// StationHeader is the CSV header for the fields written by
+// Station.CSV.
+const StationHeader = "Name,Country,State,Latitude,Longitude,Elevation,GSN,HCN"
+
+// field returns the trimmed text in columns first..last of a fixed
+// width line, using the 1-based inclusive column numbers from the
+// format readme.
+func field(line string, first, last int) string {
+	if first > len(line) {
+		return ""
+	}
+	if last > len(line) {
+		last = len(line)
+	}
+	return strings.TrimSpace(line[first-1 : last])
+}
+
+// floatField parses a numeric fixed width field.
+func floatField(line string, first, last int) (float64, error) {
+	return strconv.ParseFloat(field(line, first, last), 64)
+}
+
+// ReadStations reads the fixed width station file
+// (ghcnd-stations.txt) and returns a map from station id to the
+// station metadata.
+func ReadStations(r io.Reader) (map[string]*Station, error) {
+
+	stations := make(map[string]*Station)
+	scanner := bufio.NewScanner(r)
+	lnum := 0
+
+	for scanner.Scan() {
+
+		line := scanner.Text()
+		lnum++
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if len(line) < 71 {
+			return nil, fmt.Errorf("stations line %d: line too short", lnum)
+		}
+
+		st := &Station{
+			Id:        line[0:11],
+			Country:   line[0:2],
+			State:     field(line, 39, 40),
+			Name:      field(line, 42, 71),
+			GSN:       field(line, 73, 75) == "GSN",
+			HCN:       field(line, 77, 79),
+			WMO:       field(line, 81, 85),
+			Inventory: make(map[string][2]int),
+		}
+
+		var err error
+		st.Latitude, err = floatField(line, 13, 20)
+		if err != nil {
+			return nil, fmt.Errorf("stations line %d: %v", lnum, err)
+		}
+		st.Longitude, err = floatField(line, 22, 30)
+		if err != nil {
+			return nil, fmt.Errorf("stations line %d: %v", lnum, err)
+		}
+		st.Elevation, err = floatField(line, 32, 37)
+		if err != nil {
+			return nil, fmt.Errorf("stations line %d: %v", lnum, err)
+		}
+
+		stations[st.Id] = st
+	}
+
+	return stations, scanner.Err()
+}
+
+// ReadInventory reads the fixed width inventory file
+// (ghcnd-inventory.txt) and records the period of record for each
+// element in the Inventory field of the stations.  Inventory lines
+// for stations that are not in the map are ignored.
+func ReadInventory(r io.Reader, stations map[string]*Station) error {
+
+	scanner := bufio.NewScanner(r)
+	lnum := 0
+
+	for scanner.Scan() {
+
+		line := scanner.Text()
+		lnum++
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if len(line) < 45 {
+			return fmt.Errorf("inventory line %d: line too short", lnum)
+		}
+
+		st, ok := stations[line[0:11]]
+		if !ok {
+			continue
+		}
+
+		first, err := strconv.Atoi(field(line, 37, 40))
+		if err != nil {
+			return fmt.Errorf("inventory line %d: %v", lnum, err)
+		}
+		last, err := strconv.Atoi(field(line, 42, 45))
+		if err != nil {
+			return fmt.Errorf("inventory line %d: %v", lnum, err)
+		}
+
+		st.Inventory[field(line, 32, 35)] = [2]int{first, last}
+	}
+
+	return scanner.Err()
+}
+
+// LoadStations reads ghcnd-stations.txt and ghcnd-inventory.txt from
+// the directory dir.  The inventory file is optional.
+func LoadStations(dir string) (map[string]*Station, error) {
+
+	fid, err := os.Open(path.Join(dir, "ghcnd-stations.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	stations, err := ReadStations(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	fid, err = os.Open(path.Join(dir, "ghcnd-inventory.txt"))
+	if os.IsNotExist(err) {
+		return stations, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	err = ReadInventory(fid, stations)
+	if err != nil {
+		return nil, err
+	}
+
+	return stations, nil
+}
+
+// CSV returns the metadata fields of the station in the order given
+// by StationHeader, formatted as comma separated values.
+func (st *Station) CSV() string {
+
+	if st == nil {
+		return ",,,,,,,"
+	}
+
+	name := st.Name
+	if strings.ContainsAny(name, ",\"") {
+		name = "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+	}
+
+	gsn := ""
+	if st.GSN {
+		gsn = "GSN"
+	}
+
+	return fmt.Sprintf("%s,%s,%s,%.4f,%.4f,%.1f,%s,%s", name, st.Country,
+		st.State, st.Latitude, st.Longitude, st.Elevation, gsn, st.HCN)
+}
@@ -0,0 +1,90 @@
+package ghcn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The lines of ghcnd-stations.txt for the test stations
+const testStations = `USW00094728  40.7789  -73.9692   39.6 NY NEW YORK CNTRL PK TWR              HCN 72506
+CA006158355  43.6667  -79.4000  112.5 ON TORONTO, CITY                  GSN     71508
+
+ASN00086071 -37.8075  144.9700   31.2    MELBOURNE REGIONAL OFFICE      GSN     94868
+`
+
+// The lines of ghcnd-inventory.txt for the test stations, and for a
+// station that is not in the station file
+const testInventory = `USW00094728  40.7789  -73.9692 TMAX 1869 2020
+USW00094728  40.7789  -73.9692 PRCP 1869 2020
+CA006158355  43.6667  -79.4000 TMAX 1840 2017
+CA006158355  43.6667  -79.4000 SNOW 1960 2017
+ASN00086071 -37.8075  144.9700 TMAX 1855 2015
+USC00305801  40.7794  -73.9697 TMAX 1876 1919
+`
+
+func TestReadStations(t *testing.T) {
+
+	stations, err := ReadStations(strings.NewReader(testStations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReadInventory(strings.NewReader(testInventory), stations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*Station{
+		"USW00094728": {Id: "USW00094728", Country: "US", State: "NY", Name: "NEW YORK CNTRL PK TWR",
+			Latitude: 40.7789, Longitude: -73.9692, Elevation: 39.6, HCN: "HCN", WMO: "72506",
+			Inventory: map[string][2]int{"TMAX": {1869, 2020}, "PRCP": {1869, 2020}}},
+		"CA006158355": {Id: "CA006158355", Country: "CA", State: "ON", Name: "TORONTO, CITY",
+			Latitude: 43.6667, Longitude: -79.4, Elevation: 112.5, GSN: true, WMO: "71508",
+			Inventory: map[string][2]int{"TMAX": {1840, 2017}, "SNOW": {1960, 2017}}},
+		"ASN00086071": {Id: "ASN00086071", Country: "AS", Name: "MELBOURNE REGIONAL OFFICE",
+			Latitude: -37.8075, Longitude: 144.97, Elevation: 31.2, GSN: true, WMO: "94868",
+			Inventory: map[string][2]int{"TMAX": {1855, 2015}}},
+	}
+	if len(stations) != len(want) {
+		t.Errorf("read %d stations, expected %d", len(stations), len(want))
+	}
+	for id, w := range want {
+		if st := stations[id]; !reflect.DeepEqual(st, w) {
+			t.Errorf("%s is\n%+v\nexpected\n%+v", id, st, w)
+		}
+	}
+
+	for _, tc := range []struct {
+		id  string
+		csv string
+	}{
+		{"USW00094728", "NEW YORK CNTRL PK TWR,US,NY,40.7789,-73.9692,39.6,,HCN"},
+		{"CA006158355", "\"TORONTO, CITY\",CA,ON,43.6667,-79.4000,112.5,GSN,"},
+		{"XXX00000000", ",,,,,,,"},
+	} {
+		if csv := stations[tc.id].CSV(); csv != tc.csv {
+			t.Errorf("%s: CSV is %s, expected %s", tc.id, csv, tc.csv)
+		}
+	}
+}
+
+func TestReadStationsErrors(t *testing.T) {
+
+	for _, tc := range []struct {
+		name, stations, inventory string
+	}{
+		{"short station line", "USW00094728  40.7789  -73.9692   39.6 NY NEW YORK\n", ""},
+		{"bad latitude", "USW00094728  40.77x9  -73.9692   39.6 NY NEW YORK CNTRL PK TWR              HCN 72506\n", ""},
+		{"bad elevation", "USW00094728  40.7789  -73.9692   ---- NY NEW YORK CNTRL PK TWR              HCN 72506\n", ""},
+		{"short inventory line", testStations, "USW00094728  40.7789  -73.9692 TMAX 1869\n"},
+		{"bad year", testStations, "USW00094728  40.7789  -73.9692 TMAX 18x9 2020\n"},
+	} {
+		stations, err := ReadStations(strings.NewReader(tc.stations))
+		if err == nil && tc.inventory != "" {
+			err = ReadInventory(strings.NewReader(tc.inventory), stations)
+		}
+		if err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("%s: the error is %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ghcn
+
+import "math"
+
+// This file contains the distribution functions needed for the trend
+// tests.
+
+// normCDF returns the standard normal cumulative distribution function
+// at x.
+func normCDF(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+// normQuantile returns the standard normal quantile function at p.
+func normQuantile(p float64) float64 {
+	return -math.Sqrt2 * math.Erfcinv(2*p)
+}
+
+// betacf evaluates the continued fraction for the incomplete beta
+// function by the modified Lentz method (Numerical Recipes, 6.4).
+func betacf(a, b, x float64) float64 {
+
+	const (
+		maxit = 300
+		eps   = 1e-14
+		fpmin = 1e-300
+	)
+
+	qab := a + b
+	qap := a + 1
+	qam := a - 1
+	c := 1.0
+	d := 1 - qab*x/qap
+	if math.Abs(d) < fpmin {
+		d = fpmin
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= maxit; m++ {
+		fm := float64(m)
+		m2 := 2 * fm
+		aa := fm * (b - fm) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < fpmin {
+			d = fpmin
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < fpmin {
+			c = fpmin
+		}
+		d = 1 / d
+		h *= d * c
+		aa = -(a + fm) * (qab + fm) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < fpmin {
+			d = fpmin
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < fpmin {
+			c = fpmin
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+
+	return h
+}
+
+// betaInc returns the regularized incomplete beta function I_x(a, b).
+func betaInc(a, b, x float64) float64 {
+
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	la, _ := math.Lgamma(a + b)
+	lb, _ := math.Lgamma(a)
+	lc, _ := math.Lgamma(b)
+	bt := math.Exp(la - lb - lc + a*math.Log(x) + b*math.Log(1-x))
+
+	if x < (a+1)/(a+b+2) {
+		return bt * betacf(a, b, x) / a
+	}
+	return 1 - bt*betacf(b, a, 1-x)/b
+}
+
+// tCDF returns the cumulative distribution function of the Student t
+// distribution with df degrees of freedom at t.
+func tCDF(t, df float64) float64 {
+
+	// p is the probability of a value above |t|.  Near zero, 1 - x
+	// cannot be found accurately from x, and the complement is used.
+	var p float64
+	if x := t * t / (df + t*t); x < 0.5 {
+		p = 0.5 * (1 - betaInc(0.5, df/2, x))
+	} else {
+		p = 0.5 * betaInc(df/2, 0.5, df/(df+t*t))
+	}
+	if t > 0 {
+		return 1 - p
+	}
+	return p
+}
+
+// tQuantile returns the quantile function of the Student t
+// distribution with df degrees of freedom at p, found by bisection.
+func tQuantile(p, df float64) float64 {
+
+	lo, hi := -1.0, 1.0
+	for tCDF(lo, df) > p {
+		lo *= 2
+	}
+	for tCDF(hi, df) < p {
+		hi *= 2
+	}
+
+	for i := 0; i < 200 && hi-lo > 1e-12; i++ {
+		mid := (lo + hi) / 2
+		if tCDF(mid, df) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return (lo + hi) / 2
+}
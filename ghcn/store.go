@@ -0,0 +1,725 @@
+package ghcn
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains a reader for the columnized data written by
+// gcos_columnize.go.  The data are divided into partitions (by year
+// unless the layout file says otherwise, see partition.go), each in
+// its own directory containing aligned column files.  Both column
+// file layouts described in colfile.go can be read.  If a partition
+// has statistics (see colstats.go), the partition and the blocks
+// within it that cannot contain rows that pass the filter are skipped
+// without being decompressed.
+
+// Row is one observation in the columnized store.  In a store of
+// several elements (see Store.Elements), a row holds the values of all
+// elements for one station and date, Value is the value of the
+// element selected by Filter.Element (NaN if no element is selected),
+// and the Values and Valid slices are only valid until the next row
+// is read.
+type Row struct {
+	Id     string    // The station id
+	Date   Date      // The date of the observation
+	Value  float64   // The data value
+	Values []float64 // The value of each element
+	Valid  []bool    // Whether each element is present
+}
+
+// Columns contains aligned columns for a set of observations.
+type Columns struct {
+	Ids    []string
+	Dates  []Date
+	Values []float64
+}
+
+// Len returns the number of observations.
+func (c *Columns) Len() int {
+	return len(c.Ids)
+}
+
+// Append adds one observation to the columns.
+func (c *Columns) Append(r Row) {
+	c.Ids = append(c.Ids, r.Id)
+	c.Dates = append(c.Dates, r.Date)
+	c.Values = append(c.Values, r.Value)
+}
+
+// Filter selects observations from the columnized store.  The zero
+// value selects all observations.
+type Filter struct {
+
+	// The station ids to keep, all stations are kept if empty
+	Ids []string
+
+	// The first and last dates (inclusive) to keep, a zero time
+	// means that the dates are not restricted in that direction
+	From, To time.Time
+
+	// The prefix of the station ids to keep, e.g. a country code
+	// such as "US", all stations are kept if empty
+	Prefix string
+
+	// If not nil, only the values greater than *Above and less than
+	// *Below are kept
+	Above, Below *float64
+
+	// In a store of several elements, the element whose value is
+	// returned in Row.Value.  If not empty, only the rows in which
+	// this element is present are kept, otherwise all rows are kept.
+	// Above and Below can only be used if Element is set.
+	Element string
+}
+
+// compiled returns a predicate for the rows in years first..last
+// that pass the filter, a predicate for the partitions (of a store
+// partitioned by p) that may contain such rows, and a predicate for
+// the partitions and blocks whose statistics show that they may
+// contain such rows.  In a store of several elements, elem is the
+// position of Filter.Element, or -1 if no element is selected.
+func (f *Filter) compiled(p Partitioning, first, last, elem int) (func(*Row) bool, func(string) bool,
+	func(*ColumnStats) bool) {
+
+	if f == nil {
+		f = &Filter{}
+	}
+
+	var ids map[string]bool
+	if len(f.Ids) > 0 {
+		ids = make(map[string]bool)
+		for _, id := range f.Ids {
+			ids[id] = true
+		}
+	}
+
+	if !f.From.IsZero() && f.From.Year() > first {
+		first = f.From.Year()
+	}
+	if !f.To.IsZero() && f.To.Year() < last {
+		last = f.To.Year()
+	}
+
+	from, to := NewDate(first, 1, 1), NewDate(last, 12, 31)
+	if !f.From.IsZero() && DateOf(f.From) > from {
+		from = DateOf(f.From)
+	}
+	if !f.To.IsZero() && DateOf(f.To) < to {
+		to = DateOf(f.To)
+	}
+
+	row := func(r *Row) bool {
+		if ids != nil && !ids[r.Id] {
+			return false
+		}
+		if f.Prefix != "" && !strings.HasPrefix(r.Id, f.Prefix) {
+			return false
+		}
+		if elem >= 0 && elem < len(r.Valid) && !r.Valid[elem] {
+			return false
+		}
+		if f.Above != nil && !(r.Value > *f.Above) {
+			return false
+		}
+		if f.Below != nil && !(r.Value < *f.Below) {
+			return false
+		}
+		return r.Date >= from && r.Date <= to
+	}
+
+	part := func(key string) bool {
+		return p.Keep(key, ids, f.Prefix, first, last)
+	}
+
+	stats := func(s *ColumnStats) bool {
+		if s.Rows == 0 || s.Date.Max < from || s.Date.Min > to {
+			return false
+		}
+		if ids != nil && !s.Id.contains(ids) {
+			return false
+		}
+		if f.Prefix != "" && !s.Id.hasPrefix(f.Prefix) {
+			return false
+		}
+		vs := &s.Value
+		if elem >= 0 {
+			if elem >= len(s.Values) {
+				return true
+			}
+			vs = &s.Values[elem]
+			if vs.Count == 0 {
+				return false
+			}
+		}
+		if (f.Above != nil || f.Below != nil) && vs.Count == 0 {
+			return false
+		}
+		if f.Above != nil && vs.Max <= *f.Above {
+			return false
+		}
+		if f.Below != nil && vs.Min >= *f.Below {
+			return false
+		}
+		return true
+	}
+
+	return row, part, stats
+}
+
+// Store is a columnized data set on disk.
+type Store struct {
+	dir    string
+	layout *Layout
+	parts  Partitioning
+	keys   []string
+}
+
+// OpenStore opens the columnized data in directory dir.  The layout
+// file (see Layout) determines how the partitions are pruned when
+// the store is read.
+func OpenStore(dir string) (*Store, error) {
+
+	layout, err := ReadLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := ParsePartitioning(layout.Partitioning)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, layout: layout, parts: parts}
+	for _, di := range dirs {
+		if di.IsDir() {
+			s.keys = append(s.keys, di.Name())
+		}
+	}
+	sort.Strings(s.keys)
+
+	// Stores written before the layout file was introduced are
+	// partitioned by year, and the years are the directory names.
+	if layout.Years == nil {
+		for _, k := range s.keys {
+			if year, err := strconv.Atoi(k); err == nil {
+				layout.Years = append(layout.Years, year)
+			}
+		}
+		sort.Ints(layout.Years)
+	}
+
+	return s, nil
+}
+
+// Years returns the years that have data in the store, in increasing
+// order.
+func (s *Store) Years() []int {
+	return s.layout.Years
+}
+
+// Partitioning returns the partitioning of the store.
+func (s *Store) Partitioning() Partitioning {
+	return s.parts
+}
+
+// Elements returns the elements of a store of several elements, in the
+// order of Row.Values, and nil for a store of one element.
+func (s *Store) Elements() []string {
+	return s.layout.Elements
+}
+
+// Read returns the observations for the years first..last (inclusive)
+// that pass the filter, which may be nil.
+func (s *Store) Read(first, last int, f *Filter) (*Columns, error) {
+
+	sc := s.Scan(first, last, f)
+	defer sc.Close()
+
+	c := new(Columns)
+	for sc.Next() {
+		c.Append(sc.Row())
+	}
+
+	return c, sc.Err()
+}
+
+// ReadYear returns the observations for one year that pass the filter,
+// which may be nil.
+func (s *Store) ReadYear(year int, f *Filter) (*Columns, error) {
+	return s.Read(year, year, f)
+}
+
+// Scan returns a Scanner that streams the observations for the years
+// first..last (inclusive) that pass the filter, which may be nil.
+// Partitions, and blocks within partitions, that cannot contain
+// matching observations are skipped.
+// Only one partition is open at a time, and the rows are read as
+// they are needed, so any number of partitions can be scanned.  The
+// rows are returned in the order of the partitions, and by station
+// then date within each partition.
+func (s *Store) Scan(first, last int, f *Filter) *Scanner {
+
+	elem := -1
+	var err error
+	if f != nil && len(s.layout.Elements) > 0 {
+		if f.Element != "" {
+			for k, e := range s.layout.Elements {
+				if e == f.Element {
+					elem = k
+				}
+			}
+			if elem < 0 {
+				err = fmt.Errorf("the store has no element %s", f.Element)
+			}
+		} else if f.Above != nil || f.Below != nil {
+			err = fmt.Errorf("the store has several elements, select one to filter the values")
+		}
+	}
+
+	keepRow, keepPart, keepStats := f.compiled(s.parts, first, last, elem)
+
+	sc := &Scanner{store: s, keep: keepRow, stats: keepStats, elem: elem, err: err}
+	for _, k := range s.keys {
+		if keepPart(k) {
+			sc.keys = append(sc.keys, k)
+		}
+	}
+
+	return sc
+}
+
+// Scanner streams rows from a Store.  Use Next to advance to the next
+// row, Row to obtain it, and Err to check for errors at the end.
+type Scanner struct {
+	store *Store
+	keep  func(*Row) bool
+	stats func(*ColumnStats) bool
+	elem  int
+	keys  []string
+
+	part *partReader
+	row  Row
+	err  error
+}
+
+// Next advances to the next row that passes the filter, and returns
+// false when there are no more rows or an error occurred.
+func (sc *Scanner) Next() bool {
+
+	for sc.err == nil {
+
+		if sc.part == nil {
+			if len(sc.keys) == 0 {
+				return false
+			}
+			dir := path.Join(sc.store.dir, sc.keys[0])
+			sc.keys = sc.keys[1:]
+			sc.part, sc.err = openPart(dir, sc.stats, sc.elem)
+			continue
+		}
+
+		err := sc.part.read(&sc.row)
+		if err == io.EOF {
+			sc.err = sc.part.Close()
+			sc.part = nil
+			continue
+		} else if err != nil {
+			sc.err = err
+			return false
+		}
+
+		if sc.keep(&sc.row) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Row returns the current row.
+func (sc *Scanner) Row() Row {
+	return sc.row
+}
+
+// Err returns the first error encountered by the scanner.
+func (sc *Scanner) Err() error {
+	return sc.err
+}
+
+// Close releases the files held by the scanner.  It is only needed if
+// the scanner is not read to the end.
+func (sc *Scanner) Close() error {
+	if sc.part != nil {
+		err := sc.part.Close()
+		sc.part = nil
+		return err
+	}
+	return nil
+}
+
+// gzFile is a gzip compressed file that is read sequentially.
+type gzFile struct {
+	fid *os.File
+	gz  *gzip.Reader
+	rdr *bufio.Reader
+}
+
+func openGz(fname string) (*gzFile, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(fid)
+	if err != nil {
+		fid.Close()
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return &gzFile{fid: fid, gz: gz, rdr: bufio.NewReader(gz)}, nil
+}
+
+// readValue reads one value from g, stored as described by f, where
+// inv is 1/f.Scale.
+func readValue(g *gzFile, f *Format, inv float64, buf []byte) (float64, error) {
+
+	if f.Values == "int16" {
+		_, err := io.ReadFull(g.rdr, buf[0:2])
+		v := int16(binary.LittleEndian.Uint16(buf[0:2]))
+		return float64(v) / inv, err
+	}
+
+	_, err := io.ReadFull(g.rdr, buf[0:8])
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf[0:8])), err
+}
+
+// seek positions the file at the gzip member that starts at offset,
+// and stops reading at the end of that member.
+func (g *gzFile) seek(offset int64) error {
+
+	_, err := g.fid.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = g.gz.Reset(g.fid)
+	if err != nil {
+		return fmt.Errorf("%s: %v", g.fid.Name(), err)
+	}
+	g.gz.Multistream(false)
+	g.rdr.Reset(g.gz)
+
+	return nil
+}
+
+func (g *gzFile) Close() error {
+	g.gz.Close()
+	return g.fid.Close()
+}
+
+// partReader reads the aligned columns in one partition directory.  If
+// the partition has statistics, only the blocks in blocks are read.
+type partReader struct {
+	dir     string
+	format  *Format
+	stats   *PartStats
+	blocks  []BlockStats
+	left    int // The number of rows left in the current block
+	files   []*gzFile
+	ids     *gzFile
+	dates   *gzFile
+	vals    *gzFile
+	idtable []string
+	inv     float64 // 1/Scale, for int16 values
+	buf     [8]byte
+
+	// For layout version 3: the position of the element that is
+	// returned in Row.Value (or -1), the values of the current row,
+	// and the current byte of each validity bitmap
+	elem   int
+	values []float64
+	valid  []bool
+	bits   []byte
+	nbit   uint
+}
+
+// openPart opens the partition in directory dir.  If the partition
+// has statistics, the blocks for which keep returns false are
+// skipped, and nil is returned if no blocks are kept.  For a partition
+// of several elements, elem is the position of the element whose
+// value is returned in Row.Value, or -1.
+func openPart(dir string, keep func(*ColumnStats) bool, elem int) (*partReader, error) {
+
+	format, err := ReadFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if format.Version < 1 || format.Version > 3 {
+		return nil, fmt.Errorf("%s: unknown layout version %d", dir, format.Version)
+	}
+
+	p := &partReader{dir: dir, format: format, elem: elem}
+	fnames := []string{"ids.gz", "dates.gz", "values.gz"}
+	if format.Version == 3 {
+		nel := len(format.Elements)
+		if elem >= nel {
+			return nil, fmt.Errorf("%s: the partition has %d elements", dir, nel)
+		}
+		p.values = make([]float64, nel)
+		p.valid = make([]bool, nel)
+		p.bits = make([]byte, nel)
+		fnames = fnames[0:2]
+		for _, e := range format.Elements {
+			fnames = append(fnames, "values_"+e+".gz", "valid_"+e+".gz")
+		}
+	}
+
+	if format.Version >= 2 {
+		p.stats, err = ReadStats(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if format.Version == 3 && p.stats == nil {
+		return nil, fmt.Errorf("%s: %s is missing", dir, StatsFile)
+	}
+	if p.stats != nil {
+		if !keep(&p.stats.ColumnStats) {
+			return nil, nil
+		}
+		for _, b := range p.stats.Blocks {
+			if keep(&b.ColumnStats) {
+				p.blocks = append(p.blocks, b)
+			}
+		}
+		if len(p.blocks) == 0 {
+			return nil, nil
+		}
+	}
+
+	// Dividing by 1/Scale rather than multiplying by Scale gives
+	// the exact decimal value for scales such as 0.1.
+	if format.Values == "int16" {
+		if format.Scale <= 0 {
+			return nil, fmt.Errorf("%s: invalid scale %v", dir, format.Scale)
+		}
+		p.inv = 1 / format.Scale
+	}
+
+	if format.Version >= 2 {
+		p.idtable, err = readStrings(path.Join(dir, "idtable.gz"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fn := range fnames {
+		g, err := openGz(path.Join(dir, fn))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.files = append(p.files, g)
+	}
+	p.ids, p.dates, p.vals = p.files[0], p.files[1], p.files[2]
+
+	return p, nil
+}
+
+// readStrings reads a gzip compressed file of newline delimited text.
+func readStrings(fname string) ([]string, error) {
+
+	g, err := openGz(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer g.Close()
+
+	var x []string
+	scanner := bufio.NewScanner(g.rdr)
+	for scanner.Scan() {
+		x = append(x, scanner.Text())
+	}
+
+	return x, scanner.Err()
+}
+
+// read reads the next row, returning io.EOF when all the rows have
+// been read.  An error is returned if a block has fewer rows than its
+// statistics say.
+func (p *partReader) read(r *Row) error {
+
+	if p.stats != nil {
+		for p.left == 0 {
+			if len(p.blocks) == 0 {
+				return io.EOF
+			}
+			b := &p.blocks[0]
+			p.blocks = p.blocks[1:]
+			if len(b.Offsets) != len(p.files) {
+				return fmt.Errorf("%s/%s: a block has %d offsets, expected %d",
+					p.dir, StatsFile, len(b.Offsets), len(p.files))
+			}
+			p.nbit = 0
+			for j, g := range p.files {
+				err := g.seek(b.Offsets[j])
+				if err != nil {
+					return err
+				}
+			}
+			p.left = b.Rows
+		}
+		p.left--
+	}
+
+	var err error
+	switch p.format.Version {
+	case 1:
+		err = p.readV1(r)
+	case 2:
+		err = p.readV2(r)
+	default:
+		err = p.readV3(r)
+	}
+
+	// The block must have as many rows as its statistics say.
+	if err == io.EOF && p.stats != nil {
+		return fmt.Errorf("%s/ids.gz: a block ends %d rows before the end given in %s",
+			p.dir, p.left+1, StatsFile)
+	}
+
+	return err
+}
+
+// readV1 reads the next row of a version 1 partition.  The id string
+// is reused if it has not changed from the previous row.
+func (p *partReader) readV1(r *Row) error {
+
+	id, err := p.ids.rdr.ReadSlice('\n')
+	if err == io.EOF && len(id) == 0 {
+		return io.EOF
+	} else if err != nil {
+		return fmt.Errorf("%s/ids.gz: %v", p.dir, err)
+	}
+	id = id[:len(id)-1]
+	if r.Id != string(id) {
+		r.Id = string(id)
+	}
+
+	da, err := p.dates.rdr.ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("%s/dates.gz: columns are not aligned: %v", p.dir, err)
+	}
+	r.Date, err = ParseDate(strings.TrimSpace(string(da)))
+	if err != nil {
+		return fmt.Errorf("%s/dates.gz: %v", p.dir, err)
+	}
+
+	_, err = io.ReadFull(p.vals.rdr, p.buf[:])
+	if err != nil {
+		return fmt.Errorf("%s/values.gz: columns are not aligned: %v", p.dir, err)
+	}
+	r.Value = math.Float64frombits(binary.LittleEndian.Uint64(p.buf[:]))
+
+	return nil
+}
+
+// readKey reads the station id and date of the next row of a version
+// 2 or 3 partition.
+func (p *partReader) readKey(r *Row) error {
+
+	_, err := io.ReadFull(p.ids.rdr, p.buf[0:4])
+	if err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return fmt.Errorf("%s/ids.gz: %v", p.dir, err)
+	}
+	code := int32(binary.LittleEndian.Uint32(p.buf[0:4]))
+	if code < 0 || int(code) >= len(p.idtable) {
+		return fmt.Errorf("%s/ids.gz: invalid id code %d", p.dir, code)
+	}
+	r.Id = p.idtable[code]
+
+	_, err = io.ReadFull(p.dates.rdr, p.buf[0:4])
+	if err != nil {
+		return fmt.Errorf("%s/dates.gz: columns are not aligned: %v", p.dir, err)
+	}
+	r.Date = Date(int32(binary.LittleEndian.Uint32(p.buf[0:4])))
+
+	return nil
+}
+
+// readV2 reads the next row of a version 2 partition.
+func (p *partReader) readV2(r *Row) error {
+
+	err := p.readKey(r)
+	if err != nil {
+		return err
+	}
+
+	r.Value, err = readValue(p.vals, p.format, p.inv, p.buf[:])
+	if err != nil {
+		return fmt.Errorf("%s/values.gz: columns are not aligned: %v", p.dir, err)
+	}
+	r.Values, r.Valid = nil, nil
+
+	return nil
+}
+
+// readV3 reads the next row of a version 3 partition.
+func (p *partReader) readV3(r *Row) error {
+
+	err := p.readKey(r)
+	if err != nil {
+		return err
+	}
+
+	for k, e := range p.format.Elements {
+		p.values[k], err = readValue(p.files[2+2*k], p.format, p.inv, p.buf[:])
+		if err != nil {
+			return fmt.Errorf("%s/values_%s.gz: columns are not aligned: %v", p.dir, e, err)
+		}
+		if p.nbit == 0 {
+			p.bits[k], err = p.files[3+2*k].rdr.ReadByte()
+			if err != nil {
+				return fmt.Errorf("%s/valid_%s.gz: columns are not aligned: %v", p.dir, e, err)
+			}
+		}
+		p.valid[k] = p.bits[k]&(1<<p.nbit) != 0
+	}
+	p.nbit = (p.nbit + 1) % 8
+
+	r.Values, r.Valid = p.values, p.valid
+	r.Value = math.NaN()
+	if p.elem >= 0 && p.valid[p.elem] {
+		r.Value = p.values[p.elem]
+	}
+
+	return nil
+}
+
+func (p *partReader) Close() error {
+	var err error
+	for _, g := range p.files {
+		if e := g.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,348 @@
+package ghcn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeRows returns the rows of a test store of two elements, by year,
+// sorted by station then date within each year.  The second element
+// is missing in every third row.  The values are multiples of 0.1 so
+// that they are stored exactly as int16 values with a scale of 0.1.
+func storeRows() map[int][]Row {
+
+	rows := make(map[int][]Row)
+	ids := []string{"ASN00086071", "CA006158355", "USW00094728"}
+	k := 0
+	for _, year := range []int{1990, 1991} {
+		for _, id := range ids {
+			for d := 0; d < 365; d += 9 {
+				k++
+				r := Row{Id: id, Date: NewDate(year, 1, 1) + Date(d)}
+				r.Values = []float64{float64(k%500-100) / 10, float64(k%300-200) / 10}
+				r.Valid = []bool{true, k%3 != 0}
+				r.Value = r.Values[0]
+				rows[year] = append(rows[year], r)
+			}
+		}
+	}
+
+	return rows
+}
+
+// writeStore writes the rows to a store in directory dir, partitioned
+// by year, in layout version 1, 2 or 3.  Versions 1 and 2 hold only
+// the first element.  The stores of versions 2 and 3 have small
+// blocks, so that blocks are skipped when they are read.
+func writeStore(dir string, version int, values string, rows map[int][]Row) error {
+
+	var years []int
+	for year := range rows {
+		years = append(years, year)
+	}
+	sort.Ints(years)
+
+	for _, year := range years {
+		rr := rows[year]
+		pdir := filepath.Join(dir, fmt.Sprintf("%d", year))
+		err := os.Mkdir(pdir, 0700)
+		if err != nil {
+			return err
+		}
+
+		// Version 1 is written by hand, as there is no writer
+		// for it any more.
+		if version == 1 {
+			var ids, dates []string
+			for _, r := range rr {
+				ids = append(ids, r.Id)
+				dates = append(dates, r.Date.String())
+			}
+			err = WriteStrings(ids, filepath.Join(pdir, "ids.gz"))
+			if err != nil {
+				return err
+			}
+			err = WriteStrings(dates, filepath.Join(pdir, "dates.gz"))
+			if err != nil {
+				return err
+			}
+			err = writeGz(filepath.Join(pdir, "values.gz"), func(w *bufio.Writer) error {
+				var buf [8]byte
+				for _, r := range rr {
+					binary.LittleEndian.PutUint64(buf[:], math.Float64bits(r.Value))
+					w.Write(buf[:])
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		format := &Format{Values: values, Scale: 0.1}
+		if version == 3 {
+			format.Elements = []string{"TMAX", "TMIN"}
+		}
+		pw, err := NewPartWriter(pdir, format)
+		if err != nil {
+			return err
+		}
+		pw.BlockSize = 20
+		for _, r := range rr {
+			if version == 3 {
+				err = pw.WriteRow(r.Id, r.Date, r.Values, r.Valid)
+			} else {
+				err = pw.Write(r.Id, r.Date, r.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = pw.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch version {
+	case 2:
+		return WriteLayout(dir, &Layout{Partitioning: "year", Years: years})
+	case 3:
+		return WriteLayout(dir, &Layout{Partitioning: "year", Years: years,
+			Elements: []string{"TMAX", "TMIN"}})
+	}
+	return nil
+}
+
+func TestStoreRead(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rows := storeRows()
+	above := 5.0
+	below := -10.0
+
+	for _, st := range []struct {
+		version int
+		values  string
+	}{
+		{1, "float64"},
+		{2, "float64"},
+		{2, "int16"},
+		{3, "float64"},
+		{3, "int16"},
+	} {
+		sdir := filepath.Join(dir, fmt.Sprintf("v%d%s", st.version, st.values))
+		err := os.Mkdir(sdir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeStore(sdir, st.version, st.values, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := OpenStore(sdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if y := s.Years(); len(y) != 2 || y[0] != 1990 || y[1] != 1991 {
+			t.Errorf("version %d %s: years %v", st.version, st.values, y)
+		}
+
+		for _, tc := range []struct {
+			name        string
+			first, last int
+			f           *Filter
+			v3          bool // Whether the filter needs several elements
+			keep        func(r Row, value float64) bool
+		}{
+			{
+				name: "all", first: 1990, last: 1991,
+				keep: func(r Row, value float64) bool { return true },
+			},
+			{
+				name: "one year", first: 1991, last: 2000,
+				keep: func(r Row, value float64) bool { return r.Date >= NewDate(1991, 1, 1) },
+			},
+			{
+				name: "ids", first: 1990, last: 1991,
+				f: &Filter{Ids: []string{"USW00094728", "ASN00086071"}},
+				keep: func(r Row, value float64) bool {
+					return r.Id == "USW00094728" || r.Id == "ASN00086071"
+				},
+			},
+			{
+				name: "prefix", first: 1990, last: 1991,
+				f:    &Filter{Prefix: "CA"},
+				keep: func(r Row, value float64) bool { return strings.HasPrefix(r.Id, "CA") },
+			},
+			{
+				name: "dates", first: 1990, last: 1991,
+				f: &Filter{From: time.Date(1990, 3, 1, 0, 0, 0, 0, time.UTC),
+					To: time.Date(1990, 4, 30, 0, 0, 0, 0, time.UTC)},
+				keep: func(r Row, value float64) bool {
+					return r.Date >= NewDate(1990, 3, 1) && r.Date <= NewDate(1990, 4, 30)
+				},
+			},
+			{
+				name: "above", first: 1990, last: 1991,
+				f:    &Filter{Above: &above, Element: "TMAX"},
+				keep: func(r Row, value float64) bool { return value > above },
+			},
+			{
+				name: "below", first: 1990, last: 1991,
+				f:  &Filter{Below: &below, Element: "TMIN", Prefix: "US"},
+				v3: true,
+				keep: func(r Row, value float64) bool {
+					return r.Valid[1] && value < below && strings.HasPrefix(r.Id, "US")
+				},
+			},
+			{
+				name: "element", first: 1990, last: 1991,
+				f:    &Filter{Element: "TMIN"},
+				v3:   true,
+				keep: func(r Row, value float64) bool { return r.Valid[1] },
+			},
+		} {
+			name := fmt.Sprintf("version %d %s, %s", st.version, st.values, tc.name)
+			if tc.v3 && st.version != 3 {
+				continue
+			}
+
+			// The element is only used in a store of several
+			// elements.  Without one, the values of such a store
+			// are missing.
+			elem := 0
+			if tc.f != nil && tc.f.Element == "TMIN" {
+				elem = 1
+			}
+			want := new(Columns)
+			for _, year := range []int{1990, 1991} {
+				for _, r := range rows[year] {
+					value := r.Values[elem]
+					if st.version == 3 && (tc.f == nil || tc.f.Element == "") {
+						value = math.NaN()
+					}
+					if tc.keep(r, value) {
+						want.Append(Row{Id: r.Id, Date: r.Date, Value: value})
+					}
+				}
+			}
+			f := tc.f
+			if f != nil && st.version != 3 {
+				g := *f
+				g.Element = ""
+				f = &g
+			}
+
+			got, err := s.Read(tc.first, tc.last, f)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got.Len() != want.Len() {
+				t.Errorf("%s: %d rows, expected %d", name, got.Len(), want.Len())
+				continue
+			}
+			for i := 0; i < want.Len(); i++ {
+				if got.Ids[i] != want.Ids[i] || got.Dates[i] != want.Dates[i] ||
+					!near(got.Values[i], want.Values[i], 0) {
+					t.Errorf("%s: row %d is %s %s %v, expected %s %s %v", name, i,
+						got.Ids[i], got.Dates[i], got.Values[i], want.Ids[i], want.Dates[i], want.Values[i])
+					break
+				}
+			}
+		}
+
+		// A store of several elements needs an element to filter the
+		// values, and the element must exist.
+		if st.version == 3 {
+			if _, err := s.Read(1990, 1991, &Filter{Above: &above}); err == nil {
+				t.Errorf("version 3 %s: no error for a value filter without element", st.values)
+			}
+			if _, err := s.Read(1990, 1991, &Filter{Element: "PRCP"}); err == nil {
+				t.Errorf("version 3 %s: no error for an unknown element", st.values)
+			}
+		}
+	}
+}
+
+func TestStoreShortBlock(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, version := range []int{2, 3} {
+		sdir := filepath.Join(dir, fmt.Sprintf("v%d", version))
+		err := os.Mkdir(sdir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeStore(sdir, version, "float64", storeRows())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The statistics of the last block of 1991 claim one row
+		// more than the block has.
+		pdir := filepath.Join(sdir, "1991")
+		st, err := ReadStats(pdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Blocks[len(st.Blocks)-1].Rows++
+		err = WriteStats(pdir, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := OpenStore(sdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Read(1990, 1990, &Filter{}); err != nil {
+			t.Errorf("version %d: %v", version, err)
+		}
+		_, err = s.Read(1990, 1991, &Filter{})
+		if err == nil || !strings.Contains(err.Error(), "1991") {
+			t.Errorf("version %d: a short block gives the error %v", version, err)
+		}
+	}
+}
+
+func TestFormatFits(t *testing.T) {
+
+	for _, tc := range []struct {
+		format Format
+		value  float64
+		fits   bool
+	}{
+		{Format{Values: "float64"}, 1e300, true},
+		{Format{Values: "int16", Scale: 0.1}, 3276.7, true},
+		{Format{Values: "int16", Scale: 0.1}, 3276.74, true},
+		{Format{Values: "int16", Scale: 0.1}, 3276.8, false},
+		{Format{Values: "int16", Scale: 0.1}, -3276.8, true},
+		{Format{Values: "int16", Scale: 0.1}, -3276.9, false},
+		{Format{Values: "int16", Scale: 1}, 40000, false},
+	} {
+		if f := tc.format.Fits(tc.value); f != tc.fits {
+			t.Errorf("%s with scale %v: Fits(%v) is %v", tc.format.Values, tc.format.Scale, tc.value, f)
+		}
+	}
+}
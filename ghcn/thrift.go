@@ -0,0 +1,251 @@
+package ghcn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// This file contains an encoder and a decoder for the Thrift compact
+// protocol, which is used for the metadata of Parquet files (see
+// parquet.go).  Only the parts of the protocol used by Parquet are
+// supported, in particular maps are not.
+//
+// See https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+
+// Compact protocol type codes
+const (
+	tTrue   = 1
+	tFalse  = 2
+	tByte   = 3
+	tI16    = 4
+	tI32    = 5
+	tI64    = 6
+	tDouble = 7
+	tBinary = 8
+	tList   = 9
+	tSet    = 10
+	tMap    = 11
+	tStruct = 12
+)
+
+// thriftWriter encodes structs with the compact protocol.  A struct
+// is written by calling begin, writing its fields in increasing
+// order of field id, and calling end.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // The last field id written in each open struct
+}
+
+func (w *thriftWriter) varint(x uint64) {
+	w.buf = binary.AppendUvarint(w.buf, x)
+}
+
+func (w *thriftWriter) zigzag(x int64) {
+	w.varint(uint64((x << 1) ^ (x >> 63)))
+}
+
+func (w *thriftWriter) bytes(b []byte) {
+	w.varint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// field writes a field header.  Field ids are stored as the
+// difference from the previous field id when possible.
+func (w *thriftWriter) field(id int16, typ byte) {
+	k := len(w.last) - 1
+	if d := id - w.last[k]; d > 0 && d <= 15 {
+		w.buf = append(w.buf, byte(d)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.zigzag(int64(id))
+	}
+	w.last[k] = id
+}
+
+func (w *thriftWriter) begin() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) end() {
+	w.buf = append(w.buf, 0)
+	w.last = w.last[0 : len(w.last)-1]
+}
+
+// structField starts a struct valued field, which is closed by
+// calling end.
+func (w *thriftWriter) structField(id int16) {
+	w.field(id, tStruct)
+	w.begin()
+}
+
+func (w *thriftWriter) i32(id int16, x int32) {
+	w.field(id, tI32)
+	w.zigzag(int64(x))
+}
+
+func (w *thriftWriter) i64(id int16, x int64) {
+	w.field(id, tI64)
+	w.zigzag(x)
+}
+
+func (w *thriftWriter) binary(id int16, b []byte) {
+	w.field(id, tBinary)
+	w.bytes(b)
+}
+
+func (w *thriftWriter) bool(id int16, v bool) {
+	if v {
+		w.field(id, tTrue)
+	} else {
+		w.field(id, tFalse)
+	}
+}
+
+// list starts a list valued field with n elements of the given type.
+// The elements are then written with zigzag, bytes, or begin/end.
+func (w *thriftWriter) list(id int16, typ byte, n int) {
+	w.field(id, tList)
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|typ)
+	} else {
+		w.buf = append(w.buf, 0xF0|typ)
+		w.varint(uint64(n))
+	}
+}
+
+// tstruct is a decoded struct, mapping field ids to values.  The
+// values are bool, int64 (for all integer types), float64, []byte,
+// []interface{} (for lists and sets) or tstruct.
+type tstruct map[int16]interface{}
+
+// int returns the value of an integer field, or def if the field is
+// not present.
+func (s tstruct) int(id int16, def int64) int64 {
+	if v, ok := s[id].(int64); ok {
+		return v
+	}
+	return def
+}
+
+func (s tstruct) bytes(id int16) []byte {
+	b, _ := s[id].([]byte)
+	return b
+}
+
+func (s tstruct) strct(id int16) tstruct {
+	t, _ := s[id].(tstruct)
+	return t
+}
+
+func (s tstruct) list(id int16) []interface{} {
+	x, _ := s[id].([]interface{})
+	return x
+}
+
+var errThrift = errors.New("thrift: truncated data")
+
+// thriftReader decodes compact protocol data.  Errors are sticky, and
+// should be checked after the struct is read.
+type thriftReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.b) {
+		r.err = errThrift
+		return 0
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *thriftReader) varint() uint64 {
+	x, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		r.err = errThrift
+		r.pos = len(r.b)
+		return 0
+	}
+	r.pos += n
+	return x
+}
+
+func (r *thriftReader) zigzag() int64 {
+	x := r.varint()
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case tTrue:
+		return true
+	case tFalse:
+		return false
+	case tByte:
+		return int64(int8(r.byte()))
+	case tI16, tI32, tI64:
+		return r.zigzag()
+	case tDouble:
+		if r.pos+8 > len(r.b) {
+			r.err = errThrift
+			return 0.0
+		}
+		x := math.Float64frombits(binary.LittleEndian.Uint64(r.b[r.pos:]))
+		r.pos += 8
+		return x
+	case tBinary:
+		n := int(r.varint())
+		if n < 0 || r.pos+n > len(r.b) {
+			r.err = errThrift
+			return []byte(nil)
+		}
+		b := r.b[r.pos : r.pos+n]
+		r.pos += n
+		return b
+	case tList, tSet:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.varint())
+		}
+		var x []interface{}
+		for i := 0; i < n && r.err == nil; i++ {
+			if t := h & 0x0F; t == tTrue || t == tFalse {
+				// Booleans in lists are stored in one byte
+				x = append(x, r.byte() == 1)
+			} else {
+				x = append(x, r.value(h&0x0F))
+			}
+		}
+		return x
+	case tStruct:
+		return r.readStruct()
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("thrift: unsupported type %d", typ)
+	}
+	return nil
+}
+
+func (r *thriftReader) readStruct() tstruct {
+	s := make(tstruct)
+	var last int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			break
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		last = id
+		s[id] = r.value(h & 0x0F)
+	}
+	return s
+}
@@ -0,0 +1,217 @@
+package ghcn
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Trend contains the results of the trend analyses of one time series.
+// All slopes are in units per decade.  Results that cannot be computed
+// (e.g. because the series is too short) are NaN.
+type Trend struct {
+	N      int // The number of observations used
+	Nyears int // The number of distinct years with observations
+
+	// Ordinary least squares slope, with confidence interval and
+	// the p-value of the t-test for zero slope
+	OLS      float64
+	OLSLower float64
+	OLSUpper float64
+	OLSP     float64
+
+	// Theil-Sen slope (the median of the pairwise slopes), with
+	// the confidence interval of Sen (1968)
+	Sen      float64
+	SenLower float64
+	SenUpper float64
+
+	// Kendall's tau and the p-value of the Mann-Kendall test for
+	// a monotone trend (normal approximation, corrected for ties)
+	MKTau float64
+	MKP   float64
+}
+
+// TrendHeader is the CSV header for the fields written by Trend.CSV.
+const TrendHeader = "N,Nyears,OLS,OLSLower,OLSUpper,OLSP,Sen,SenLower,SenUpper,MKTau,MKP"
+
+// formatP formats a p-value, using enough significant digits for
+// small values.  NaN values are written as empty fields.
+func formatP(p float64) string {
+	if math.IsNaN(p) {
+		return ""
+	}
+	return strconv.FormatFloat(p, 'g', 4, 64)
+}
+
+// CSV returns the fields of the trend in the order given by
+// TrendHeader, formatted as comma separated values.
+func (tr *Trend) CSV() string {
+	return fmt.Sprintf("%d,%d,%s,%s,%s,%s,%s,%s,%s,%s,%s", tr.N, tr.Nyears,
+		FormatValue(tr.OLS), FormatValue(tr.OLSLower),
+		FormatValue(tr.OLSUpper), formatP(tr.OLSP), FormatValue(tr.Sen),
+		FormatValue(tr.SenLower), FormatValue(tr.SenUpper),
+		FormatValue(tr.MKTau), formatP(tr.MKP))
+}
+
+// EstimateTrend estimates the trend in the series y observed at times t
+// (in fractional years).  The confidence intervals have coverage
+// probability level (e.g. 0.95).
+func EstimateTrend(t, y []float64, level float64) *Trend {
+
+	nan := math.NaN()
+	tr := &Trend{N: len(y), OLS: nan, OLSLower: nan, OLSUpper: nan, OLSP: nan,
+		Sen: nan, SenLower: nan, SenUpper: nan, MKTau: nan, MKP: nan}
+
+	years := make(map[int]bool)
+	for _, u := range t {
+		years[int(math.Floor(u))] = true
+	}
+	tr.Nyears = len(years)
+
+	if len(y) < 3 {
+		return tr
+	}
+
+	tr.ols(t, y, level)
+	tr.mannKendall(t, y, level)
+
+	return tr
+}
+
+// ols computes the least squares slope.
+func (tr *Trend) ols(t, y []float64, level float64) {
+
+	n := float64(len(y))
+	var tbar, ybar float64
+	for i := range y {
+		tbar += t[i]
+		ybar += y[i]
+	}
+	tbar /= n
+	ybar /= n
+
+	var sxx, sxy float64
+	for i := range y {
+		sxx += (t[i] - tbar) * (t[i] - tbar)
+		sxy += (t[i] - tbar) * (y[i] - ybar)
+	}
+	if sxx == 0 {
+		return
+	}
+	b := sxy / sxx
+	a := ybar - b*tbar
+
+	var sse float64
+	for i := range y {
+		r := y[i] - a - b*t[i]
+		sse += r * r
+	}
+	df := n - 2
+	se := math.Sqrt(sse / df / sxx)
+	q := tQuantile(1-(1-level)/2, df)
+
+	tr.OLS = 10 * b
+	tr.OLSLower = 10 * (b - q*se)
+	tr.OLSUpper = 10 * (b + q*se)
+	if se > 0 {
+		tr.OLSP = 2 * (1 - tCDF(math.Abs(b/se), df))
+	} else {
+		tr.OLSP = 0
+	}
+}
+
+// mannKendall computes the Theil-Sen slope and the Mann-Kendall test.
+func (tr *Trend) mannKendall(t, y []float64, level float64) {
+
+	n := len(y)
+
+	// The Mann-Kendall statistic and the pairwise slopes
+	var s float64
+	var slopes []float64
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			dt := t[j] - t[i]
+			if dt == 0 {
+				continue
+			}
+			d := (y[j] - y[i]) * math.Copysign(1, dt)
+			switch {
+			case d > 0:
+				s++
+			case d < 0:
+				s--
+			}
+			slopes = append(slopes, (y[j]-y[i])/dt)
+		}
+	}
+	if len(slopes) == 0 {
+		return
+	}
+
+	// Variance of S, corrected for ties in y
+	z := make([]float64, n)
+	copy(z, y)
+	sort.Float64s(z)
+	nf := float64(n)
+	vs := nf * (nf - 1) * (2*nf + 5)
+	for i := 0; i < n; {
+		j := i
+		for j < n && z[j] == z[i] {
+			j++
+		}
+		g := float64(j - i)
+		vs -= g * (g - 1) * (2*g + 5)
+		i = j
+	}
+	vs /= 18
+
+	tr.MKTau = s / (nf * (nf - 1) / 2)
+	if vs > 0 {
+		var zs float64
+		switch {
+		case s > 0:
+			zs = (s - 1) / math.Sqrt(vs)
+		case s < 0:
+			zs = (s + 1) / math.Sqrt(vs)
+		}
+		tr.MKP = 2 * (1 - normCDF(math.Abs(zs)))
+	}
+
+	// The Theil-Sen slope and its confidence interval
+	sort.Float64s(slopes)
+	m := len(slopes)
+	if m%2 == 1 {
+		tr.Sen = 10 * slopes[m/2]
+	} else {
+		tr.Sen = 10 * (slopes[m/2-1] + slopes[m/2]) / 2
+	}
+
+	c := normQuantile(1-(1-level)/2) * math.Sqrt(vs)
+	lo := int(math.Round((float64(m)-c)/2)) - 1
+	hi := int(math.Round((float64(m) + c) / 2))
+	if lo >= 0 && hi < m {
+		tr.SenLower = 10 * slopes[lo]
+		tr.SenUpper = 10 * slopes[hi]
+	}
+}
+
+// Deseasonalize removes the mean of each calendar month from a monthly
+// series.  month contains the calendar month (1..12) of each value.
+func Deseasonalize(month []int, y []float64) []float64 {
+
+	var sum [13]float64
+	var n [13]int
+	for i, v := range y {
+		sum[month[i]] += v
+		n[month[i]]++
+	}
+
+	z := make([]float64, len(y))
+	for i, v := range y {
+		z[i] = v - sum[month[i]]/float64(n[month[i]])
+	}
+
+	return z
+}
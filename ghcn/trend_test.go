@@ -0,0 +1,150 @@
+package ghcn
+
+import (
+	"math"
+	"testing"
+)
+
+// near reports whether x and y agree to within tol, relative to the
+// size of y if it is larger than one.  Two NaN values agree.
+func near(x, y, tol float64) bool {
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return math.IsNaN(x) && math.IsNaN(y)
+	}
+	return math.Abs(x-y) <= tol*math.Max(1, math.Abs(y))
+}
+
+func TestTQuantile(t *testing.T) {
+
+	// From a table of the Student t distribution
+	for _, tc := range []struct {
+		p, df float64
+		q     float64
+	}{
+		{0.975, 1, 12.706205},
+		{0.975, 2, 4.302653},
+		{0.975, 5, 2.570582},
+		{0.975, 8, 2.306004},
+		{0.975, 10, 2.228139},
+		{0.975, 30, 2.042272},
+		{0.975, 1000, 1.962339},
+		{0.95, 10, 1.812461},
+		{0.995, 5, 4.032143},
+		{0.9, 20, 1.325341},
+		{0.5, 7, 0},
+		{0.025, 10, -2.228139},
+	} {
+		q := tQuantile(tc.p, tc.df)
+		if math.Abs(q-tc.q) > 1e-5 {
+			t.Errorf("tQuantile(%v, %v) is %v, expected %v", tc.p, tc.df, q, tc.q)
+		}
+		if p := tCDF(q, tc.df); math.Abs(p-tc.p) > 1e-9 {
+			t.Errorf("tCDF(%v, %v) is %v, expected %v", q, tc.df, p, tc.p)
+		}
+	}
+}
+
+func TestEstimateTrend(t *testing.T) {
+
+	nan := math.NaN()
+	years := func(n int) []float64 {
+		t := make([]float64, n)
+		for i := range t {
+			t[i] = 2000 + float64(i)
+		}
+		return t
+	}
+
+	for _, tc := range []struct {
+		name string
+		t, y []float64
+		want Trend
+	}{
+		{
+			// The expected values were computed from the
+			// textbook formulas, with the p-value of the
+			// t-test found by numerical integration of the t
+			// density.  The value 2.3 is tied.
+			name: "noisy",
+			t:    years(10),
+			y:    []float64{1.2, 0.8, 1.9, 1.5, 2.3, 2.0, 2.8, 2.3, 3.1, 3.0},
+			want: Trend{N: 10, Nyears: 10,
+				OLS: 2.296969697, OLSLower: 1.428444800, OLSUpper: 3.165494594, OLSP: 0.0002899048,
+				Sen: 2.375, SenLower: 1.5, SenUpper: 3.285714286,
+				MKTau: 34.0 / 45, MKP: 0.003041744},
+		},
+		{
+			name: "linear",
+			t:    years(5),
+			y:    []float64{1, 1.5, 2, 2.5, 3},
+			want: Trend{N: 5, Nyears: 5,
+				OLS: 5, OLSLower: 5, OLSUpper: 5, OLSP: 0,
+				Sen: 5, SenLower: 5, SenUpper: 5,
+				MKTau: 1, MKP: 0.02748633611},
+		},
+		{
+			// Quarterly values with a decreasing trend, where
+			// the value 1 is tied
+			name: "quarterly",
+			t:    []float64{2000, 2000.25, 2000.5, 2000.75, 2001, 2001.25},
+			y:    []float64{3, 2, 2.5, 1, 0.5, 1},
+			want: Trend{N: 6, Nyears: 2,
+				OLS: -18.285714286, OLSLower: -32.681616624, OLSUpper: -3.889811947, OLSP: 0.02430387183,
+				Sen: -20, SenLower: -40, SenUpper: 20,
+				MKTau: -10.0 / 15, MKP: 0.08516790588},
+		},
+		{
+			name: "short",
+			t:    years(2),
+			y:    []float64{1, 2},
+			want: Trend{N: 2, Nyears: 2, OLS: nan, OLSLower: nan, OLSUpper: nan, OLSP: nan,
+				Sen: nan, SenLower: nan, SenUpper: nan, MKTau: nan, MKP: nan},
+		},
+		{
+			name: "one time",
+			t:    []float64{2000, 2000, 2000},
+			y:    []float64{1, 2, 3},
+			want: Trend{N: 3, Nyears: 1, OLS: nan, OLSLower: nan, OLSUpper: nan, OLSP: nan,
+				Sen: nan, SenLower: nan, SenUpper: nan, MKTau: nan, MKP: nan},
+		},
+	} {
+		got := EstimateTrend(tc.t, tc.y, 0.95)
+		if got.N != tc.want.N || got.Nyears != tc.want.Nyears {
+			t.Errorf("%s: N=%d, Nyears=%d, expected %d and %d", tc.name,
+				got.N, got.Nyears, tc.want.N, tc.want.Nyears)
+		}
+		for _, f := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"OLS", got.OLS, tc.want.OLS},
+			{"OLSLower", got.OLSLower, tc.want.OLSLower},
+			{"OLSUpper", got.OLSUpper, tc.want.OLSUpper},
+			{"OLSP", got.OLSP, tc.want.OLSP},
+			{"Sen", got.Sen, tc.want.Sen},
+			{"SenLower", got.SenLower, tc.want.SenLower},
+			{"SenUpper", got.SenUpper, tc.want.SenUpper},
+			{"MKTau", got.MKTau, tc.want.MKTau},
+			{"MKP", got.MKP, tc.want.MKP},
+		} {
+			if !near(f.got, f.want, 1e-6) {
+				t.Errorf("%s: %s is %v, expected %v", tc.name, f.name, f.got, f.want)
+			}
+		}
+	}
+}
+
+func TestDeseasonalize(t *testing.T) {
+
+	month := []int{1, 2, 1, 2, 3}
+	y := []float64{1, 10, 3, 20, 5}
+	want := []float64{-1, -5, 1, 5, 0}
+
+	z := Deseasonalize(month, y)
+	for i := range want {
+		if z[i] != want[i] {
+			t.Errorf("Deseasonalize gives %v, expected %v", z, want)
+			break
+		}
+	}
+}